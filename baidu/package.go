@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/marcozac/go-jsonc"
@@ -52,16 +55,21 @@ type BaiduAutocompleteType struct {
 type CityUIDMapping struct {
 	BaiduID        string
 	MetromanCode   string
-	ChelaileCode   string
+	ChelaileCode   string // 3 digits like "027", empty if the city is not on Chelaile
 	EnglishName    string
 	SimplifiedName string
 }
 
 type BaiduServer struct {
-	TextTemplates                 *template.Template
-	Auth                          string
-	Headers                       map[string]string
+	TextTemplates *template.Template
+	// Replaced together by RefreshAuth, read through CurrentAuth
+	auth      string
+	headers   map[string]string
+	auth_lock sync.RWMutex
+
+	// Replaced by RefreshSubwayCities, read through SubwayVersion and GetCityCrossDistance when it may run concurrently
 	BaiduSubwayCities             BaiduSubwayCities
+	subway_cities_lock            sync.RWMutex
 	CityUIDMappings               []CityUIDMapping
 	CityUIDMappingsByMetromanCode map[string]CityUIDMapping
 }
@@ -79,8 +87,8 @@ func CreateServer() (*BaiduServer, error) {
 
 	s := &BaiduServer{
 		TextTemplates: text_templates,
-		Auth:          auth,
-		Headers:       headers,
+		auth:          auth,
+		headers:       headers,
 	}
 
 	s.BaiduSubwayCities, err = s.GetBaiduSubwayCities()
@@ -164,11 +172,13 @@ func GetAuthAndHeaders(templates *template.Template) (string, map[string]string,
 }
 
 func (s *BaiduServer) GetAutocomplete(metroman_city string, search_query string) (BaiduAutocomplete, error) {
+	auth, headers := s.CurrentAuth()
+
 	var url_buf bytes.Buffer
 	err := s.TextTemplates.ExecuteTemplate(&url_buf, "baidu_autocomplete_url.gotxt",
 		map[string]interface{}{
 			"SearchQuery": search_query,
-			"Auth":        s.Auth,
+			"Auth":        auth,
 			"CityID":      s.CityUIDMappingsByMetromanCode[metroman_city].BaiduID,
 			"Timestamp":   time.Now().UnixMilli(),
 		})
@@ -186,7 +196,7 @@ func (s *BaiduServer) GetAutocomplete(metroman_city string, search_query string)
 	}
 
 	// Add standard Baidu Maps headers
-	for name, header := range s.Headers {
+	for name, header := range headers {
 		req.Header.Add(name, header)
 	}
 
@@ -227,12 +237,29 @@ func GetAutocompleteStation(autocomplete BaiduAutocomplete) (BaiduAutocompleteEn
 	return BaiduAutocompleteEntry{}, false
 }
 
+// Names of up to limit non-station entries containing keyword, like "停车场" for parking near a station
+func GetAutocompleteFacilities(autocomplete BaiduAutocomplete, keyword string, limit int) []string {
+	facilities := []string{}
+	for _, entry := range autocomplete.Content {
+		if len(facilities) >= limit {
+			break
+		}
+		if entry.GeoType != 2 && strings.Contains(entry.Name, keyword) {
+			facilities = append(facilities, entry.Name)
+		}
+	}
+
+	return facilities
+}
+
 func (s *BaiduServer) GetAutocompleteType(search_query string) ([]string, error) {
+	auth, headers := s.CurrentAuth()
+
 	var url_buf bytes.Buffer
 	err := s.TextTemplates.ExecuteTemplate(&url_buf, "baidu_autocomplete_type_url.gotxt",
 		map[string]interface{}{
 			"SearchQuery": search_query,
-			"Auth":        s.Auth,
+			"Auth":        auth,
 			"Timestamp":   time.Now().UnixMilli(),
 		})
 	if err != nil {
@@ -249,7 +276,7 @@ func (s *BaiduServer) GetAutocompleteType(search_query string) ([]string, error)
 	}
 
 	// Add standard Baidu Maps headers
-	for name, header := range s.Headers {
+	for name, header := range headers {
 		req.Header.Add(name, header)
 	}
 
@@ -291,18 +318,83 @@ func GetAutocompleteTypeStation(autocomplete_entries []string) (string, bool) {
 	return "", false
 }
 
+// Auth and headers as one consistent pair
+func (s *BaiduServer) CurrentAuth() (string, map[string]string) {
+	s.auth_lock.RLock()
+	defer s.auth_lock.RUnlock()
+
+	return s.auth, s.headers
+}
+
+// Fetch a new auth token, safe to call while other requests are running
+func (s *BaiduServer) RefreshAuth() error {
+	auth, headers, err := GetAuthAndHeaders(s.TextTemplates)
+	if err != nil {
+		return err
+	}
+
+	s.auth_lock.Lock()
+	defer s.auth_lock.Unlock()
+
+	s.auth = auth
+	s.headers = headers
+
+	return nil
+}
+
+// Check the homepage is reachable and still hands out an auth token
+func (s *BaiduServer) Ping() error {
+	_, headers := s.CurrentAuth()
+
+	req, err := http.NewRequest("GET", "https://map.baidu.com", nil)
+	if err != nil {
+		return fmt.Errorf("could not request homepage: %v", err)
+	}
+
+	// Add standard Baidu Maps headers
+	for name, header := range headers {
+		req.Header.Add(name, header)
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach homepage: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("homepage returned HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read homepage: %v", err)
+	}
+
+	if !strings.Contains(string(body), "window.AUTH = \"") {
+		return fmt.Errorf("homepage no longer contains an auth token")
+	}
+
+	return nil
+}
+
 func (s *BaiduServer) GetBaiduSubwayCities() (BaiduSubwayCities, error) {
+	auth, headers := s.CurrentAuth()
+
 	// Create a new request to Baidu Maps
 	// Remove just tabs and newlines
 	req, err := http.NewRequest("GET",
-		fmt.Sprintf("https://map.baidu.com/?qt=subwayscity&t=%d&auth=%s&pcevaname=pc4.1&newfrom=zhuzhan_webmap", time.Now().UnixMilli(), s.Auth),
+		fmt.Sprintf("https://map.baidu.com/?qt=subwayscity&t=%d&auth=%s&pcevaname=pc4.1&newfrom=zhuzhan_webmap", time.Now().UnixMilli(), auth),
 		nil)
 	if err != nil {
 		return BaiduSubwayCities{}, fmt.Errorf("could not create subway cities request: %v", err)
 	}
 
 	// Add standard Baidu Maps headers
-	for name, header := range s.Headers {
+	for name, header := range headers {
 		req.Header.Add(name, header)
 	}
 
@@ -330,6 +422,49 @@ func (s *BaiduServer) GetBaiduSubwayCities() (BaiduSubwayCities, error) {
 	return subway_cities, nil
 }
 
+// Baidu bumps this whenever its subway data changes in any city, a hint MetroMan may follow
+func (s *BaiduServer) SubwayVersion() string {
+	s.subway_cities_lock.RLock()
+	defer s.subway_cities_lock.RUnlock()
+	return s.BaiduSubwayCities.Result.SubwayVersion
+}
+
+// Fetch the subway cities again, changed is true when the subway version differs from the last seen one
+func (s *BaiduServer) RefreshSubwayCities() (bool, error) {
+	subway_cities, err := s.GetBaiduSubwayCities()
+	if err != nil {
+		return false, err
+	}
+
+	s.subway_cities_lock.Lock()
+	defer s.subway_cities_lock.Unlock()
+
+	changed := subway_cities.Result.SubwayVersion != s.BaiduSubwayCities.Result.SubwayVersion
+	s.BaiduSubwayCities = subway_cities
+
+	return changed, nil
+}
+
+// Baidu's cxfDis for a city, non-zero values appear to mark distance-based fares.
+// Returns false if the city is not in Baidu's subway cities
+func (s *BaiduServer) GetCityCrossDistance(metroman_code string) (int, bool) {
+	mapping, ok := s.CityUIDMappingsByMetromanCode[metroman_code]
+	if !ok {
+		return 0, false
+	}
+
+	s.subway_cities_lock.RLock()
+	defer s.subway_cities_lock.RUnlock()
+
+	for _, city := range s.BaiduSubwayCities.SubwaysCity.Cities {
+		if strconv.Itoa(city.Code) == mapping.BaiduID {
+			return city.CxfDis, true
+		}
+	}
+
+	return 0, false
+}
+
 func (s *BaiduServer) LoadCityUIDMappings() ([]CityUIDMapping, error) {
 	file, err := os.Open("baidu_city_uid_to_city.csv")
 	if err != nil {
@@ -360,8 +495,35 @@ func (s *BaiduServer) LoadCityUIDMappings() ([]CityUIDMapping, error) {
 			EnglishName:    record[3],
 			SimplifiedName: record[4],
 		}
+
+		if mapping.ChelaileCode != "" && !IsValidChelaileCode(mapping.ChelaileCode) {
+			log.Printf("ignoring invalid chelaile code %q for %s", mapping.ChelaileCode, mapping.MetromanCode)
+			mapping.ChelaileCode = ""
+		}
+
 		mappings = append(mappings, mapping)
 	}
 
 	return mappings, nil
 }
+
+// Chelaile city codes are 3 digits with leading zeroes
+func IsValidChelaileCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BaiduServer) GetChelaileCode(metroman_code string) (string, bool) {
+	mapping, ok := s.CityUIDMappingsByMetromanCode[metroman_code]
+	if !ok || mapping.ChelaileCode == "" {
+		return "", false
+	}
+	return mapping.ChelaileCode, true
+}
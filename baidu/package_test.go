@@ -0,0 +1,240 @@
+package baidu_client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Trimmed qt=subwayscity response, 131 is distance-based and 332 is not
+const test_subway_cities_json = `{
+	"result": {"type": "subwayscity", "error": "0", "subwayVersion": "20250615"},
+	"subways_city": {"cities": [
+		{"cn_name": "北京", "cename": "beijing", "code": 131, "cpre": "bj", "cxfDis": 1},
+		{"cn_name": "天津", "cename": "tianjin", "code": 332, "cpre": "tj"}
+	]}
+}`
+
+// A server with mappings for bj, tj and the unlisted xx, built without touching the network
+func newTestServer(t testing.TB) *BaiduServer {
+	t.Helper()
+
+	s := &BaiduServer{
+		CityUIDMappingsByMetromanCode: map[string]CityUIDMapping{
+			"bj": {BaiduID: "131", MetromanCode: "bj", ChelaileCode: "027", EnglishName: "Beijing", SimplifiedName: "北京"},
+			"tj": {BaiduID: "332", MetromanCode: "tj", EnglishName: "Tianjin", SimplifiedName: "天津"},
+			"xx": {BaiduID: "999", MetromanCode: "xx", EnglishName: "Test City", SimplifiedName: "测试"},
+		},
+	}
+	if err := json.Unmarshal([]byte(test_subway_cities_json), &s.BaiduSubwayCities); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Serve every request to Baidu from handler until the test ends, a nil handler fails every request like an outage
+func mockTransport(t testing.TB, handler http.HandlerFunc) {
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if handler == nil {
+			return nil, errors.New("connection refused")
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		return recorder.Result(), nil
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+}
+
+func TestGetCityCrossDistance(t *testing.T) {
+	s := newTestServer(t)
+
+	if cross_distance, ok := s.GetCityCrossDistance("bj"); !ok || cross_distance != 1 {
+		t.Errorf("expected cxfDis 1 for bj, got %d %v", cross_distance, ok)
+	}
+	// Omitted cxfDis is 0
+	if cross_distance, ok := s.GetCityCrossDistance("tj"); !ok || cross_distance != 0 {
+		t.Errorf("expected cxfDis 0 for tj, got %d %v", cross_distance, ok)
+	}
+	if _, ok := s.GetCityCrossDistance("xx"); ok {
+		t.Errorf("expected xx to be missing from the subway cities")
+	}
+	if _, ok := s.GetCityCrossDistance("zz"); ok {
+		t.Errorf("expected zz to have no mapping")
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		err     string
+	}{
+		{"down", nil, "could not reach homepage"},
+		{"error page", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}, "HTTP 503"},
+		{"no auth token", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html>captcha</html>"))
+		}, "no longer contains an auth token"},
+		{"up", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`<script>window.AUTH = "token";</script>`))
+		}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mockTransport(t, test.handler)
+
+			err := s.Ping()
+			if test.err == "" && err != nil {
+				t.Errorf("expected Baidu to be reachable, got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestGetAutocompleteWhileRefreshingAuth(t *testing.T) {
+	s := newTestServer(t)
+	text_templates, err := template.ParseGlob("../*.gotxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TextTemplates = text_templates
+
+	// Every homepage load hands out a new token, autocomplete echoes the token it was sent
+	var tokens atomic.Int64
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("qt") == "s" {
+			fmt.Fprintf(w, `{"content": [{"name": %q, "uid": %q}]}`, r.URL.Query().Get("wd"), r.URL.Query().Get("auth"))
+			return
+		}
+		fmt.Fprintf(w, `window.AUTH = "token%02d%s";`, tokens.Add(1), strings.Repeat("x", 40))
+	})
+	if err := s.RefreshAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wait_group sync.WaitGroup
+	wait_group.Add(1)
+	go func() {
+		defer wait_group.Done()
+		for range 20 {
+			if err := s.RefreshAuth(); err != nil {
+				t.Errorf("could not refresh auth: %v", err)
+			}
+		}
+	}()
+
+	for i := range 50 {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+
+			search_query := fmt.Sprintf("站%d", i)
+			autocomplete, err := s.GetAutocomplete("bj", search_query)
+			if err != nil {
+				t.Errorf("could not autocomplete: %v", err)
+				return
+			}
+			if len(autocomplete.Content) != 1 || autocomplete.Content[0].Name != search_query || !strings.HasPrefix(autocomplete.Content[0].UID, "token") {
+				t.Errorf("unexpected autocomplete %+v", autocomplete)
+			}
+		}()
+	}
+	wait_group.Wait()
+
+	if auth, _ := s.CurrentAuth(); !strings.HasPrefix(auth, "token21") {
+		t.Errorf("expected the last refresh to win, got %s", auth)
+	}
+}
+
+func TestChelaileCodes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	mappings_csv := "baidu_id,metroman_code,chelaile_code,english_name,simplified_name\n" +
+		"131,bj,027,Beijing,北京\n" +
+		"289,sh,34,Shanghai,上海\n" +
+		"332,tj,,Tianjin,天津\n"
+	if err := os.WriteFile("baidu_city_uid_to_city.csv", []byte(mappings_csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, err := (&BaiduServer{}).LoadCityUIDMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &BaiduServer{CityUIDMappingsByMetromanCode: map[string]CityUIDMapping{}}
+	for _, mapping := range mappings {
+		s.CityUIDMappingsByMetromanCode[mapping.MetromanCode] = mapping
+	}
+
+	if chelaile_code, ok := s.GetChelaileCode("bj"); !ok || chelaile_code != "027" {
+		t.Errorf("expected 027 for bj, got %q %v", chelaile_code, ok)
+	}
+	// Not 3 digits, dropped while loading
+	if chelaile_code, ok := s.GetChelaileCode("sh"); ok {
+		t.Errorf("expected the invalid code for sh to be ignored, got %q", chelaile_code)
+	}
+	if _, ok := s.GetChelaileCode("tj"); ok {
+		t.Errorf("expected no code for tj")
+	}
+	if _, ok := s.GetChelaileCode("zz"); ok {
+		t.Errorf("expected no code without a mapping")
+	}
+}
+
+func TestRefreshSubwayCitiesDetectsNewVersion(t *testing.T) {
+	s := newTestServer(t)
+	if version := s.SubwayVersion(); version != "20250615" {
+		t.Fatalf("expected subway version 20250615, got %q", version)
+	}
+
+	subway_cities_json := test_subway_cities_json
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(subway_cities_json))
+	})
+
+	if changed, err := s.RefreshSubwayCities(); err != nil || changed {
+		t.Errorf("expected the same version to be unchanged, got %v %v", changed, err)
+	}
+
+	// Tianjin becomes distance-based in a new version
+	subway_cities_json = strings.Replace(strings.Replace(test_subway_cities_json, "20250615", "20250701", 1), `"cpre": "tj"`, `"cpre": "tj", "cxfDis": 1`, 1)
+	if changed, err := s.RefreshSubwayCities(); err != nil || !changed {
+		t.Errorf("expected a new version to be detected, got %v %v", changed, err)
+	}
+	if version := s.SubwayVersion(); version != "20250701" {
+		t.Errorf("expected subway version 20250701, got %q", version)
+	}
+	if cross_distance, _ := s.GetCityCrossDistance("tj"); cross_distance != 1 {
+		t.Errorf("expected the refreshed cxfDis for tj, got %d", cross_distance)
+	}
+
+	// A failed refresh keeps the last subway cities
+	mockTransport(t, nil)
+	if _, err := s.RefreshSubwayCities(); err == nil {
+		t.Errorf("expected the refresh to fail with Baidu down")
+	}
+	if version := s.SubwayVersion(); version != "20250701" {
+		t.Errorf("expected subway version 20250701 to be kept, got %q", version)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gorilla/mux"
 	"tgrcode.com/china_gtfs"
+	"tgrcode.com/metroman_client"
 )
 
 func main() {
@@ -22,109 +29,373 @@ func main() {
 	flag_preload_with_server := flag.Bool("metroman-preload-all", false, "Preload cities before starting server")
 	flag_port := flag.String("port", "8080", "Port to listen on for the HTTP server")
 	flag_city_csv := flag.String("city-csv", "baidu_city_uid_to_city.csv", "Path to baidu_city_uid_to_city.csv")
+	flag_offline := flag.Bool("offline", false, "Generate without contacting Baidu")
+	flag_versions_cache := flag.String("versions-cache", "", "File to cache MetroMan's version.txt in, used when the fetch fails")
+	flag_allow_missing_versions := flag.Bool("allow-missing-versions", false, "Start even if MetroMan's version.txt cannot be fetched")
+	flag_zip_compression := flag.String("zip-compression", "default", "Compression for generated zips: default, store, speed, or best")
+	flag_access_log := flag.Bool("access-log", false, "Log every HTTP request")
+	flag_preview := flag.Bool("preview", false, "Serve /preview/{code} HTML maps for visual QA")
+	flag_admin_token := flag.String("admin-token", "", "Token required by ?force=1 and /{code}/reload as an Authorization: Bearer header, unset allows anyone")
+	flag_feed_store := flag.String("feed-store", "file", "Where built feeds are kept: file or s3")
+	flag_feed_dir := flag.String("feed-dir", "build", "Directory for the file feed store")
+	flag_s3_endpoint := flag.String("s3-endpoint", "", "S3 compatible endpoint, like https://oss-cn-hangzhou.aliyuncs.com")
+	flag_s3_region := flag.String("s3-region", "", "S3 region")
+	flag_s3_bucket := flag.String("s3-bucket", "", "S3 bucket")
+	flag_s3_prefix := flag.String("s3-prefix", "", "Prefix for every S3 key")
+	flag_resume := flag.Bool("resume", false, "Skip cities already preloaded at their current version, tracked in --resume-state")
+	flag_resume_state := flag.String("resume-state", "preload_state.json", "Preload progress file used by --resume")
+	flag_validate_coords := flag.String("validate-coords", "", "Report stations far from their line's path or route's shape for these comma separated cities (no server)")
+	flag_validate_coords_meters := flag.Float64("validate-coords-meters", 300, "Distance from the path or shape before a station is reported by --validate-coords")
+	flag_license_spdx := flag.String("license-spdx", "", "SPDX identifier of the license feeds are published under, unset is unknown")
+	flag_city_config := flag.String("city-config", "", "JSON file of per-city overrides like {\"hk\": {\"currency\": \"HKD\", \"timezone\": \"Asia/Hong_Kong\"}}")
+	flag_generation_log_dir := flag.String("generation-log-dir", "", "Directory to write a JSON log of each generated feed's data-quality compromises to, unset disables")
+	flag_include_bus_tram := flag.Bool("include-bus-tram", false, "Keep bus and tram lines some cities have in MetroMan's data as routes")
+	flag_license_url := flag.String("license-url", "", "License URL, written to feed_info.txt feed_contact_url and the DMFR documents")
 	flag.Parse()
 
 	// -------------------------------------------------------
 	// Behavior rules matching your usage block
 	// -------------------------------------------------------
 
-	if !*flag_server && !*flag_load_all {
+	if !*flag_server && !*flag_load_all && *flag_validate_coords == "" {
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  %s --server [--port=8080] [--metroman-preload-all]\n", filepath.Base(os.Args[0]))
-		fmt.Fprintf(os.Stderr, "  %s --metroman-load-all\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "  %s --server [--port=8080] [--metroman-preload-all] [--offline] [--preview] [--access-log]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "  %s --metroman-load-all [--offline] [--resume]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "  %s --validate-coords=bj,sh [--validate-coords-meters=300]\n", filepath.Base(os.Args[0]))
 		os.Exit(1)
 	}
 
+	zip_compression, err := parseZipCompression(*flag_zip_compression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	license := metroman_client.MetromanLicense{
+		SPDXIdentifier: *flag_license_spdx,
+		URL:            *flag_license_url,
+	}
+
+	city_configs := map[string]metroman_client.MetromanCityConfig{}
+	if *flag_city_config != "" {
+		city_configs, err = metroman_client.LoadCityConfigs(*flag_city_config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Credentials come from the environment so they stay out of process listings
+	feed_store, err := createFeedStore(*flag_feed_store, *flag_feed_dir, &china_gtfs.S3FeedStore{
+		Endpoint:        *flag_s3_endpoint,
+		Region:          *flag_s3_region,
+		Bucket:          *flag_s3_bucket,
+		Prefix:          *flag_s3_prefix,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	server_options := china_gtfs.ServerOptions{
+		Offline:              *flag_offline,
+		AllowMissingVersions: *flag_allow_missing_versions,
+		VersionsCachePath:    *flag_versions_cache,
+	}
+
+	resume_state_path := ""
+	if *flag_resume {
+		resume_state_path = *flag_resume_state
+	}
+
 	if *flag_load_all && *flag_preload_with_server {
 		fmt.Fprintf(os.Stderr, "Error: --metroman-load-all cannot be combined with --metroman-preload-all\n")
 		os.Exit(1)
 	}
 
+	// coordinate validation mode (do not run server)
+	if *flag_validate_coords != "" {
+		china_gtfs_server, err := china_gtfs.CreateServerWithOptions(server_options)
+		if err != nil {
+			log.Fatalf("Error creating GTFS server: %v", err)
+		}
+
+		drift_found, err := validateCoords(china_gtfs_server, strings.Split(*flag_validate_coords, ","), *flag_validate_coords_meters)
+		if err != nil {
+			log.Fatalf("Error validating coordinates: %v", err)
+		}
+		if drift_found {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// preload-only mode (do not run server)
 	if *flag_load_all {
-		china_gtfs_server, err := china_gtfs.CreateServer()
+		china_gtfs_server, err := china_gtfs.CreateServerWithOptions(server_options)
 		if err != nil {
 			log.Fatalf("Error creating GTFS server: %v", err)
 		}
+		china_gtfs_server.ZipCompression = zip_compression
+		china_gtfs_server.MetromanServer.License = license
+		china_gtfs_server.MetromanServer.CityConfigs = city_configs
+		china_gtfs_server.MetromanServer.IncludeBusAndTram = *flag_include_bus_tram
 
-		generate_gtfs := makeGtfsGenerator(china_gtfs_server)
+		generate_gtfs := makeGtfsGenerator(china_gtfs_server, feed_store, *flag_generation_log_dir)
 
-		if err := metromanLoadAll(*flag_city_csv, generate_gtfs); err != nil {
+		if err := metromanLoadAll(*flag_city_csv, china_gtfs_server, generate_gtfs, resume_state_path); err != nil {
 			log.Fatalf("Error preloading cities: %v", err)
 		}
 		return
 	}
 
 	// server mode (optional preload)
-	china_gtfs_server, err := china_gtfs.CreateServer()
+	china_gtfs_server, err := china_gtfs.CreateServerWithOptions(server_options)
 	if err != nil {
 		log.Fatalf("Error creating GTFS server: %v", err)
 	}
+	china_gtfs_server.ZipCompression = zip_compression
+	china_gtfs_server.MetromanServer.License = license
+	china_gtfs_server.MetromanServer.CityConfigs = city_configs
+	china_gtfs_server.MetromanServer.IncludeBusAndTram = *flag_include_bus_tram
 
-	generate_gtfs := makeGtfsGenerator(china_gtfs_server)
+	generate_gtfs := makeGtfsGenerator(china_gtfs_server, feed_store, *flag_generation_log_dir)
 
 	if *flag_preload_with_server {
-		if err := metromanLoadAll(*flag_city_csv, generate_gtfs); err != nil {
+		if err := metromanLoadAll(*flag_city_csv, china_gtfs_server, generate_gtfs, resume_state_path); err != nil {
 			log.Fatalf("Error preloading cities: %v", err)
 		}
 	}
 
-	startServer(generate_gtfs, *flag_port)
+	startServer(china_gtfs_server, generate_gtfs, *flag_port, *flag_preview, *flag_access_log, *flag_admin_token)
 }
 
-// -------------------------------------------------------
-// GTFS generator factory
-// -------------------------------------------------------
-func makeGtfsGenerator(china_gtfs_server *china_gtfs.ChinaGTFSServer) func(code string) ([]byte, error) {
-	return func(code string) ([]byte, error) {
-		version, err := china_gtfs_server.MetromanGetCityVersion(code)
+func parseZipCompression(name string) (china_gtfs.CompressionLevel, error) {
+	switch name {
+	case "default":
+		return china_gtfs.COMPRESSION_DEFAULT, nil
+	case "store":
+		return china_gtfs.COMPRESSION_STORE, nil
+	case "speed":
+		return china_gtfs.COMPRESSION_BEST_SPEED, nil
+	case "best":
+		return china_gtfs.COMPRESSION_BEST_COMPRESSION, nil
+	default:
+		return china_gtfs.COMPRESSION_DEFAULT, fmt.Errorf("unknown zip compression '%s'", name)
+	}
+}
+
+func createFeedStore(name string, dir string, s3_feed_store *china_gtfs.S3FeedStore) (china_gtfs.FeedStore, error) {
+	switch name {
+	case "file":
+		return &china_gtfs.FileFeedStore{Dir: dir}, nil
+	case "s3":
+		if s3_feed_store.Endpoint == "" || s3_feed_store.Region == "" || s3_feed_store.Bucket == "" {
+			return nil, fmt.Errorf("--feed-store=s3 requires --s3-endpoint, --s3-region, and --s3-bucket")
+		}
+		return s3_feed_store, nil
+	default:
+		return nil, fmt.Errorf("unknown feed store '%s'", name)
+	}
+}
+
+// Print every drifting station, returning whether any were found
+func validateCoords(china_gtfs_server *china_gtfs.ChinaGTFSServer, codes []string, threshold_meters float64) (bool, error) {
+	drift_found := false
+
+	for _, code := range codes {
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			return drift_found, fmt.Errorf("loading city %s: %w", code, err)
+		}
+
+		drifts, err := china_gtfs_server.MetromanFindCoordinateDrift(code, threshold_meters)
 		if err != nil {
-			return nil, fmt.Errorf("getting version for %s: %w", code, err)
+			return drift_found, fmt.Errorf("validating city %s: %w", code, err)
 		}
 
-		gtfs_filename := fmt.Sprintf("%s.%s.gtfs.zip", code, version)
-		gtfs_path := filepath.Join("build", gtfs_filename)
+		for _, drift := range drifts {
+			fmt.Printf("%s: station %s (%s) is %.0fm from line %s\n", code, drift.StationCode, drift.EnglishName, drift.Meters, drift.LineCode)
+			drift_found = true
+		}
 
-		if _, err := os.Stat(gtfs_path); err == nil {
-			return os.ReadFile(gtfs_path)
+		gaps, err := china_gtfs_server.MetromanFindShapeGaps(code, threshold_meters)
+		if err != nil {
+			return drift_found, fmt.Errorf("validating city %s: %w", code, err)
 		}
 
-		if err := china_gtfs_server.MetromanLoadCity(code); err != nil {
-			return nil, fmt.Errorf("loading city %s: %w", code, err)
+		for _, gap := range gaps {
+			fmt.Printf("%s: station %s (%s) is %.0fm from the shape of route %s\n", code, gap.StationCode, gap.EnglishName, gap.Meters, gap.RouteCode)
+			drift_found = true
 		}
+	}
+
+	return drift_found, nil
+}
 
-		raw_zip, err := china_gtfs_server.MetromanGetRawZip(code)
+// -------------------------------------------------------
+// GTFS generator factory
+// -------------------------------------------------------
+// force skips the stored feed, regenerating and overwriting it
+func makeGtfsGenerator(china_gtfs_server *china_gtfs.ChinaGTFSServer, feed_store china_gtfs.FeedStore, generation_log_dir string) func(code string, force bool) ([]byte, error) {
+	return func(code string, force bool) ([]byte, error) {
+		// Record the outcome so /status reflects the latest attempt
+		version, _ := china_gtfs_server.MetromanGetCityVersion(code)
+		gtfs_zip, err := generateGtfs(china_gtfs_server, feed_store, code, force, generation_log_dir)
 		if err != nil {
-			return nil, fmt.Errorf("getting raw zip for %s: %w", code, err)
+			china_gtfs_server.SetCityFailed(code, version, err)
+			return nil, err
 		}
 
-		os.MkdirAll("backup", 0755)
-		backup_filename := fmt.Sprintf("%s.%s.metroman.zip", code, version)
-		backup_path := filepath.Join("backup", backup_filename)
-		os.WriteFile(backup_path, raw_zip, 0644)
+		china_gtfs_server.SetCityLoaded(code, version)
+		return gtfs_zip, nil
+	}
+}
+
+func generateGtfs(china_gtfs_server *china_gtfs.ChinaGTFSServer, feed_store china_gtfs.FeedStore, code string, force bool, generation_log_dir string) ([]byte, error) {
+	version, err := china_gtfs_server.MetromanGetCityVersion(code)
+	if err != nil {
+		return nil, fmt.Errorf("getting version for %s: %w", code, err)
+	}
 
-		gtfs_zip, err := china_gtfs_server.MetromanGenerateGTFSZip(code, false)
+	if !force {
+		stored_zip, found, err := feed_store.Get(code, version)
 		if err != nil {
-			return nil, fmt.Errorf("generating GTFS zip for %s: %w", code, err)
+			return nil, fmt.Errorf("getting stored feed for %s: %w", code, err)
 		}
+		if found {
+			return stored_zip, nil
+		}
+	}
 
-		os.MkdirAll("build", 0755)
-		os.WriteFile(gtfs_path, gtfs_zip, 0644)
+	if err := china_gtfs_server.MetromanLoadCity(code); err != nil {
+		return nil, fmt.Errorf("loading city %s: %w", code, err)
+	}
 
-		return gtfs_zip, nil
+	raw_zip, err := china_gtfs_server.MetromanGetRawZip(code)
+	if err != nil {
+		return nil, fmt.Errorf("getting raw zip for %s: %w", code, err)
+	}
+
+	os.MkdirAll("backup", 0755)
+	backup_filename := fmt.Sprintf("%s.%s.metroman.zip", code, version)
+	backup_path := filepath.Join("backup", backup_filename)
+	os.WriteFile(backup_path, raw_zip, 0644)
+
+	gtfs_zip, events, err := china_gtfs_server.MetromanGenerateGTFSZipWithReport(code, china_gtfs.GenerateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("generating GTFS zip for %s: %w", code, err)
 	}
+	for _, event := range events {
+		log.Printf("%s: %s", code, event.Message)
+	}
+
+	if generation_log_dir != "" {
+		if err := writeGenerationLog(generation_log_dir, code, version, events); err != nil {
+			log.Printf("Could not write generation log for %s: %v", code, err)
+		}
+	}
+
+	if err := feed_store.Put(code, version, gtfs_zip); err != nil {
+		log.Printf("Could not store feed for %s: %v", code, err)
+	}
+
+	return gtfs_zip, nil
+}
+
+// Sidecar to the feed, named like the MetroMan backup
+func writeGenerationLog(dir string, code string, version string, events []metroman_client.MetromanGenerationEvent) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	generation_log, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s.%s.log.json", code, version)), generation_log, 0644)
+}
+
+func generateGtfsForLines(china_gtfs_server *china_gtfs.ChinaGTFSServer, code string, line_codes []string) ([]byte, error) {
+	if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+		return nil, fmt.Errorf("loading city %s: %w", code, err)
+	}
+
+	gtfs_zip, err := china_gtfs_server.MetromanGenerateGTFSZipForLines(code, line_codes, china_gtfs.GenerateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("generating GTFS zip for %s lines %v: %w", code, line_codes, err)
+	}
+
+	return gtfs_zip, nil
 }
 
 // -------------------------------------------------------
 // HTTP server for TransitLand (DMFR)
 // -------------------------------------------------------
-func startServer(generate_gtfs func(code string) ([]byte, error), port string) {
+func startServer(china_gtfs_server *china_gtfs.ChinaGTFSServer, generate_gtfs func(code string, force bool) ([]byte, error), port string, preview bool, access_log bool, admin_token string) {
+	handler, err := newRouter(china_gtfs_server, generate_gtfs, preview, access_log, admin_token)
+	if err != nil {
+		log.Fatalf("Error creating router: %v", err)
+	}
+
+	addr := ":" + port
+	log.Printf("Starting server at %s", addr)
+	log.Fatal(http.ListenAndServe(addr, handler))
+}
+
+// Every endpoint of the server, wrapped in the access log when enabled
+func newRouter(china_gtfs_server *china_gtfs.ChinaGTFSServer, generate_gtfs func(code string, force bool) ([]byte, error), preview bool, access_log bool, admin_token string) (http.Handler, error) {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/{code}.gtfs.zip", func(w http.ResponseWriter, r *http.Request) {
 		code := mux.Vars(r)["code"]
 
-		gtfs_data, err := generate_gtfs(code)
+		// Same feed as a tarball for pipelines that prefer it, never cached
+		switch r.URL.Query().Get("format") {
+		case "", "zip":
+		case "tar.gz":
+			if r.URL.Query().Get("lines") != "" {
+				http.Error(w, "format=tar.gz cannot be combined with lines", http.StatusBadRequest)
+				return
+			}
+
+			if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+				http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			gtfs_data, err := china_gtfs_server.MetromanGenerateGTFSTarGz(code, china_gtfs.GenerateOptions{})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error generating GTFS: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.gtfs.tar.gz\"", code))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(gtfs_data)))
+			w.Write(gtfs_data)
+			return
+		default:
+			http.Error(w, "format must be zip or tar.gz", http.StatusBadRequest)
+			return
+		}
+
+		var gtfs_data []byte
+		var err error
+		if lines := r.URL.Query().Get("lines"); lines != "" {
+			// Partial feeds are never cached
+			gtfs_data, err = generateGtfsForLines(china_gtfs_server, code, strings.Split(lines, ","))
+		} else if r.URL.Query().Get("force") == "1" {
+			if !isAuthorized(r, admin_token) {
+				http.Error(w, "force=1 requires the admin token", http.StatusUnauthorized)
+				return
+			}
+			gtfs_data, err = generate_gtfs(code, true)
+		} else {
+			gtfs_data, err = generate_gtfs(code, false)
+		}
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error generating GTFS: %v", err), http.StatusInternalServerError)
 			return
@@ -136,15 +407,373 @@ func startServer(generate_gtfs func(code string) ([]byte, error), port string) {
 		w.Write(gtfs_data)
 	})
 
-	addr := ":" + port
-	log.Printf("Starting server at %s", addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+	// Pick up a new MetroMan version for one city without restarting, replacing its stored feed
+	router.HandleFunc("/{code}/reload", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if !isAuthorized(r, admin_token) {
+			http.Error(w, "reload requires the admin token", http.StatusUnauthorized)
+			return
+		}
+
+		if err := china_gtfs_server.MetromanRefreshVersions(); err != nil {
+			http.Error(w, fmt.Sprintf("Error refreshing versions: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		if _, err := generate_gtfs(code, true); err != nil {
+			http.Error(w, fmt.Sprintf("Error generating GTFS: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		version, err := china_gtfs_server.MetromanGetCityVersion(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting version: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Only a cross-check, the reload already succeeded
+		baidu_subway_version, err := china_gtfs_server.BaiduRefreshSubwayVersion()
+		if err != nil {
+			log.Printf("Could not refresh Baidu subway version: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"code":                 code,
+			"version":              version,
+			"baidu_subway_version": baidu_subway_version,
+		})
+	}).Methods("POST")
+
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if china_gtfs_server.BaiduServer == nil {
+			w.Write([]byte("ok (without Baidu)\n"))
+			return
+		}
+
+		if err := china_gtfs_server.BaiduPing(); err != nil {
+			http.Error(w, fmt.Sprintf("Baidu unreachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok\n"))
+	})
+
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(china_gtfs_server.GetCityStatuses())
+	})
+
+	router.HandleFunc("/{code}/lines.geojson", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		lines_geojson, err := china_gtfs_server.MetromanGenerateLinesGeoJSON(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating lines GeoJSON: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Write(lines_geojson)
+	})
+
+	router.HandleFunc("/{code}/stops.geojson", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		stops_geojson, err := china_gtfs_server.MetromanGenerateStopsGeoJSON(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating stops GeoJSON: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Write(stops_geojson)
+	})
+
+	router.HandleFunc("/{code}/fares.json", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		fare_matrices, err := china_gtfs_server.MetromanGetFareMatrices(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting fares: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fare_matrices)
+	})
+
+	router.HandleFunc("/{code}/fares.csv", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		fares_csv, err := china_gtfs_server.MetromanGenerateFareMatrixCSV(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating fares: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Write([]byte(fares_csv))
+	})
+
+	router.HandleFunc("/{code}/dmfr.json", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// The feed is served next to this document
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		feed_url := fmt.Sprintf("%s://%s/%s.gtfs.zip", scheme, r.Host, code)
+
+		dmfr, err := china_gtfs_server.MetromanGenerateDMFR(code, feed_url)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating DMFR: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(dmfr)
+	})
+
+	router.HandleFunc("/{code}/stats.json", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		stats, err := china_gtfs_server.MetromanGetCityStats(code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	router.HandleFunc("/{code}/lines/{line}/directions", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+		line_code := mux.Vars(r)["line"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		directions, err := china_gtfs_server.MetromanGetLineDirections(code, line_code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting directions: %v", err), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(directions)
+	})
+
+	router.HandleFunc("/{code}/routes/{route}/schedule", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+		route_code := mux.Vars(r)["route"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		route_schedules, err := china_gtfs_server.MetromanGetRouteSchedule(code, route_code)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting schedule: %v", err), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(route_schedules)
+	})
+
+	router.HandleFunc("/{code}/trips/{trip}", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+		trip_id := mux.Vars(r)["trip"]
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		timetable, err := china_gtfs_server.MetromanGetTripTimetable(code, trip_id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting trip: %v", err), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(timetable)
+	})
+
+	router.HandleFunc("/{code}/stations/{station}/departures", func(w http.ResponseWriter, r *http.Request) {
+		code := mux.Vars(r)["code"]
+		station_code := mux.Vars(r)["station"]
+
+		// Schedules are in local time, default to now in China Standard Time
+		now := time.Now().In(time.FixedZone("CST", 8*60*60))
+		date := metroman_client.MetromanDate{Year: now.Year(), Month: int(now.Month()), Day: now.Day()}
+		after_minutes := now.Hour()*60 + now.Minute()
+		limit := 3
+
+		if after := r.URL.Query().Get("after"); after != "" {
+			after_time, err := time.Parse("15:04", after)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid after %s, expected HH:MM", after), http.StatusBadRequest)
+				return
+			}
+			after_minutes = after_time.Hour()*60 + after_time.Minute()
+		}
+
+		if date_str := r.URL.Query().Get("date"); date_str != "" {
+			parsed_date, err := time.Parse("20060102", date_str)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid date %s, expected YYYYMMDD", date_str), http.StatusBadRequest)
+				return
+			}
+			date = metroman_client.MetromanDate{Year: parsed_date.Year(), Month: int(parsed_date.Month()), Day: parsed_date.Day()}
+		}
+
+		if limit_str := r.URL.Query().Get("limit"); limit_str != "" {
+			parsed_limit, err := strconv.Atoi(limit_str)
+			if err != nil || parsed_limit <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid limit %s", limit_str), http.StatusBadRequest)
+				return
+			}
+			limit = parsed_limit
+		}
+
+		if err := china_gtfs_server.MetromanEnsureCityLoaded(code); err != nil {
+			http.Error(w, fmt.Sprintf("Error loading city: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		departures, err := china_gtfs_server.MetromanGetDepartures(code, station_code, date, after_minutes, limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting departures: %v", err), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(departures)
+	})
+
+	if preview {
+		preview_template, err := template.ParseFiles("preview.gohtml")
+		if err != nil {
+			return nil, fmt.Errorf("parsing preview template: %w", err)
+		}
+
+		router.HandleFunc("/preview/{code}", func(w http.ResponseWriter, r *http.Request) {
+			code := mux.Vars(r)["code"]
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err := preview_template.Execute(w, map[string]interface{}{
+				"Code":     code,
+				"LinesURL": fmt.Sprintf("/%s/lines.geojson", code),
+				"StopsURL": fmt.Sprintf("/%s/stops.geojson", code),
+			})
+			if err != nil {
+				log.Printf("Error rendering preview for %s: %v", code, err)
+			}
+		})
+	}
+
+	if access_log {
+		return accessLogMiddleware(router), nil
+	}
+	return router, nil
+}
+
+// -------------------------------------------------------
+// Access log
+// -------------------------------------------------------
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
+
+// Admin requests need "Authorization: Bearer <token>" when a token is configured
+func isAuthorized(r *http.Request, admin_token string) bool {
+	if admin_token == "" {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+admin_token)) == 1
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		log_writer := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(log_writer, r)
+
+		log.Printf("method=%s path=%s status=%d bytes=%d duration=%s",
+			r.Method, r.URL.Path, log_writer.status, log_writer.bytes, time.Since(start))
+	})
 }
 
 // -------------------------------------------------------
 // Preload cities from "baidu_city_uid_to_city.csv"
 // -------------------------------------------------------
-func metromanLoadAll(csv_path string, generate_gtfs func(code string) ([]byte, error)) error {
+// resume_state_path, when set, records the version of every city preloaded so a later run can skip it
+func metromanLoadAll(csv_path string, china_gtfs_server *china_gtfs.ChinaGTFSServer, generate_gtfs func(code string, force bool) ([]byte, error), resume_state_path string) error {
+	completed_versions := map[string]string{}
+	if resume_state_path != "" {
+		state, err := os.ReadFile(resume_state_path)
+		if err == nil {
+			if err := json.Unmarshal(state, &completed_versions); err != nil {
+				return fmt.Errorf("parsing resume state %s: %w", resume_state_path, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("reading resume state %s: %w", resume_state_path, err)
+		}
+	}
+
 	f, err := os.Open(csv_path)
 	if err != nil {
 		return fmt.Errorf("opening CSV: %w", err)
@@ -169,11 +798,10 @@ func metromanLoadAll(csv_path string, generate_gtfs func(code string) ([]byte, e
 		return fmt.Errorf("CSV missing metroman_code column")
 	}
 
+	// Read every code first so progress can be shown out of the total
+	codes := []string{}
 	row_index := 0
 	for {
-		// Sleep a bit on every iteration as to not overload MetroMan
-		time.Sleep(time.Second * 1)
-
 		record, err := r.Read()
 		if err == io.EOF {
 			break
@@ -187,13 +815,80 @@ func metromanLoadAll(csv_path string, generate_gtfs func(code string) ([]byte, e
 			continue
 		}
 
-		code := record[metroman_idx]
-		log.Printf("Preloading %s...", code)
+		codes = append(codes, record[metroman_idx])
+	}
+
+	start := time.Now()
+	results := []preloadResult{}
+	defer func() {
+		writePreloadSummary(os.Stderr, results, time.Since(start))
+	}()
 
-		if _, err := generate_gtfs(code); err != nil {
-			log.Printf("Error loading %s: %v", code, err)
+	for i, code := range codes {
+		progress := fmt.Sprintf("[%d/%d]", i+1, len(codes))
+
+		version, _ := china_gtfs_server.MetromanGetCityVersion(code)
+		if resume_state_path != "" && version != "" && completed_versions[code] == version {
+			log.Printf("%s Skipping %s, already preloaded at %s", progress, code, version)
+			results = append(results, preloadResult{code: code, status: "skipped"})
+			continue
 		}
+
+		// Sleep a bit before every download as to not overload MetroMan
+		time.Sleep(time.Second * 1)
+
+		log.Printf("%s Preloading %s...", progress, code)
+
+		city_start := time.Now()
+		if _, err := generate_gtfs(code, false); err != nil {
+			log.Printf("%s Error loading %s: %v", progress, code, err)
+			results = append(results, preloadResult{code: code, status: "failed", duration: time.Since(city_start), err: err})
+			continue
+		}
+		results = append(results, preloadResult{code: code, status: "ok", duration: time.Since(city_start)})
+
+		if resume_state_path != "" {
+			completed_versions[code] = version
+			state, err := json.MarshalIndent(completed_versions, "", "\t")
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(resume_state_path, state, 0644); err != nil {
+				return fmt.Errorf("writing resume state %s: %w", resume_state_path, err)
+			}
+		}
+	}
+
+	if incomplete_cities := china_gtfs_server.MetromanIncompleteCities(); len(incomplete_cities) > 0 {
+		log.Printf("Cities missing trips, shapes, or coordinates: %s", strings.Join(incomplete_cities, ", "))
 	}
 
 	return nil
 }
+
+type preloadResult struct {
+	code     string
+	status   string // ok, failed, or skipped
+	duration time.Duration
+	err      error
+}
+
+// Table of every city preloaded followed by the totals
+func writePreloadSummary(output io.Writer, results []preloadResult, elapsed time.Duration) {
+	counts := map[string]int{}
+
+	table_writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table_writer, "CITY\tSTATUS\tTIME\tERROR")
+	for _, result := range results {
+		counts[result.status]++
+
+		error_message := ""
+		if result.err != nil {
+			error_message = result.err.Error()
+		}
+		fmt.Fprintf(table_writer, "%s\t%s\t%s\t%s\n", result.code, result.status, result.duration.Round(time.Millisecond), error_message)
+	}
+	table_writer.Flush()
+
+	fmt.Fprintf(output, "%d ok, %d failed, %d skipped in %s\n", counts["ok"], counts["failed"], counts["skipped"], elapsed.Round(time.Second))
+}
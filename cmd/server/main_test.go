@@ -0,0 +1,538 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tgrcode.com/baidu_client"
+	"tgrcode.com/china_gtfs"
+	"tgrcode.com/china_gtfs/common"
+	"tgrcode.com/metroman_client"
+)
+
+// Fixture city shared with the metroman tests, see metroman/package_test.go
+const test_city_code = "xx"
+const test_zip_prefix = "20250615"
+
+// A server without Baidu holding the fixture city, built without touching the network
+func newTestServer(t testing.TB) *china_gtfs.ChinaGTFSServer {
+	t.Helper()
+
+	metroman_server := &metroman_client.MetromanServer{
+		CityZips:      map[string][]byte{},
+		Cities:        map[string]*metroman_client.MetromanCity{},
+		ZipDateLookup: map[string]string{test_city_code: test_zip_prefix},
+		ChinaHandler:  &common.ChinaHandler{},
+	}
+	if err := metroman_server.LoadCityFromDir(test_city_code, test_zip_prefix, "../../metroman/testdata/xx"); err != nil {
+		t.Fatalf("could not load fixture: %v", err)
+	}
+
+	return &china_gtfs.ChinaGTFSServer{MetromanServer: metroman_server}
+}
+
+// Generator for servers that should never generate
+func unusedGenerator(t testing.TB) func(code string, force bool) ([]byte, error) {
+	return func(code string, force bool) ([]byte, error) {
+		t.Errorf("unexpected generation of %s", code)
+		return nil, nil
+	}
+}
+
+func get(t testing.TB, handler http.Handler, target string) (int, string) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	body, _ := io.ReadAll(recorder.Result().Body)
+	return recorder.Code, string(body)
+}
+
+// Feeds kept in memory, counting every Put
+type memoryFeedStore struct {
+	feeds map[string][]byte
+	puts  int
+	lock  sync.Mutex
+}
+
+func (s *memoryFeedStore) Get(code string, version string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contents, found := s.feeds[china_gtfs.FeedFilename(code, version)]
+	return contents, found, nil
+}
+
+func (s *memoryFeedStore) Put(code string, version string, contents []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.feeds == nil {
+		s.feeds = map[string][]byte{}
+	}
+	s.feeds[china_gtfs.FeedFilename(code, version)] = contents
+	s.puts++
+	return nil
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Fake MetroMan OSS serving the fixture city as whichever version is set
+type metromanMock struct {
+	version   string
+	downloads int
+	files     map[string][]byte // Fixture files by path within the version, tests may replace them
+}
+
+// Serve version.txt and the zipped fixture (under the requested version) until the test ends.
+// Generating writes a backup of the download to the working directory, so this also moves to a temporary one
+func mockMetroman(t testing.TB) *metromanMock {
+	t.Helper()
+
+	fixture_files := map[string][]byte{}
+	fixture_dir := path.Join("../../metroman/testdata/xx", test_zip_prefix)
+	err := fs.WalkDir(os.DirFS(fixture_dir), ".", func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		fixture_files[file_path], err = os.ReadFile(path.Join(fixture_dir, file_path))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not read fixture: %v", err)
+	}
+
+	mock := &metromanMock{version: test_zip_prefix, files: fixture_files}
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		recorder := httptest.NewRecorder()
+		if path.Base(r.URL.Path) == "version.txt" {
+			recorder.WriteString(test_city_code + "," + mock.version + ",1\n")
+			return recorder.Result(), nil
+		}
+
+		// Zips are at <code>/<version>.zip with every file under <version>/
+		mock.downloads++
+		zip_prefix := strings.TrimSuffix(path.Base(r.URL.Path), ".zip")
+		zip_writer := zip.NewWriter(recorder.Body)
+		for file_path, contents := range mock.files {
+			file_writer, err := zip_writer.Create(path.Join(zip_prefix, file_path))
+			if err != nil {
+				return nil, err
+			}
+			file_writer.Write(contents)
+		}
+		if err := zip_writer.Close(); err != nil {
+			return nil, err
+		}
+		return recorder.Result(), nil
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+
+	t.Chdir(t.TempDir())
+	return mock
+}
+
+// Send the standard logger to a buffer for the rest of the test
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &output
+}
+
+func TestPreviewReferencesGeoJSONEndpoints(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+
+	// preview.gohtml is read from the working directory, the repository root
+	t.Chdir("../..")
+	handler, err := newRouter(china_gtfs_server, unusedGenerator(t), true, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, page := get(t, handler, "/preview/xx")
+	if status != http.StatusOK {
+		t.Fatalf("preview returned %d: %s", status, page)
+	}
+
+	// Both URLs are written into the script as quoted strings
+	for _, endpoint := range []string{"/xx/lines.geojson", "/xx/stops.geojson"} {
+		if !strings.Contains(page, `"`+endpoint+`"`) {
+			t.Errorf("preview does not reference %s", endpoint)
+		}
+
+		status, body := get(t, handler, endpoint)
+		if status != http.StatusOK || !strings.Contains(body, "FeatureCollection") {
+			t.Errorf("%s returned %d: %s", endpoint, status, body)
+		}
+	}
+}
+
+func TestStatusShowsFailedCity(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	generate_gtfs := makeGtfsGenerator(china_gtfs_server, &china_gtfs.FileFeedStore{Dir: t.TempDir()}, "")
+
+	// MetroMan has no version for zz
+	if _, err := generate_gtfs("zz", false); err == nil {
+		t.Fatalf("expected generating an unknown city to fail")
+	}
+
+	handler, err := newRouter(china_gtfs_server, generate_gtfs, false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := get(t, handler, "/status")
+	if status != http.StatusOK {
+		t.Fatalf("/status returned %d: %s", status, body)
+	}
+
+	statuses := map[string]china_gtfs.CityStatus{}
+	if err := json.Unmarshal([]byte(body), &statuses); err != nil {
+		t.Fatalf("/status is not JSON: %v", err)
+	}
+	if !statuses["zz"].Failed || !strings.Contains(statuses["zz"].LastError, "zz") {
+		t.Errorf("expected zz to be failed with its error, got %+v", statuses["zz"])
+	}
+}
+
+func TestAccessLogLinePerRequest(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+
+	handler, err := newRouter(china_gtfs_server, unusedGenerator(t), false, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureLog(t)
+	get(t, handler, "/xx/fares.json")
+	get(t, handler, "/missing/path/here")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one log line per request, got:\n%s", output.String())
+	}
+	if !strings.Contains(lines[0], "method=GET path=/xx/fares.json status=200 bytes=") || strings.Contains(lines[0], "bytes=0 ") {
+		t.Errorf("unexpected log line %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "path=/missing/path/here status=404") {
+		t.Errorf("unexpected log line %q", lines[1])
+	}
+
+	// Off by default
+	handler, err = newRouter(china_gtfs_server, unusedGenerator(t), false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Reset()
+	get(t, handler, "/xx/fares.json")
+	if output.Len() != 0 {
+		t.Errorf("expected no access log when disabled, got %q", output.String())
+	}
+}
+
+func TestDeparturesAcrossHoliday(t *testing.T) {
+	handler, err := newRouter(newTestServer(t), unusedGenerator(t), false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Line 1 from Bravo, October 1st is a holiday and the 8th is an ordinary Wednesday
+	for _, test := range []struct {
+		date          string
+		schedule_code string
+		time          string
+	}{
+		{"20251001", "WE", "06:33:00"},
+		{"20251008", "WD", "07:03:00"},
+	} {
+		status, body := get(t, handler, "/xx/stations/XXMS02/departures?after=06:10&limit=1&date="+test.date)
+		if status != http.StatusOK {
+			t.Fatalf("%s: departures returned %d: %s", test.date, status, body)
+		}
+
+		all_departures := []metroman_client.MetromanDepartures{}
+		if err := json.Unmarshal([]byte(body), &all_departures); err != nil {
+			t.Fatalf("%s: departures are not JSON: %v", test.date, err)
+		}
+		if len(all_departures) == 0 || all_departures[0].RouteCode != "XXMW01" || len(all_departures[0].Departures) != 1 {
+			t.Fatalf("%s: expected one departure towards Charlie first, got %+v", test.date, all_departures)
+		}
+
+		next_departure := all_departures[0].Departures[0]
+		if next_departure.ScheduleCode != test.schedule_code || next_departure.Time != test.time {
+			t.Errorf("%s: expected the %s train at %s, got %+v", test.date, test.schedule_code, test.time, next_departure)
+		}
+	}
+
+	if status, _ := get(t, handler, "/xx/stations/XXMS02/departures?after=6pm"); status != http.StatusBadRequest {
+		t.Errorf("expected an invalid after to be rejected, got %d", status)
+	}
+}
+
+func TestStoredFeedAvoidsRegeneration(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	metroman_mock := mockMetroman(t)
+
+	feed_store := &memoryFeedStore{}
+	generate_gtfs := makeGtfsGenerator(china_gtfs_server, feed_store, "")
+
+	gtfs_zip, err := generate_gtfs(test_city_code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metroman_mock.downloads != 1 || feed_store.puts != 1 {
+		t.Fatalf("expected the first request to download and store the feed, got %d downloads and %d puts", metroman_mock.downloads, feed_store.puts)
+	}
+
+	stored_zip, err := generate_gtfs(test_city_code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metroman_mock.downloads != 1 || feed_store.puts != 1 {
+		t.Errorf("expected the stored feed to be served, got %d downloads and %d puts", metroman_mock.downloads, feed_store.puts)
+	}
+	if !bytes.Equal(stored_zip, gtfs_zip) {
+		t.Errorf("stored feed differs from the generated one")
+	}
+}
+
+func TestForceRegenerates(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	metroman_mock := mockMetroman(t)
+
+	feed_store := &memoryFeedStore{}
+	handler, err := newRouter(china_gtfs_server, makeGtfsGenerator(china_gtfs_server, feed_store, ""), false, false, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forced := func(authorization string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/xx.gtfs.zip?force=1", nil)
+		request.Header.Set("Authorization", authorization)
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	for range 2 {
+		if status, body := get(t, handler, "/xx.gtfs.zip"); status != http.StatusOK {
+			t.Fatalf("feed returned %d: %s", status, body)
+		}
+	}
+	if metroman_mock.downloads != 1 || feed_store.puts != 1 {
+		t.Fatalf("expected the second request to be served from the store, got %d downloads and %d puts", metroman_mock.downloads, feed_store.puts)
+	}
+
+	if status := forced(""); status != http.StatusUnauthorized {
+		t.Errorf("expected force=1 without the admin token to be refused, got %d", status)
+	}
+	if status := forced("Bearer secret"); status != http.StatusOK {
+		t.Fatalf("forced feed returned %d", status)
+	}
+	if metroman_mock.downloads != 2 || feed_store.puts != 2 {
+		t.Errorf("expected force=1 to regenerate and replace the stored feed, got %d downloads and %d puts", metroman_mock.downloads, feed_store.puts)
+	}
+
+	// Back to the stored feed
+	get(t, handler, "/xx.gtfs.zip")
+	if metroman_mock.downloads != 2 {
+		t.Errorf("expected the regenerated feed to be served, got %d downloads", metroman_mock.downloads)
+	}
+}
+
+func TestReadyzWithBaiduDown(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+
+	handler, err := newRouter(china_gtfs_server, unusedGenerator(t), false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(t, handler, "/readyz"); status != http.StatusOK || !strings.Contains(body, "without Baidu") {
+		t.Errorf("expected a server without Baidu to be ready, got %d: %s", status, body)
+	}
+
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+
+	china_gtfs_server.BaiduServer = &baidu_client.BaiduServer{}
+	if status, body := get(t, handler, "/readyz"); status != http.StatusServiceUnavailable || !strings.Contains(body, "Baidu unreachable") {
+		t.Errorf("expected Baidu being down to fail readiness, got %d: %s", status, body)
+	}
+}
+
+func TestReloadUpdatesVersion(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	metroman_mock := mockMetroman(t)
+
+	feed_store := &memoryFeedStore{}
+	handler, err := newRouter(china_gtfs_server, makeGtfsGenerator(china_gtfs_server, feed_store, ""), false, false, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload := func(authorization string) (int, string) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/xx/reload", nil)
+		request.Header.Set("Authorization", authorization)
+		handler.ServeHTTP(recorder, request)
+		body, _ := io.ReadAll(recorder.Result().Body)
+		return recorder.Code, string(body)
+	}
+
+	// MetroMan publishes a new version
+	metroman_mock.version = "20250701"
+
+	if status, _ := reload(""); status != http.StatusUnauthorized {
+		t.Errorf("expected a reload without the admin token to be refused, got %d", status)
+	}
+	status, body := reload("Bearer secret")
+	if status != http.StatusOK {
+		t.Fatalf("reload returned %d: %s", status, body)
+	}
+
+	response := map[string]string{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatalf("reload response is not JSON: %v", err)
+	}
+	if response["version"] != "20250701" {
+		t.Errorf("expected the reload to return version 20250701, got %+v", response)
+	}
+	if version, err := china_gtfs_server.MetromanGetCityVersion(test_city_code); err != nil || version != "20250701" {
+		t.Errorf("expected the server to hold version 20250701, got %q %v", version, err)
+	}
+
+	// The new version is what gets served, without downloading again
+	if _, found, _ := feed_store.Get(test_city_code, "20250701"); !found {
+		t.Errorf("expected the reloaded feed to be stored under the new version")
+	}
+	if status, body := get(t, handler, "/xx.gtfs.zip"); status != http.StatusOK || metroman_mock.downloads != 1 {
+		t.Errorf("expected the reloaded feed to be served, got %d with %d downloads: %s", status, metroman_mock.downloads, body)
+	}
+}
+
+func TestResumeSkipsPreloadedCities(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	state_dir := t.TempDir()
+	csv_path := path.Join(state_dir, "cities.csv")
+	resume_state_path := path.Join(state_dir, "preload_state.json")
+	if err := os.WriteFile(csv_path, []byte("baidu_uid,metroman_code\n999,xx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	generated := []string{}
+	generate_gtfs := func(code string, force bool) ([]byte, error) {
+		generated = append(generated, code)
+		return nil, nil
+	}
+
+	for range 2 {
+		if err := metromanLoadAll(csv_path, china_gtfs_server, generate_gtfs, resume_state_path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(generated) != 1 {
+		t.Errorf("expected xx to be generated only by the first run, got %v", generated)
+	}
+
+	state, err := os.ReadFile(resume_state_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed_versions := map[string]string{}
+	if err := json.Unmarshal(state, &completed_versions); err != nil || completed_versions[test_city_code] != test_zip_prefix {
+		t.Errorf("expected xx to be recorded at %s, got %s", test_zip_prefix, state)
+	}
+}
+
+func TestPreloadSummary(t *testing.T) {
+	var output bytes.Buffer
+	writePreloadSummary(&output, []preloadResult{
+		{code: "bj", status: "ok", duration: 1500 * time.Millisecond},
+		{code: "sh", status: "failed", duration: 200 * time.Millisecond, err: errors.New("could not download")},
+		{code: "xx", status: "skipped"},
+	}, 3*time.Second)
+
+	expected_output := "CITY  STATUS   TIME   ERROR\n" +
+		"bj    ok       1.5s   \n" +
+		"sh    failed   200ms  could not download\n" +
+		"xx    skipped  0s     \n" +
+		"1 ok, 1 failed, 1 skipped in 3s\n"
+	if output.String() != expected_output {
+		t.Errorf("expected summary:\n%s\ngot:\n%s", expected_output, output.String())
+	}
+}
+
+func TestGenerationLogRecordsSynthesizedShape(t *testing.T) {
+	china_gtfs_server := newTestServer(t)
+	metroman_mock := mockMetroman(t)
+	captureLog(t)
+
+	// Delta to Echo loses its path, so line 2 is drawn straight between them
+	path_rail := []string{}
+	for _, line := range strings.Split(string(metroman_mock.files["path_rail.csv"]), "\n") {
+		if !strings.HasPrefix(line, "XXML02,XXMS04,XXMS05,") {
+			path_rail = append(path_rail, line)
+		}
+	}
+	metroman_mock.files["path_rail.csv"] = []byte(strings.Join(path_rail, "\n"))
+
+	generation_log_dir := t.TempDir()
+	if _, err := makeGtfsGenerator(china_gtfs_server, &memoryFeedStore{}, generation_log_dir)(test_city_code, false); err != nil {
+		t.Fatal(err)
+	}
+
+	generation_log, err := os.ReadFile(path.Join(generation_log_dir, "xx."+test_zip_prefix+".log.json"))
+	if err != nil {
+		t.Fatalf("expected a generation log: %v", err)
+	}
+	var events []metroman_client.MetromanGenerationEvent
+	if err := json.Unmarshal(generation_log, &events); err != nil {
+		t.Fatalf("generation log is not JSON: %v", err)
+	}
+
+	synthesized := []string{}
+	for _, event := range events {
+		if event.Kind == metroman_client.GENERATION_EVENT_SHAPE_SEGMENT_SYNTHESIZED {
+			synthesized = append(synthesized, event.Message)
+		}
+	}
+	// Both directions share the path
+	expected_synthesized := []string{
+		"shape shape_XXMW03: straight line from XXMS04 to XXMS05",
+		"shape shape_XXMW04: straight line from XXMS05 to XXMS04",
+	}
+	if !slices.Equal(synthesized, expected_synthesized) {
+		t.Errorf("expected synthesized segments %v, got %v", expected_synthesized, synthesized)
+	}
+}
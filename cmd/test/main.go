@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -30,6 +31,10 @@ import (
 const otp_date = "2025-12-02"
 const otp_time = "08:30"
 
+// OTP used when no external instance is given
+const default_otp_url = "http://localhost:8080"
+const default_otp_image = "docker.io/opentripplanner/opentripplanner:2.8.1"
+
 type OtpLeg struct {
 	Mode string `json:"mode"`
 	From struct {
@@ -68,6 +73,32 @@ type OtpGraphqlResponse struct {
 	} `json:"errors"`
 }
 
+// Which itineraries to ask OTP for
+type OtpPlanOptions struct {
+	Modes          []string // OTP modes such as TRANSIT, WALK, RAIL
+	NumItineraries int
+}
+
+// Severity of an issue found while verifying a feed
+type Severity int
+
+const (
+	SEVERITY_WARNING Severity = 0
+	SEVERITY_ERROR   Severity = 1
+)
+
+func (severity Severity) String() string {
+	if severity == SEVERITY_ERROR {
+		return "error"
+	}
+	return "warning"
+}
+
+type VerifyIssue struct {
+	Severity Severity
+	Message  string
+}
+
 type RouteLeg struct {
 	LineName   string
 	FromName   string
@@ -77,6 +108,44 @@ type RouteLeg struct {
 }
 
 func main() {
+	flag_otp_modes := flag.String("otp-modes", "TRANSIT", "Comma separated OTP transport modes to plan with")
+	flag_otp_num_itineraries := flag.Int("otp-num-itineraries", 1, "Number of itineraries to request from OTP")
+	flag_otp_url := flag.String("otp-url", os.Getenv("OTP_URL"), "Base URL of an already running OTP instance, skips starting docker (env OTP_URL)")
+	flag_otp_image := flag.String("otp-image", envOrDefault("OTP_IMAGE", default_otp_image), "OTP docker image to start (env OTP_IMAGE)")
+	flag_verify := flag.Bool("verify", false, "Only parse and verify the feeds in build/, without OTP")
+	flag_min_severity := flag.String("min-severity", "warning", "Lowest severity printed by --verify: warning or error")
+	flag_fail_on_warnings := flag.Bool("fail-on-warnings", false, "Make --verify exit non-zero on warnings, not just errors")
+	flag.Parse()
+
+	if *flag_verify {
+		min_severity, err := parseSeverity(*flag_min_severity)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		fail_severity := SEVERITY_ERROR
+		if *flag_fail_on_warnings {
+			fail_severity = SEVERITY_WARNING
+		}
+
+		if !verifyFeeds(min_severity, fail_severity) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Only start our own container when no external OTP is given
+	external_otp := *flag_otp_url != ""
+	otp_url := strings.TrimSuffix(*flag_otp_url, "/")
+	if !external_otp {
+		otp_url = default_otp_url
+	}
+
+	plan_options := OtpPlanOptions{
+		Modes:          strings.Split(*flag_otp_modes, ","),
+		NumItineraries: *flag_otp_num_itineraries,
+	}
+
 	rand.Seed(42)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -91,17 +160,19 @@ func main() {
 		cancel()
 	}()
 
-	otp_cmd, err := startOtpContainer(ctx)
-	if err != nil {
-		log.Fatalf("failed to start OTP container: %v", err)
-	}
-	defer func() {
-		if otp_cmd.Process != nil {
-			_ = otp_cmd.Process.Kill()
+	if !external_otp {
+		otp_cmd, err := startOtpContainer(ctx, *flag_otp_image)
+		if err != nil {
+			log.Fatalf("failed to start OTP container: %v", err)
 		}
-	}()
+		defer func() {
+			if otp_cmd.Process != nil {
+				_ = otp_cmd.Process.Kill()
+			}
+		}()
+	}
 
-	if err := waitForOtp(); err != nil {
+	if err := waitForOtp(otp_url); err != nil {
 		log.Fatalf("OTP did not come online: %v", err)
 	}
 
@@ -176,25 +247,27 @@ func main() {
 				i+1, stop_a.Name, stop_a.Id, stop_b.Name, stop_b.Id,
 			)
 
-			itinerary, err := queryOtpRoute(stop_a, stop_b)
+			itineraries, err := queryOtpRoute(otp_url, stop_a, stop_b, plan_options)
 			if err != nil {
 				fmt.Printf("  OTP error: %v\n", err)
 				continue
 			}
-			if itinerary == nil {
+			if len(itineraries) == 0 {
 				fmt.Println("  No itinerary found.")
 				continue
 			}
 
-			fmt.Printf("  Duration: %.0f sec\n", itinerary.Duration)
-			fmt.Println("  Legs:")
-			for j, leg := range itinerary.Legs {
-				fmt.Printf("    %2d: %-8s %s → %s\n",
-					j+1,
-					leg.Mode,
-					leg.From.Name,
-					leg.To.Name,
-				)
+			for k, itinerary := range itineraries {
+				fmt.Printf("  Itinerary %d duration: %.0f sec\n", k+1, itinerary.Duration)
+				fmt.Println("  Legs:")
+				for j, leg := range itinerary.Legs {
+					fmt.Printf("    %2d: %-8s %s → %s\n",
+						j+1,
+						leg.Mode,
+						leg.From.Name,
+						leg.To.Name,
+					)
+				}
 			}
 
 			metroman_routes, err := getMetromanRoutes(english_city_name, stop_a.Name, stop_b.Name, time.Now())
@@ -210,15 +283,102 @@ func main() {
 	}
 }
 
-func startOtpContainer(ctx context.Context) (*exec.Cmd, error) {
+// verifyFeeds parses every feed in build/, printing issues at or above min_severity.
+// Returns false if any issue is at or above fail_severity
+func verifyFeeds(min_severity Severity, fail_severity Severity) bool {
+	zip_paths, err := filepath.Glob("build/*.gtfs.zip")
+	if err != nil {
+		log.Fatalf("glob error: %v", err)
+	}
+	if len(zip_paths) == 0 {
+		log.Fatalf("no GTFS zip files in build/")
+	}
+
+	passed := true
+	for _, zip_path := range zip_paths {
+		if !printIssues(os.Stdout, filepath.Base(zip_path), verifyFeed(zip_path), min_severity, fail_severity) {
+			passed = false
+		}
+	}
+
+	return passed
+}
+
+// printIssues writes the issues of one feed at or above min_severity followed by its totals.
+// Returns false if any issue is at or above fail_severity
+func printIssues(output io.Writer, feed_name string, issues []VerifyIssue, min_severity Severity, fail_severity Severity) bool {
+	passed := true
+
+	counts := map[Severity]int{}
+	for _, issue := range issues {
+		counts[issue.Severity]++
+		if issue.Severity >= min_severity {
+			fmt.Fprintf(output, "%s: %s: %s\n", feed_name, issue.Severity, issue.Message)
+		}
+		if issue.Severity >= fail_severity {
+			passed = false
+		}
+	}
+
+	fmt.Fprintf(output, "%s: %d errors, %d warnings\n", feed_name, counts[SEVERITY_ERROR], counts[SEVERITY_WARNING])
+
+	return passed
+}
+
+// verifyFeed checks a single feed for the problems that would otherwise make OTP testing skip it
+func verifyFeed(zip_path string) []VerifyIssue {
+	issues := []VerifyIssue{}
+
+	feed := gtfsparser.NewFeed()
+	if err := feed.Parse(zip_path); err != nil {
+		return append(issues, VerifyIssue{SEVERITY_ERROR, fmt.Sprintf("failed to parse: %v", err)})
+	}
+
+	if len(feed.Agencies) == 0 {
+		issues = append(issues, VerifyIssue{SEVERITY_ERROR, "no agency"})
+	}
+
+	stops_with_coords := 0
+	for _, stop := range feed.Stops {
+		if stop == nil {
+			continue
+		}
+		if stop.Lat == 0 && stop.Lon == 0 {
+			issues = append(issues, VerifyIssue{SEVERITY_WARNING, fmt.Sprintf("stop %s has no coordinates", stop.Id)})
+		} else {
+			stops_with_coords++
+		}
+		if stop.Name == "" {
+			issues = append(issues, VerifyIssue{SEVERITY_WARNING, fmt.Sprintf("stop %s has no name", stop.Id)})
+		}
+	}
+	if stops_with_coords < 2 {
+		issues = append(issues, VerifyIssue{SEVERITY_ERROR, "fewer than 2 stops with coordinates"})
+	}
+
+	return issues
+}
+
+func parseSeverity(name string) (Severity, error) {
+	switch name {
+	case "warning":
+		return SEVERITY_WARNING, nil
+	case "error":
+		return SEVERITY_ERROR, nil
+	default:
+		return SEVERITY_WARNING, fmt.Errorf("unknown severity '%s'", name)
+	}
+}
+
+func startOtpContainer(ctx context.Context, otp_image string) (*exec.Cmd, error) {
 	cmd := exec.CommandContext(
 		ctx,
 		"docker", "run",
 		"--rm",
 		"-p", "8080:8080",
 		"-v", "./build:/var/opentripplanner",
-		// pin to a specific OTP version if you like, e.g. v2.7.0
-		"docker.io/opentripplanner/opentripplanner:2.8.1",
+		// pin to a specific OTP version with --otp-image, e.g. v2.7.0
+		otp_image,
 		"--load",
 		"--serve",
 	)
@@ -237,9 +397,9 @@ func startOtpContainer(ctx context.Context) (*exec.Cmd, error) {
 }
 
 // waitForOtp just waits until the server responds with any non-5xx code
-func waitForOtp() error {
+func waitForOtp(otp_url string) error {
 	client := &http.Client{Timeout: 2 * time.Second}
-	url_str := "http://localhost:8080/otp"
+	url_str := otp_url + "/otp"
 
 	deadline := time.Now().Add(2 * time.Minute)
 	for {
@@ -260,28 +420,30 @@ func waitForOtp() error {
 	}
 }
 
-// queryOtpRoute uses the OTP GTFS GraphQL API (transit-only)
-func queryOtpRoute(stop_a, stop_b *gtfs.Stop) (*OtpItinerary, error) {
+// queryOtpRoute uses the OTP GTFS GraphQL API with the requested modes and itinerary count
+func queryOtpRoute(otp_url string, stop_a, stop_b *gtfs.Stop, plan_options OtpPlanOptions) ([]OtpItinerary, error) {
 	client := &http.Client{Timeout: 15 * time.Second}
 
-	graphql_url := "http://localhost:8080/otp/gtfs/v1"
+	graphql_url := otp_url + "/otp/gtfs/v1"
 
 	query := `
 query Plan(
-  $fromLat: Float!,
-  $fromLon: Float!,
-  $toLat:   Float!,
-  $toLon:   Float!,
-  $date:    String!,
-  $time:    String!
+  $fromLat:        Float!,
+  $fromLon:        Float!,
+  $toLat:          Float!,
+  $toLon:          Float!,
+  $date:           String!,
+  $time:           String!,
+  $transportModes: [TransportMode],
+  $numItineraries: Int
 ) {
   plan(
     from: { lat: $fromLat, lon: $fromLon }
     to:   { lat: $toLat,   lon: $toLon   }
     date: $date
     time: $time
-    transportModes: [{ mode: TRANSIT }]
-    numItineraries: 1
+    transportModes: $transportModes
+    numItineraries: $numItineraries
   ) {
     itineraries {
       duration
@@ -296,12 +458,14 @@ query Plan(
 `
 
 	variables := map[string]interface{}{
-		"fromLat": stop_a.Lat,
-		"fromLon": stop_a.Lon,
-		"toLat":   stop_b.Lat,
-		"toLon":   stop_b.Lon,
-		"date":    otp_date,
-		"time":    otp_time,
+		"fromLat":        stop_a.Lat,
+		"fromLon":        stop_a.Lon,
+		"toLat":          stop_b.Lat,
+		"toLon":          stop_b.Lon,
+		"date":           otp_date,
+		"time":           otp_time,
+		"transportModes": otpTransportModes(plan_options.Modes),
+		"numItineraries": plan_options.NumItineraries,
 	}
 
 	payload := map[string]interface{}{
@@ -339,11 +503,31 @@ query Plan(
 	if len(gql_resp.Errors) > 0 {
 		return nil, fmt.Errorf("OTP GraphQL error: %s", gql_resp.Errors[0].Message)
 	}
-	if gql_resp.Data.Plan == nil || len(gql_resp.Data.Plan.Itineraries) == 0 {
+	if gql_resp.Data.Plan == nil {
 		return nil, nil
 	}
 
-	return &gql_resp.Data.Plan.Itineraries[0], nil
+	return gql_resp.Data.Plan.Itineraries, nil
+}
+
+// otpTransportModes converts mode names into OTP TransportMode inputs
+func otpTransportModes(modes []string) []map[string]string {
+	transport_modes := []map[string]string{}
+	for _, mode := range modes {
+		mode = strings.ToUpper(strings.TrimSpace(mode))
+		if mode != "" {
+			transport_modes = append(transport_modes, map[string]string{"mode": mode})
+		}
+	}
+	return transport_modes
+}
+
+// envOrDefault returns the environment variable if set, otherwise the fallback
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
 }
 
 // slugStationName converts a station name like
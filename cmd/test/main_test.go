@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/geops/gtfsparser/gtfs"
+)
+
+func TestQueryOtpRouteSendsModes(t *testing.T) {
+	var variables map[string]any
+	otp_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Variables map[string]any `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("could not decode query: %v", err)
+		}
+		variables = payload.Variables
+
+		w.Write([]byte(`{"data": {"plan": {"itineraries": [{"duration": 600, "legs": [{"mode": "SUBWAY"}]}]}}}`))
+	}))
+	defer otp_server.Close()
+
+	stop_a := &gtfs.Stop{Lat: 39.9, Lon: 116.35}
+	stop_b := &gtfs.Stop{Lat: 39.93, Lon: 116.39}
+	itineraries, err := queryOtpRoute(otp_server.URL, stop_a, stop_b, OtpPlanOptions{
+		Modes:          []string{"rail", " walk ", ""},
+		NumItineraries: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itineraries) != 1 || itineraries[0].Legs[0].Mode != "SUBWAY" {
+		t.Errorf("unexpected itineraries %+v", itineraries)
+	}
+
+	// Modes are upper cased and blanks dropped
+	expected_modes := []any{map[string]any{"mode": "RAIL"}, map[string]any{"mode": "WALK"}}
+	if !reflect.DeepEqual(variables["transportModes"], expected_modes) {
+		t.Errorf("expected transportModes %v, got %v", expected_modes, variables["transportModes"])
+	}
+	if variables["numItineraries"] != 3.0 {
+		t.Errorf("expected numItineraries 3, got %v", variables["numItineraries"])
+	}
+}
+
+func TestOtpClientTargetsConfiguredURL(t *testing.T) {
+	var paths []string
+	var paths_lock sync.Mutex
+	otp_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths_lock.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		paths_lock.Unlock()
+
+		w.Write([]byte(`{"data": {"plan": null}}`))
+	}))
+	defer otp_server.Close()
+
+	if err := waitForOtp(otp_server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queryOtpRoute(otp_server.URL, &gtfs.Stop{}, &gtfs.Stop{}, OtpPlanOptions{Modes: []string{"TRANSIT"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected_paths := []string{"GET /otp", "POST /otp/gtfs/v1"}
+	if !reflect.DeepEqual(paths, expected_paths) {
+		t.Errorf("expected requests %v to the configured URL, got %v", expected_paths, paths)
+	}
+}
+
+func TestEnvOrDefault(t *testing.T) {
+	t.Setenv("OTP_IMAGE", "")
+	if image := envOrDefault("OTP_IMAGE", default_otp_image); image != default_otp_image {
+		t.Errorf("expected the default image, got %s", image)
+	}
+
+	t.Setenv("OTP_IMAGE", "docker.io/opentripplanner/opentripplanner:2.7.0")
+	if image := envOrDefault("OTP_IMAGE", default_otp_image); image != "docker.io/opentripplanner/opentripplanner:2.7.0" {
+		t.Errorf("expected the image from the environment, got %s", image)
+	}
+}
+
+func TestPrintIssuesSeverity(t *testing.T) {
+	issues := []VerifyIssue{
+		{SEVERITY_WARNING, "stop XXMS07 has no name"},
+		{SEVERITY_ERROR, "no agency"},
+	}
+
+	var output bytes.Buffer
+	passed := printIssues(&output, "xx.gtfs.zip", issues, SEVERITY_ERROR, SEVERITY_ERROR)
+	if passed {
+		t.Errorf("expected an error to fail verification")
+	}
+	if strings.Contains(output.String(), "has no name") {
+		t.Errorf("warning printed at error level:\n%s", output.String())
+	}
+	if !strings.Contains(output.String(), "xx.gtfs.zip: error: no agency") {
+		t.Errorf("error not printed:\n%s", output.String())
+	}
+	// Totals still count the hidden warning
+	if !strings.Contains(output.String(), "xx.gtfs.zip: 1 errors, 1 warnings") {
+		t.Errorf("unexpected totals:\n%s", output.String())
+	}
+
+	// Warnings alone pass unless they are made fatal
+	warnings := issues[:1]
+	if !printIssues(&bytes.Buffer{}, "xx.gtfs.zip", warnings, SEVERITY_WARNING, SEVERITY_ERROR) {
+		t.Errorf("expected warnings to pass by default")
+	}
+	if printIssues(&bytes.Buffer{}, "xx.gtfs.zip", warnings, SEVERITY_WARNING, SEVERITY_WARNING) {
+		t.Errorf("expected warnings to fail with --fail-on-warnings")
+	}
+}
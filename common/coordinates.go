@@ -1,6 +1,8 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"strings"
@@ -34,29 +36,38 @@ type GeoDiff struct {
 	Points []Mercator
 }
 
-// Decode combined geo diff
-func DecodeCombinedGeoDiff(encoded string) []GeoDiff {
+// Decode combined geo diff, malformed elements are skipped and their errors joined
+func DecodeCombinedGeoDiff(encoded string) ([]GeoDiff, error) {
 	var result []GeoDiff
+	var errs []error
 	elems := strings.Split(encoded, "|")
-	for _, elem := range elems {
-		decoded := DecodeGeoDiff(elem)
+	for i, elem := range elems {
+		decoded, err := DecodeGeoDiff(elem)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("element %d: %v", i, err))
+			continue
+		}
 		if len(decoded.Points) != 0 {
 			result = append(result, decoded)
 		}
 	}
-	return result
+	return result, errors.Join(errs...)
 }
 
-// Decode single geo diff
-func DecodeGeoDiff(encoded string) GeoDiff {
+// Decode single geo diff, an empty string is an empty GeoDiff
+func DecodeGeoDiff(encoded string) (GeoDiff, error) {
 	if len(encoded) == 0 {
-		return GeoDiff{}
+		return GeoDiff{}, nil
 	}
 
 	geo_type_char := encoded[0]           // First character denotes geo type
 	geo_type := GetGeoType(geo_type_char) // Map first character to geo type
 	geo_data := encoded[1:]               // The rest is the geo data
 
+	if geo_type == -1 {
+		return GeoDiff{}, fmt.Errorf("unknown geo type %q", geo_type_char)
+	}
+
 	var points []Mercator
 	var current_point Mercator
 	index := 0
@@ -68,11 +79,11 @@ func DecodeGeoDiff(encoded string) GeoDiff {
 			// Process 13-character blocks
 			// This is always the first
 			if len(geo_data)-index < 13 {
-				return GeoDiff{}
+				return GeoDiff{}, fmt.Errorf("13 character block at %d truncated to %d characters", index, len(geo_data)-index)
 			}
 			block := geo_data[index : index+13]
 			if !Parse13Block(block, &current_point) {
-				return GeoDiff{}
+				return GeoDiff{}, fmt.Errorf("invalid character in 13 character block %q at %d", block, index)
 			}
 			index += 13
 
@@ -88,11 +99,11 @@ func DecodeGeoDiff(encoded string) GeoDiff {
 		} else {
 			// Process 8-character blocks
 			if len(geo_data)-index < 8 {
-				return GeoDiff{}
+				return GeoDiff{}, fmt.Errorf("8 character block at %d truncated to %d characters", index, len(geo_data)-index)
 			}
 			block := geo_data[index : index+8]
 			if !Parse8Block(block, &current_point) {
-				return GeoDiff{}
+				return GeoDiff{}, fmt.Errorf("invalid character in 8 character block %q at %d", block, index)
 			}
 			index += 8
 
@@ -113,7 +124,7 @@ func DecodeGeoDiff(encoded string) GeoDiff {
 	return GeoDiff{
 		Type:   geo_type,
 		Points: points,
-	}
+	}, nil
 }
 
 // Helper function to map the first character to geo type
@@ -131,6 +142,9 @@ func GetGeoType(char byte) GeoType {
 }
 
 // Helper function to parse a 13 byte block and add to current point
+// The block is the '='/'-' marker, then 6 characters of x and 6 of y, each least significant first.
+// Absolute points are never negative in China and 36 bits fit easily in int64 and exactly in
+// float64 (up to 2^53), so the later division by 100 is the only rounding and stays far below a centimeter
 func Parse13Block(block string, current_point *Mercator) bool {
 	var x, y int64
 
@@ -172,7 +186,9 @@ func Parse8Block(block string, current_point *Mercator) bool {
 		delta_y += int64(char_code_y) << (6 * i)
 	}
 
-	// Ensure deltas are within valid range
+	// Deltas are sign-magnitude with bit 23 as the sign, not two's complement.
+	// A negative delta -m is stored as MAX_DELTA_VALUE + m, so MAX_DELTA_VALUE minus the value is -m.
+	// Subtracting 1 << 24 instead would give m - MAX_DELTA_VALUE, wrong by 2m - MAX_DELTA_VALUE
 	if delta_x > MAX_DELTA_VALUE {
 		delta_x = MAX_DELTA_VALUE - delta_x
 	}
@@ -264,7 +280,8 @@ func Sign(val float64) float64 {
 func BaiduMercatorInverse(mercator Mercator) Coordinate {
 	y_abs := math.Abs(mercator.Y)
 
-	var table []float64
+	// The last band starts at 0 so this only applies to NaN, but never index a nil table
+	table := mc2ll[len(mc2ll)-1]
 	for i := 0; i < len(mcband); i++ {
 		if y_abs >= mcband[i] {
 			table = mc2ll[i]
@@ -280,6 +297,27 @@ func BaiduMercatorInverse(mercator Mercator) Coordinate {
 	}
 }
 
+// Great circle distance in meters
+func HaversineDistance(a Coordinate, b Coordinate) float64 {
+	const earth_radius = 6371000.0
+
+	lat_a := a.Lat * math.Pi / 180
+	lat_b := b.Lat * math.Pi / 180
+	delta_lat := (b.Lat - a.Lat) * math.Pi / 180
+	delta_lng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(delta_lat/2)*math.Sin(delta_lat/2) +
+		math.Cos(lat_a)*math.Cos(lat_b)*math.Sin(delta_lng/2)*math.Sin(delta_lng/2)
+
+	return 2 * earth_radius * math.Asin(math.Sqrt(h))
+}
+
+// Rough bounding box of every city MetroMan covers (mainland China, Hong Kong, Macao, and Taiwan).
+// Unlike ChinaHandler.IsWithinChina this needs no geojson, it only catches garbage like (0,0)
+func IsPlausibleChinaCoordinate(coord Coordinate) bool {
+	return coord.Lat >= 3 && coord.Lat <= 54 && coord.Lng >= 73 && coord.Lng <= 136
+}
+
 const xPi = 3.14159265358979324 * 3000.0 / 180.0
 
 // Converts BD-09 to GCJ-02 coordinates
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// Baidu's 6 bit characters for value, least significant first
+func encodeChars(value int64, chars int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	var builder strings.Builder
+	for range chars {
+		builder.WriteByte(alphabet[value&63])
+		value >>= 6
+	}
+	return builder.String()
+}
+
+// An absolute point, x and y are 100 times the Mercator coordinates
+func encode13Block(x int64, y int64) string {
+	return "=" + encodeChars(x, 6) + encodeChars(y, 6)
+}
+
+// A step from the previous point, negative steps are stored as 1 << 23 plus their magnitude
+func encode8Block(delta_x int64, delta_y int64) string {
+	encodeDelta := func(delta int64) string {
+		if delta < 0 {
+			delta = 1<<23 - delta
+		}
+		return encodeChars(delta, 4)
+	}
+	return encodeDelta(delta_x) + encodeDelta(delta_y)
+}
+
+func TestDecodeGeoDiffMalformed(t *testing.T) {
+	valid_line := "-" + encode13Block(1295816097, 482590772) + encode8Block(100, -100)
+	if geo_diff, err := DecodeGeoDiff(valid_line); err != nil || len(geo_diff.Points) != 2 {
+		t.Fatalf("expected a valid line of 2 points, got %+v %v", geo_diff, err)
+	}
+	if geo_diff, err := DecodeGeoDiff(""); err != nil || len(geo_diff.Points) != 0 {
+		t.Errorf("expected nothing for an empty string, got %+v %v", geo_diff, err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		encoded string
+		err     string
+	}{
+		{"unknown geo type", "?" + valid_line[1:], "unknown geo type"},
+		{"truncated 13 character block", valid_line[:10], "13 character block at 0 truncated to 9 characters"},
+		{"invalid character in 13 character block", "-=AAAA!AAAAAAA", "invalid character in 13 character block"},
+		{"truncated 8 character block", valid_line[:len(valid_line)-3], "8 character block at 13 truncated to 5 characters"},
+		{"invalid character in 8 character block", valid_line[:len(valid_line)-1] + "#", "invalid character in 8 character block"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			geo_diff, err := DecodeGeoDiff(test.encoded)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+			if len(geo_diff.Points) != 0 {
+				t.Errorf("expected no points with an error, got %v", geo_diff.Points)
+			}
+		})
+	}
+}
+
+func TestDecodeCombinedGeoDiffSkipsMalformed(t *testing.T) {
+	valid_point := "." + encode13Block(1295816097, 482590772)
+	geo_diffs, err := DecodeCombinedGeoDiff(valid_point + "|" + valid_point[:5] + "|" + valid_point)
+
+	if len(geo_diffs) != 2 {
+		t.Errorf("expected both valid elements to be kept, got %d", len(geo_diffs))
+	}
+	if err == nil || !strings.Contains(err.Error(), "element 1:") {
+		t.Errorf("expected the malformed element to be reported, got %v", err)
+	}
+}
+
+func TestDecodeLineToWGS84(t *testing.T) {
+	// Tiananmen, 500m east and 300m south, then back. Built with encode8Block, not captured from Baidu,
+	// following Baidu's map JS which decodes negative steps with "if (cK > 8388608) cK = 8388608 - cK"
+	const line = "-=hWJPNB0A8wcAQNMAwUHgQNMgwUHA"
+
+	geo_diff, err := DecodeGeoDiff(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_mercators := []Mercator{
+		{12958160.97, 4825907.72},
+		{12958660.97, 4825607.72},
+		{12958160.97, 4825907.72},
+	}
+	if geo_diff.Type != GEO_TYPE_LINE || len(geo_diff.Points) != len(expected_mercators) {
+		t.Fatalf("expected a line of %d points, got %+v", len(expected_mercators), geo_diff)
+	}
+
+	expected_coords := []Coordinate{
+		{39.9071426, 116.3912575},
+		{39.9050645, 116.3957476},
+		{39.9071426, 116.3912575},
+	}
+	china_handler := &ChinaHandler{}
+	for i, point := range geo_diff.Points {
+		if math.Abs(point.X-expected_mercators[i].X) > 1e-6 || math.Abs(point.Y-expected_mercators[i].Y) > 1e-6 {
+			t.Errorf("point %d: expected %+v, got %+v", i, expected_mercators[i], point)
+		}
+
+		coord := china_handler.GCJ02ToWGS84(BD09ToGCJ02(BaiduMercatorInverse(point)))
+		if math.Abs(coord.Lat-expected_coords[i].Lat) > 1e-6 || math.Abs(coord.Lng-expected_coords[i].Lng) > 1e-6 {
+			t.Errorf("point %d: expected WGS84 %+v, got %+v", i, expected_coords[i], coord)
+		}
+	}
+
+	// Negative steps undo positive ones exactly, so long lines cannot drift
+	if geo_diff.Points[2] != geo_diff.Points[0] {
+		t.Errorf("returning step drifted from %+v to %+v", geo_diff.Points[0], geo_diff.Points[2])
+	}
+	if encoded := "-" + encode13Block(1295816097, 482590772) + encode8Block(50000, -30000) + encode8Block(-50000, 30000); encoded != line {
+		t.Errorf("test encoder disagrees with the line, got %s", encoded)
+	}
+}
+
+func TestBaiduMercatorInverseBands(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mercator Mercator
+		lat      float64
+	}{
+		// One y inside each band down to the equator. Baidu's tables approximate an ellipsoidal
+		// Mercator, the expected latitudes are from its exact inverse
+		{"band 0", Mercator{12958160.97, 9000000}, 62.745},
+		{"band 1", Mercator{12958160.97, 6000000}, 47.545},
+		{"band 2", Mercator{12958160.97, 4825907.72}, 39.913},
+		{"band 3", Mercator{12958160.97, 2500000}, 22.037},
+		{"band 4", Mercator{12958160.97, 1000000}, 9.006},
+		{"near 0", Mercator{12958160.97, 0.5}, 0},
+		{"0", Mercator{12958160.97, 0}, 0},
+		{"south of the equator", Mercator{12958160.97, -1000000}, -9.006},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			coord := BaiduMercatorInverse(test.mercator)
+			if math.IsNaN(coord.Lat) || math.Abs(coord.Lat-test.lat) > 0.005 {
+				t.Errorf("expected latitude %.3f, got %f", test.lat, coord.Lat)
+			}
+			if math.Abs(coord.Lng-116.404) > 0.001 {
+				t.Errorf("expected longitude 116.404, got %f", coord.Lng)
+			}
+		})
+	}
+
+	// Does not panic without a matching band
+	BaiduMercatorInverse(Mercator{math.NaN(), math.NaN()})
+}
+
+func TestParse13Block(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		block    string
+		expected Mercator
+	}{
+		{"least significant first", "=BAAAAACAAAAA", Mercator{1, 2}},
+		{"second character", "=ABAAAAAAAAAB", Mercator{64, 1 << 30}},
+		// Tiananmen, 12958160.97 and 4825907.72 before the division by 100
+		{"Tiananmen", "=hWJPNB0A8wcA", Mercator{1295816097, 482590772}},
+		// 36 bits stay exact in float64
+		{"largest", "=////////////", Mercator{1<<36 - 1, 1<<36 - 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var point Mercator
+			if !Parse13Block(test.block, &point) {
+				t.Fatalf("could not parse %s", test.block)
+			}
+			if point != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, point)
+			}
+		})
+	}
+
+	var point Mercator
+	if Parse13Block("=AAAAA!AAAAAA", &point) {
+		t.Errorf("expected an invalid character to fail")
+	}
+}
@@ -3,30 +3,18 @@ package common
 import (
 	"archive/zip"
 	"fmt"
-	"io"
+	"io/fs"
 )
 
 func ReadFileFromZip(zip_reader *zip.Reader, name string) ([]byte, error) {
-	var chosen_file *zip.File
-	for _, file := range zip_reader.File {
-		if file.Name == name {
-			chosen_file = file
-			break
-		}
-	}
-
-	if chosen_file == nil {
-		return []byte{}, fmt.Errorf("could not find file %s in zip", name)
-	}
-
-	opened_file, err := chosen_file.Open()
-	if err != nil {
-		return nil, err
-	}
+	return ReadFileFromFS(zip_reader, name)
+}
 
-	contents, err := io.ReadAll(opened_file)
+// Read a file from a zip, directory, or any other file system
+func ReadFileFromFS(fsys fs.FS, name string) ([]byte, error) {
+	contents, err := fs.ReadFile(fsys, name)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not read file %s: %w", name, err)
 	}
 
 	return contents, nil
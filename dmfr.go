@@ -0,0 +1,84 @@
+package china_gtfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Distributed Mobility Feed Registry document, see https://github.com/transitland/distributed-mobility-feed-registry
+type DMFR struct {
+	Schema string     `json:"$schema"`
+	Feeds  []DMFRFeed `json:"feeds"`
+}
+
+type DMFRFeed struct {
+	ID      string            `json:"id"`
+	Spec    string            `json:"spec"`
+	URLs    DMFRFeedURLs      `json:"urls"`
+	License DMFRLicense       `json:"license"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+type DMFRFeedURLs struct {
+	StaticCurrent string `json:"static_current"`
+}
+
+type DMFRLicense struct {
+	SPDXIdentifier        string `json:"spdx_identifier,omitempty"`
+	URL                   string `json:"url,omitempty"`
+	UseWithoutAttribution string `json:"use_without_attribution"`
+	CreateDerivedProduct  string `json:"create_derived_product"`
+	RedistributionAllowed string `json:"redistribution_allowed"`
+	CommercialUseAllowed  string `json:"commercial_use_allowed"`
+	AttributionText       string `json:"attribution_text"`
+}
+
+// Single feed DMFR for one city, for registering cities with TransitLand individually.
+// DMFR has no bounding box field so it is a tag, "min_lng,min_lat,max_lng,max_lat"
+func (s *ChinaGTFSServer) MetromanGenerateDMFR(city string, feed_url string) ([]byte, error) {
+	metroman_city, exists := s.MetromanServer.Cities[city]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", city)
+	}
+
+	license := s.MetromanServer.License.WithUnknowns()
+
+	// Credit the upstream sources unless the license says otherwise
+	attribution_text := license.AttributionText
+	if attribution_text == "" {
+		attribution_names := []string{}
+		for _, attribution := range s.MetromanServer.DefaultAttributions() {
+			attribution_names = append(attribution_names, attribution.OrganizationName)
+		}
+		attribution_text = fmt.Sprintf("Data from %s", strings.Join(attribution_names, ", "))
+	}
+
+	feed := DMFRFeed{
+		ID:   fmt.Sprintf("f-china~gtfs~%s", city),
+		Spec: "gtfs",
+		URLs: DMFRFeedURLs{
+			StaticCurrent: feed_url,
+		},
+		License: DMFRLicense{
+			SPDXIdentifier:        license.SPDXIdentifier,
+			URL:                   license.URL,
+			UseWithoutAttribution: license.UseWithoutAttribution,
+			CreateDerivedProduct:  license.CreateDerivedProduct,
+			RedistributionAllowed: license.RedistributionAllowed,
+			CommercialUseAllowed:  license.CommercialUseAllowed,
+			AttributionText:       attribution_text,
+		},
+	}
+
+	if min_corner, max_corner, found := metroman_city.BoundingBox(); found {
+		feed.Tags = map[string]string{
+			"bbox": fmt.Sprintf("%f,%f,%f,%f", min_corner.Lng, min_corner.Lat, max_corner.Lng, max_corner.Lat),
+		}
+	}
+
+	return json.MarshalIndent(DMFR{
+		Schema: "https://dmfr.transit.land/json-schema/dmfr.schema-v0.5.0.json",
+		Feeds:  []DMFRFeed{feed},
+	}, "", "  ")
+}
@@ -0,0 +1,100 @@
+package china_gtfs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tgrcode.com/metroman_client"
+)
+
+func TestSingleFeedDMFR(t *testing.T) {
+	s := newTestServer(t)
+
+	dmfr_json, err := s.MetromanGenerateDMFR(test_city_code, "https://example.com/xx.gtfs.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dmfr DMFR
+	if err := json.Unmarshal(dmfr_json, &dmfr); err != nil {
+		t.Fatalf("DMFR is not JSON: %v", err)
+	}
+	if !strings.HasPrefix(dmfr.Schema, "https://dmfr.transit.land/json-schema/") || len(dmfr.Feeds) != 1 {
+		t.Fatalf("expected one feed under the DMFR schema, got %s", dmfr_json)
+	}
+
+	feed := dmfr.Feeds[0]
+	if feed.ID != "f-china~gtfs~xx" || feed.Spec != "gtfs" || feed.URLs.StaticCurrent != "https://example.com/xx.gtfs.zip" {
+		t.Errorf("unexpected feed %+v", feed)
+	}
+	// Without a configured license every flag is unknown
+	if feed.License.UseWithoutAttribution != "unknown" || feed.License.CommercialUseAllowed != "unknown" {
+		t.Errorf("expected unknown license flags, got %+v", feed.License)
+	}
+	if feed.License.AttributionText != "Data from MetroMan, China-GTFS" {
+		t.Errorf("expected the upstream sources to be credited, got %q", feed.License.AttributionText)
+	}
+
+	// Alpha in the west to Golf in the north
+	bbox := strings.Split(feed.Tags["bbox"], ",")
+	if len(bbox) != 4 {
+		t.Fatalf("expected a bbox tag of 4 values, got %q", feed.Tags["bbox"])
+	}
+	corners := []float64{}
+	for _, value := range bbox {
+		corner, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("invalid bbox %q", feed.Tags["bbox"])
+		}
+		corners = append(corners, corner)
+	}
+	if corners[0] < 116.3 || corners[0] >= corners[2] || corners[1] < 39.8 || corners[1] >= corners[3] || corners[3] > 40 {
+		t.Errorf("expected a bbox around the fixture, got %v", corners)
+	}
+
+	if _, err := s.MetromanGenerateDMFR("zz", ""); err == nil {
+		t.Errorf("expected an unloaded city to fail")
+	}
+}
+
+func TestLicensePropagates(t *testing.T) {
+	s := newTestServer(t)
+	s.MetromanServer.License = metroman_client.MetromanLicense{
+		SPDXIdentifier:        "CC-BY-4.0",
+		URL:                   "https://example.com/license",
+		UseWithoutAttribution: "no",
+		CommercialUseAllowed:  "yes",
+		AttributionText:       "Example Transit Data",
+	}
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact_urls := csvColumn(t, readZip(t, gtfs_zip)["feed_info.txt"], "feed_contact_url"); len(contact_urls) != 1 || contact_urls[0] != "https://example.com/license" {
+		t.Errorf("expected the license URL in feed_info.txt, got %v", contact_urls)
+	}
+
+	dmfr_json, err := s.MetromanGenerateDMFR(test_city_code, "https://example.com/xx.gtfs.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dmfr DMFR
+	if err := json.Unmarshal(dmfr_json, &dmfr); err != nil || len(dmfr.Feeds) != 1 {
+		t.Fatalf("expected one feed, got %s", dmfr_json)
+	}
+	expected_license := DMFRLicense{
+		SPDXIdentifier:        "CC-BY-4.0",
+		URL:                   "https://example.com/license",
+		UseWithoutAttribution: "no",
+		CreateDerivedProduct:  "unknown",
+		RedistributionAllowed: "unknown",
+		CommercialUseAllowed:  "yes",
+		AttributionText:       "Example Transit Data",
+	}
+	if dmfr.Feeds[0].License != expected_license {
+		t.Errorf("expected license %+v, got %+v", expected_license, dmfr.Feeds[0].License)
+	}
+}
@@ -0,0 +1,173 @@
+package china_gtfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage for already built feeds, keyed by city and MetroMan version
+type FeedStore interface {
+	// Found is false without an error when the feed has not been stored
+	Get(code string, version string) (contents []byte, found bool, err error)
+	Put(code string, version string, contents []byte) error
+}
+
+func FeedFilename(code string, version string) string {
+	return fmt.Sprintf("%s.%s.gtfs.zip", code, version)
+}
+
+// Feeds stored as files in one directory
+type FileFeedStore struct {
+	Dir string
+}
+
+func (s *FileFeedStore) Get(code string, version string) ([]byte, bool, error) {
+	contents, err := os.ReadFile(filepath.Join(s.Dir, FeedFilename(code, version)))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return contents, true, nil
+}
+
+func (s *FileFeedStore) Put(code string, version string, contents []byte) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.Dir, FeedFilename(code, version)), contents, 0644)
+}
+
+// Feeds stored in an S3 compatible bucket (AWS, Aliyun OSS, MinIO), using path style requests signed with SigV4
+type S3FeedStore struct {
+	Endpoint        string // Like https://s3.us-east-1.amazonaws.com
+	Region          string
+	Bucket          string
+	Prefix          string // Prepended to every key, like "feeds/"
+	AccessKeyID     string
+	SecretAccessKey string
+
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (s *S3FeedStore) Get(code string, version string) ([]byte, bool, error) {
+	resp, err := s.do(http.MethodGet, s.Prefix+FeedFilename(code, version), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("could not get %s from bucket %s: HTTP %d", FeedFilename(code, version), s.Bucket, resp.StatusCode)
+	}
+
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return contents, true, nil
+}
+
+func (s *S3FeedStore) Put(code string, version string, contents []byte) error {
+	resp, err := s.do(http.MethodPut, s.Prefix+FeedFilename(code, version), contents)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not put %s in bucket %s: HTTP %d", FeedFilename(code, version), s.Bucket, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *S3FeedStore) do(method string, key string, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %v", s.Endpoint, err)
+	}
+
+	// Every path segment is escaped the same way for the URL and the signature
+	segments := []string{url.PathEscape(s.Bucket)}
+	for _, segment := range strings.Split(key, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	escaped_path := "/" + strings.Join(segments, "/")
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", endpoint.Scheme, endpoint.Host, escaped_path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amz_date := now.Format("20060102T150405Z")
+	short_date := now.Format("20060102")
+	payload_hash := sha256Hex(body)
+
+	req.Header.Set("x-amz-content-sha256", payload_hash)
+	req.Header.Set("x-amz-date", amz_date)
+
+	// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_request := strings.Join([]string{
+		method,
+		escaped_path,
+		"", // Query string
+		fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", endpoint.Host, payload_hash, amz_date),
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", short_date, s.Region)
+	string_to_sign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amz_date,
+		scope,
+		sha256Hex([]byte(canonical_request)),
+	}, "\n")
+
+	signing_key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), short_date)
+	signing_key = hmacSHA256(signing_key, s.Region)
+	signing_key = hmacSHA256(signing_key, "s3")
+	signing_key = hmacSHA256(signing_key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signing_key, string_to_sign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signed_headers, signature))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,63 @@
+package metroman_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Overrides for one city, merged over the server-wide defaults. Unset fields keep the default
+type MetromanCityConfig struct {
+	Timezone string `json:"timezone,omitempty"` // Like "Asia/Hong_Kong", default Asia/Shanghai
+	Currency string `json:"currency,omitempty"` // ISO 4217 like "HKD", default CNY
+	// Replace MetromanServer.EntryFees and MinimumFares for this city
+	EntryFee    *int `json:"entry_fee,omitempty"`
+	MinimumFare *int `json:"minimum_fare,omitempty"`
+	// Keep MetroMan's coordinates as-is, for cities already on WGS-84. Must be set before loading the city
+	DisableCoordinateCorrection bool `json:"disable_coordinate_correction,omitempty"`
+	// Line codes (like "BJMLSD") left out of the city entirely. Must be set before loading the city
+	ExcludedLines []string `json:"excluded_lines,omitempty"`
+}
+
+// Read a JSON object of city code to MetromanCityConfig, like {"hk": {"currency": "HKD"}}
+func LoadCityConfigs(path string) (map[string]MetromanCityConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read city config %s: %v", path, err)
+	}
+
+	city_configs := map[string]MetromanCityConfig{}
+	if err := json.Unmarshal(contents, &city_configs); err != nil {
+		return nil, fmt.Errorf("could not parse city config %s: %v", path, err)
+	}
+
+	return city_configs, nil
+}
+
+func (s *MetromanServer) CityTimezone(code string) string {
+	if timezone := s.CityConfigs[code].Timezone; timezone != "" {
+		return timezone
+	}
+	return "Asia/Shanghai"
+}
+
+func (s *MetromanServer) CityCurrency(code string) string {
+	if currency := s.CityConfigs[code].Currency; currency != "" {
+		return currency
+	}
+	return "CNY"
+}
+
+func (s *MetromanServer) EntryFee(code string) int {
+	if entry_fee := s.CityConfigs[code].EntryFee; entry_fee != nil {
+		return *entry_fee
+	}
+	return s.EntryFees[code]
+}
+
+func (s *MetromanServer) MinimumFare(code string) int {
+	if minimum_fare := s.CityConfigs[code].MinimumFare; minimum_fare != nil {
+		return *minimum_fare
+	}
+	return s.MinimumFares[code]
+}
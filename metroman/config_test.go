@@ -0,0 +1,55 @@
+package metroman_client
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCityConfigSetsCurrency(t *testing.T) {
+	config_path := path.Join(t.TempDir(), "cities.json")
+	if err := os.WriteFile(config_path, []byte(`{"hk": {"currency": "HKD", "timezone": "Asia/Hong_Kong"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	city_configs, err := LoadCityConfigs(config_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fixture loaded as both Hong Kong and the default city
+	s := newTestServer()
+	s.CityConfigs = city_configs
+	loadTestCity(t, s, nil)
+	if err := s.LoadCityFromFS("hk", test_zip_prefix, testCityFS(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for code, expected := range map[string][2]string{
+		"hk":           {"HKD", "Asia/Hong_Kong"},
+		test_city_code: {"CNY", "Asia/Shanghai"},
+	} {
+		_, fare_attributes_txt, err := s.GenerateFaresTXT(code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fares := readCSV(t, fare_attributes_txt)
+		if len(fares) == 0 {
+			t.Fatalf("%s: expected fares", code)
+		}
+		for _, fare := range fares {
+			if fare["currency_type"] != expected[0] {
+				t.Fatalf("%s: expected %s fares, got %v", code, expected[0], fare)
+			}
+		}
+
+		for _, agency := range readCSV(t, s.GenerateAgencyTXT(code, GenerateOptions{})) {
+			if agency["agency_timezone"] != expected[1] {
+				t.Errorf("%s: expected agency in %s, got %v", code, expected[1], agency)
+			}
+		}
+	}
+
+	if _, err := LoadCityConfigs(path.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected a missing config to fail")
+	}
+}
@@ -3,28 +3,358 @@ package metroman_client
 import (
 	"archive/zip"
 	"bytes"
+	"cmp"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
 	"net/http"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
 	"tgrcode.com/baidu_client"
 	"tgrcode.com/china_gtfs/common"
 )
 
 type MetromanServer struct {
-	CityZips      map[string][]byte
-	Cities        map[string]*MetromanCity
+	CityZips map[string][]byte
+	Cities   map[string]*MetromanCity
+	// Replaced by RefreshVersions, read it through ZipDate and replace it through SetVersions when requests may run concurrently
 	ZipDateLookup map[string]string
+	versions_lock sync.RWMutex
+	// Every successful version.txt refresh is also saved here when set, see LoadVersionsCache
+	VersionsCachePath string
 
 	ChinaHandler *common.ChinaHandler
+	// Keep MetroMan's GCJ-02 coordinates as-is, must be set before loading cities
+	DisableCoordinateCorrection bool
+	// Key used for StationsByName, must be set before loading cities
+	StationKeyStrategy StationKeyStrategy
+	// Drop trips running outside these hours (like depot moves), nil keeps every trip
+	ServiceHours *MetromanServiceHours
+	// Synthesize trips for routes without a schedule CSV, nil leaves them without trips
+	EstimateMissingTrips *MetromanTripEstimate
+	// Keep bus and tram lines and routes some cities have in uno.csv, see uno_line_route_types. Must be set
+	// before loading cities
+	IncludeBusAndTram bool
+	// City code to a fee for entering the network, added to every distance fare in fare_attributes.txt
+	EntryFees map[string]int
+	// City code to the lowest fare charged (the flat entry/exit fare, often 3 CNY), raising any fare below it
+	MinimumFares map[string]int
+	// Line code (like "BJMLSD") to the company running it, must be set before loading cities. MetroMan has
+	// no operator data so unlisted lines belong to the city agency
+	LineOperators map[string]MetromanOperator
+	// Terms the feeds are published under, the zero value marks them unknown
+	License MetromanLicense
+	// City code to overrides of the settings above and the defaults below, see LoadCityConfigs
+	CityConfigs map[string]MetromanCityConfig
 
 	BaiduServer *baidu_client.BaiduServer
 }
 
+type StationKeyStrategy int
+
+const (
+	STATION_KEY_SIMPLIFIED_NAME StationKeyStrategy = 0
+	STATION_KEY_CODE            StationKeyStrategy = 1
+	STATION_KEY_COMPOSITE       StationKeyStrategy = 2 // Simplified name and code
+)
+
+type FareMode int
+
+const (
+	FARE_MODE_DISTANCE FareMode = 0 // Price depends on the station pair
+	FARE_MODE_FIXED    FareMode = 1 // One price for every journey
+)
+
+// Zero value generates the default feed. Coordinates are corrected
+// while loading, see MetromanServer.DisableCoordinateCorrection
+type GenerateOptions struct {
+	Debug bool // Also write every generated file to the debug directory
+	// Look up stop_url for every stop on Baidu, requires a Baidu server and is slow
+	FullBaiduLookups bool
+	// With FullBaiduLookups, list parking and bike share near each stop in stop_desc. Two more Baidu requests per stop
+	NearbyFacilities bool
+	// Add fare_attributes.txt and fare_rules.txt, plus networks.txt and route_networks.txt for Fares v2
+	IncludeFares bool
+	// Prepended to every stop, zone, fare, route, service, trip, and shape id so feeds can be merged
+	IDPrefix string
+	// Only write these files (like "stops.txt"), nil writes every file
+	Files []string
+	// Fill route_desc with the line and termini so both directions can be told apart
+	RouteDescriptions bool
+	// Written for every trip, MetroMan has no per line accessibility data
+	WheelchairAccessible TripAccessibility
+	BikesAllowed         TripAccessibility
+	// Credited in attributions.txt, nil credits the upstream sources (see DefaultAttributions)
+	Attributions []MetromanAttribution
+	// Namespace for agency_id (the city code by default) so short codes don't collide between feeds
+	AgencyIDPrefix string
+	// One stop per physical station (stations sharing a simplified name) at their average coordinate,
+	// rather than one per MetroMan station
+	CollapseStations bool
+	// Add the non-standard metroman_code column to stops.txt with the original MetroMan station code
+	IncludeMetromanCodes bool
+	// Decimal places of stop and shape coordinates, 0 keeps the default of 6 (about 10 cm)
+	CoordinatePrecision int
+	// Keep stations no scheduled route stops at. MetroMan has no construction flag but lists future
+	// stations on lines before any trip serves them, so these are left out of a live feed by default
+	IncludeUnservedStations bool
+	// Keep stations MetroMan has no coordinates for as stops at (0,0), rather than leaving them and
+	// their stop_times rows out
+	IncludeZeroCoordinateStations bool
+	// Use the line's terminus for each direction as trip_headsign (see LineDirections) instead of the route name,
+	// so short turn trips show where the line goes
+	TerminusHeadsigns bool
+	// What walking ways (WW, connections between stations like out of station interchanges) become
+	WalkingWayMode WalkingWayMode
+	// File name to columns left out of it, like {"stop_times.txt": {"timepoint"}} for validators that reject timepoint
+	ExcludeColumns map[string][]string
+	// Line ending of every generated file, LF by default
+	LineEnding LineEnding
+	// Drop the line ending after the last record
+	OmitTrailingNewline bool
+	// Emit trips shared by several schedules of a route once, under a service combining those schedules
+	DeduplicateTrips bool
+	// Transfers allowed on one fare, nil is unlimited since a metro fare covers the whole network
+	MaxFareTransfers *int
+	// Collects problems like unresolved stops, missing shapes, and bad fares instead of failing on the first,
+	// nil fails on problems that used to be errors and ignores the rest
+	Report *MetromanGenerationReport
+}
+
+type MetromanGenerationEventKind string
+
+const (
+	GENERATION_EVENT_STOP_OMITTED              MetromanGenerationEventKind = "stop_omitted"    // Unserved or without coordinates
+	GENERATION_EVENT_STOP_UNRESOLVED           MetromanGenerationEventKind = "stop_unresolved" // No Baidu POI for stop_url
+	GENERATION_EVENT_BAIDU_FALLBACK            MetromanGenerationEventKind = "baidu_fallback"  // Typing autocomplete heuristic used
+	GENERATION_EVENT_SHAPE_MISSING             MetromanGenerationEventKind = "shape_missing"
+	GENERATION_EVENT_SHAPE_SEGMENT_SYNTHESIZED MetromanGenerationEventKind = "shape_segment_synthesized" // Straight line where MetroMan has no path
+	GENERATION_EVENT_SHAPE_POINTS_DROPPED      MetromanGenerationEventKind = "shape_points_dropped"
+	GENERATION_EVENT_SHAPE_ID_CLEARED          MetromanGenerationEventKind = "shape_id_cleared" // See ReconcileShapeIDs
+	GENERATION_EVENT_FARE_INVALID              MetromanGenerationEventKind = "fare_invalid"
+	GENERATION_EVENT_TRIPS_ESTIMATED           MetromanGenerationEventKind = "trips_estimated" // See MetromanServer.EstimateMissingTrips
+)
+
+// One decision or problem, Subject is the stop, shape, fare or route it concerns
+type MetromanGenerationEvent struct {
+	Kind    MetromanGenerationEventKind `json:"kind"`
+	Subject string                      `json:"subject"`
+	Message string                      `json:"message"`
+}
+
+// Non-fatal problems and data-quality compromises made while generating a feed. Safe to share between
+// generators running at once, an event added by several generators is kept once
+type MetromanGenerationReport struct {
+	lock   sync.Mutex
+	events map[MetromanGenerationEvent]bool
+}
+
+func (r *MetromanGenerationReport) Add(kind MetromanGenerationEventKind, subject string, format string, a ...any) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.events == nil {
+		r.events = make(map[MetromanGenerationEvent]bool)
+	}
+	r.events[MetromanGenerationEvent{
+		Kind:    kind,
+		Subject: subject,
+		Message: fmt.Sprintf(format, a...),
+	}] = true
+}
+
+// Sorted by kind then subject, as generators running at once add events in any order
+func (r *MetromanGenerationReport) Events() []MetromanGenerationEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// Never nil so an empty log marshals to []
+	events := make([]MetromanGenerationEvent, 0, len(r.events))
+	for event := range r.events {
+		events = append(events, event)
+	}
+	slices.SortFunc(events, func(a MetromanGenerationEvent, b MetromanGenerationEvent) int {
+		return cmp.Or(
+			strings.Compare(string(a.Kind), string(b.Kind)),
+			strings.Compare(a.Subject, b.Subject),
+			strings.Compare(a.Message, b.Message),
+		)
+	})
+	return events
+}
+
+// Messages of every event, sorted
+func (r *MetromanGenerationReport) Problems() []string {
+	problems := []string{}
+	for _, event := range r.Events() {
+		problems = append(problems, event.Message)
+	}
+	return slices.Sorted(slices.Values(problems))
+}
+
+type WalkingWayMode int
+
+const (
+	WALKING_WAY_MODE_TRANSFERS WalkingWayMode = 0 // transfers.txt rows between the connected stops
+	WALKING_WAY_MODE_IGNORE    WalkingWayMode = 1
+	// Walking ways with a timetable become routes with trips, the rest stay transfers.txt rows
+	WALKING_WAY_MODE_ROUTES WalkingWayMode = 2
+)
+
+type LineEnding int
+
+const (
+	LINE_ENDING_LF   LineEnding = 0
+	LINE_ENDING_CRLF LineEnding = 1
+)
+
+type MetromanAttribution struct {
+	OrganizationName string
+	URL              string
+	IsProducer       bool
+	IsOperator       bool
+	IsAuthority      bool
+}
+
+// Values of trips.txt wheelchair_accessible and bikes_allowed
+type TripAccessibility int
+
+const (
+	TRIP_ACCESSIBILITY_UNKNOWN TripAccessibility = 0
+	TRIP_ACCESSIBILITY_YES     TripAccessibility = 1
+	TRIP_ACCESSIBILITY_NO      TripAccessibility = 2
+)
+
+func (o GenerateOptions) ID(id string) string {
+	return o.IDPrefix + id
+}
+
+func (o GenerateOptions) AgencyID(city_code string) string {
+	return o.AgencyIDPrefix + city_code
+}
+
+// Remove the columns opts.ExcludeColumns lists for filename, contents must be as generated (LF endings)
+func (o GenerateOptions) ApplyExcludeColumns(filename string, contents string) (string, error) {
+	excluded_columns := o.ExcludeColumns[filename]
+	if len(excluded_columns) == 0 {
+		return contents, nil
+	}
+
+	records, err := csv.NewReader(strings.NewReader(contents)).ReadAll()
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %v", filename, err)
+	}
+	if len(records) == 0 {
+		return contents, nil
+	}
+
+	kept_indices := []int{}
+	for i, column := range records[0] {
+		if !slices.Contains(excluded_columns, column) {
+			kept_indices = append(kept_indices, i)
+		}
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	for _, record := range records {
+		kept_record := []string{}
+		for _, i := range kept_indices {
+			kept_record = append(kept_record, record[i])
+		}
+
+		if err := csv_writer.Write(kept_record); err != nil {
+			return "", err
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Generators write LF endings with a trailing newline, convert contents to the chosen dialect
+func (o GenerateOptions) ApplyLineEnding(contents string) string {
+	line_ending := "\n"
+	if o.LineEnding == LINE_ENDING_CRLF {
+		line_ending = "\r\n"
+		contents = strings.ReplaceAll(contents, "\n", line_ending)
+	}
+
+	if o.OmitTrailingNewline {
+		contents = strings.TrimSuffix(contents, line_ending)
+	}
+
+	return contents
+}
+
+// Agency of the operator running the line, or the city agency
+func (o GenerateOptions) LineAgencyID(city_code string, line *MetromanLine) string {
+	if line != nil && line.Operator != nil {
+		return o.AgencyIDPrefix + line.Operator.ID
+	}
+	return o.AgencyID(city_code)
+}
+
+func (o GenerateOptions) FormatCoordinate(degrees float64) string {
+	precision := o.CoordinatePrecision
+	if precision == 0 {
+		precision = 6
+	}
+	return strconv.FormatFloat(degrees, 'f', precision, 64)
+}
+
+// fare_attributes.txt transfers, blank is unlimited
+func (o GenerateOptions) FareTransfers() string {
+	if o.MaxFareTransfers == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *o.MaxFareTransfers)
+}
+
+// Whether filename should be written, every file is by default
+func (o GenerateOptions) IncludesFile(filename string) bool {
+	return o.Files == nil || slices.Contains(o.Files, filename)
+}
+
+// Whether route is written to routes.txt and the files referencing it. Transit routes always are, walking
+// ways only with WALKING_WAY_MODE_ROUTES and a timetable to give them trips
+func (o GenerateOptions) IncludesRoute(route *MetromanRoute) bool {
+	if route.Walking && o.WalkingWayMode == WALKING_WAY_MODE_ROUTES {
+		return len(route.Trips) > 0
+	}
+	return IsTransitRoute(route)
+}
+
+// Operating window in minutes since midnight, End may pass 1440 to reach into the next day (04:00-01:30 is 240-1530)
+type MetromanServiceHours struct {
+	StartMinutes int
+	EndMinutes   int
+}
+
+// Trips are estimated from the distance between stations, must be set before loading cities
+type MetromanTripEstimate struct {
+	SpeedKmh       float64 // Average speed including time stopped at stations
+	HeadwayMinutes int
+	StartMinutes   int // First and last departures from the first station
+	EndMinutes     int
+}
+
 type MetromanDate struct {
 	Year  int
 	Month int
@@ -41,18 +371,48 @@ type MetromanCity struct {
 	Lines  []*MetromanLine
 	Routes []*MetromanRoute
 
-	// Heuristic key for stations is SimplifiedName, will be experimenting
-	Stations       []*MetromanStation
-	StationsByName map[string]*MetromanStation
-	StationsByCode map[string]*MetromanStation
+	// Heuristic key for stations is SimplifiedName by default, see StationKeyStrategy.
+	// Stations sharing a key are all kept
+	Stations           []*MetromanStation
+	StationsByName     map[string][]*MetromanStation
+	StationsByCode     map[string]*MetromanStation
+	StationKeyStrategy StationKeyStrategy
 
 	StationExitsByCode map[string][]*MetromanExit
 
+	// Lines and routes serving each station code, in the order of Lines and Routes. See IndexStations
+	LinesByStation  map[string][]*MetromanLine
+	RoutesByStation map[string][]*MetromanRoute
+
 	FareMatrices       []*[][]int
 	FareMatrixStations [][]*MetromanStation
 
 	Holidays    []MetromanDate
 	ScheduleDef map[string]*MetromanSchedule
+
+	// Problems found between uno.csv and line.csv while loading, see FindLineStationMismatches
+	LineWarnings []string
+
+	// Loaded with LoadCityMetadataOnly, routes have no trips
+	MetadataOnly bool
+}
+
+type MetromanCityStats struct {
+	Stations     int      `json:"stations"`
+	Lines        int      `json:"lines"`
+	Routes       int      `json:"routes"`
+	LineWarnings []string `json:"line_warnings"`
+
+	// Gaps in the generated feed, see Complete
+	MetroRoutes                int `json:"metro_routes"`
+	RoutesWithoutTrips         int `json:"routes_without_trips"`
+	RoutesWithoutShapes        int `json:"routes_without_shapes"`
+	StationsWithoutCoordinates int `json:"stations_without_coordinates"`
+}
+
+// Every metro route has trips and a shape and every station has coordinates
+func (c *MetromanCityStats) Complete() bool {
+	return c.MetroRoutes > 0 && c.RoutesWithoutTrips == 0 && c.RoutesWithoutShapes == 0 && c.StationsWithoutCoordinates == 0
 }
 
 type MetromanStation struct {
@@ -69,6 +429,9 @@ type MetromanStation struct {
 
 	Lat float64
 	Lng float64
+	// As stored by MetroMan (GCJ-02 outside Taipei, Macao, and Hong Kong)
+	RawLat float64
+	RawLng float64
 
 	SubwayMapX int
 	SubwayMapY int
@@ -84,13 +447,46 @@ type MetromanLine struct {
 
 	ShortName string
 
-	Color string
+	Color     string
+	Walking   bool   // WL rather than ML
+	RouteType string // GTFS route_type, see uno_line_route_types
+
+	Operator *MetromanOperator // Nil when run by the city agency, see LineOperators
 
 	Stations []*MetromanStation
 	// Just a simple lookup table for paths between stations
 	StationPaths map[string][]common.Coordinate
 }
 
+// MetroMan publishes no license for its data, so redistribution terms are left to whoever runs the server.
+// Flags are DMFR values ("yes", "no", "exclusive", or "unknown"), empty means unknown
+type MetromanLicense struct {
+	SPDXIdentifier        string
+	URL                   string // Also feed_contact_url in feed_info.txt
+	UseWithoutAttribution string
+	CreateDerivedProduct  string
+	RedistributionAllowed string
+	CommercialUseAllowed  string
+	AttributionText       string
+}
+
+// Copy with every empty flag set to "unknown"
+func (l MetromanLicense) WithUnknowns() MetromanLicense {
+	for _, flag := range []*string{&l.UseWithoutAttribution, &l.CreateDerivedProduct, &l.RedistributionAllowed, &l.CommercialUseAllowed} {
+		if *flag == "" {
+			*flag = "unknown"
+		}
+	}
+	return l
+}
+
+// Written to agency.txt as its own agency
+type MetromanOperator struct {
+	ID   string
+	Name string
+	URL  string
+}
+
 type MetromanRoute struct {
 	Code string
 
@@ -99,12 +495,16 @@ type MetromanRoute struct {
 	TraditionalName string
 	JapaneseName    string
 
+	Walking bool // WW rather than MW
+
 	Stations               []*MetromanStation
 	StationToScheduleIndex map[int]int // Station index -> index within schedule (schedule is not in order, is actually in sorted order)
 	Line                   *MetromanLine
 	IdxWithinLine          int
 	Schedules              []*MetromanSchedule
 	Trips                  [][]MetromanTrip // Set of trips for each schedule
+	EstimatedTrips         bool             // Trips come from EstimateTrips rather than MetroMan's timetable
+	TripsSkipped           bool             // Timetable exists but was not read, see LoadCityMetadataOnly
 }
 
 type MetromanTrip struct {
@@ -118,15 +518,98 @@ type MetromanStationVisit struct {
 	//NextArrivalMinutes int
 }
 
-// Exits include toilets, may exclude outright for now
+// Station to station fares, first index of Fares is the start station and second is the end
+type MetromanFareMatrix struct {
+	StationCodes []string `json:"station_codes"`
+	Fares        [][]int  `json:"fares"`
+}
+
+type MetromanTripTimetable struct {
+	TripID       string                  `json:"trip_id"`
+	RouteCode    string                  `json:"route_code"`
+	ScheduleCode string                  `json:"schedule_code"`
+	Departure    string                  `json:"departure"` // HH:MM from the first stop, may pass 24:00
+	Stops        []MetromanTimetableStop `json:"stops"`
+}
+
+// Every trip of a route running under one schedule, sorted by first departure
+type MetromanRouteSchedule struct {
+	ScheduleCode string                  `json:"schedule_code"`
+	Trips        []MetromanTripTimetable `json:"trips"`
+}
+
+type MetromanTimetableStop struct {
+	StationCode string `json:"station_code"`
+	EnglishName string `json:"english_name"`
+	Minutes     int    `json:"minutes"`
+	Time        string `json:"time"` // GTFS time, may pass 24:00:00
+}
+
+// Upcoming departures from one station for a single route direction
+type MetromanDepartures struct {
+	RouteCode   string              `json:"route_code"`
+	EnglishName string              `json:"english_name"`
+	Headsign    string              `json:"headsign"` // English name of the last station
+	Departures  []MetromanDeparture `json:"departures"`
+}
+
+type MetromanDeparture struct {
+	TripID       string `json:"trip_id"`
+	ScheduleCode string `json:"schedule_code"`
+	Minutes      int    `json:"minutes"`
+	Time         string `json:"time"`
+}
+
+// One direction of a line, direction_id in trips.txt
+type MetromanLineDirection struct {
+	DirectionID int    `json:"direction_id"`
+	Headsign    string `json:"headsign"` // English name of the line's terminus that way
+	Name        string `json:"name"`     // Like "Towards Sihui East"
+}
+
+type MetromanFirstLastTrain struct {
+	RouteCode    string `json:"route_code"`
+	Headsign     string `json:"headsign"`
+	FirstMinutes int    `json:"first_minutes"`
+	LastMinutes  int    `json:"last_minutes"`
+}
+
+// Exits include toilets, those are excluded while parsing, see IsToiletExit
 type MetromanExit struct {
-	Code string
+	Code        string
+	StationCode string
 
 	SimplifiedName        string
 	SimplifiedDescription string
 }
 
 func CreateServer() (*MetromanServer, error) {
+	versions_lookup, err := GetVersionsLookup()
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateServerWithVersions(versions_lookup)
+}
+
+// Create a server without fetching version.txt, versions_lookup may be empty (version.txt is retried on first use)
+func CreateServerWithVersions(versions_lookup map[string]string) (*MetromanServer, error) {
+	// Create China handler for coordinates
+	china_handler, err := common.NewChinaHandler("china.geojson")
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetromanServer{
+		CityZips:      make(map[string][]byte),
+		Cities:        make(map[string]*MetromanCity),
+		ChinaHandler:  china_handler,
+		ZipDateLookup: versions_lookup,
+	}, nil
+}
+
+// Get the latest zip date for every city from version.txt
+func GetVersionsLookup() (map[string]string, error) {
 	// Download version.txt (without headers)
 	// Determined with a reverse proxy
 	versions_resp, err := http.Get("https://metroman.oss-cn-hangzhou.aliyuncs.com/app/metromanandroid/v202005/version.txt")
@@ -150,18 +633,87 @@ func CreateServer() (*MetromanServer, error) {
 		}
 	}
 
-	// Create China handler for coordinates
-	china_handler, err := common.NewChinaHandler("china.geojson")
+	return versions_lookup, nil
+}
+
+// Fetch version.txt again, saving it to VersionsCachePath
+func (s *MetromanServer) RefreshVersions() error {
+	versions_lookup, err := GetVersionsLookup()
+	if err != nil {
+		return err
+	}
+	s.SetVersions(versions_lookup)
+
+	if s.VersionsCachePath != "" {
+		if err := SaveVersionsCache(s.VersionsCachePath, versions_lookup); err != nil {
+			log.Printf("Could not save versions cache: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Versions are cached as code,zip_date rows
+func SaveVersionsCache(path string, versions_lookup map[string]string) error {
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	for _, code := range slices.Sorted(maps.Keys(versions_lookup)) {
+		if err := csv_writer.Write([]string{code, versions_lookup[code]}); err != nil {
+			return err
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func LoadVersionsCache(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MetromanServer{
-		CityZips:      make(map[string][]byte),
-		Cities:        make(map[string]*MetromanCity),
-		ChinaHandler:  china_handler,
-		ZipDateLookup: versions_lookup,
-	}, nil
+	records, err := csv.NewReader(bytes.NewReader(contents)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse versions cache %s: %v", path, err)
+	}
+
+	versions_lookup := make(map[string]string)
+	for _, record := range records {
+		if len(record) == 2 {
+			versions_lookup[record[0]] = record[1]
+		}
+	}
+
+	return versions_lookup, nil
+}
+
+// Zip date of a city from version.txt
+func (s *MetromanServer) ZipDate(code string) (string, bool) {
+	s.versions_lock.RLock()
+	defer s.versions_lock.RUnlock()
+
+	zip_date, ok := s.ZipDateLookup[code]
+	return zip_date, ok
+}
+
+func (s *MetromanServer) SetVersions(versions_lookup map[string]string) {
+	s.versions_lock.Lock()
+	defer s.versions_lock.Unlock()
+
+	s.ZipDateLookup = versions_lookup
+}
+
+func (s *MetromanServer) hasVersions() bool {
+	s.versions_lock.RLock()
+	defer s.versions_lock.RUnlock()
+
+	return len(s.ZipDateLookup) > 0
 }
 
 func (s *MetromanServer) SetBaiduServer(baidu_server *baidu_client.BaiduServer) {
@@ -169,29 +721,46 @@ func (s *MetromanServer) SetBaiduServer(baidu_server *baidu_client.BaiduServer)
 }
 
 func (s *MetromanServer) GetCityVersion(code string) (string, error) {
-	zip_date, ok := s.ZipDateLookup[code]
+	zip_date, ok := s.ZipDate(code)
+
+	// Created without versions, MetroMan may be reachable again
+	if !ok && !s.hasVersions() {
+		if err := s.RefreshVersions(); err == nil {
+			zip_date, ok = s.ZipDate(code)
+		}
+	}
+
 	if !ok {
 		return "", fmt.Errorf("city with code '%s' has not been loaded", code)
 	}
 	return zip_date, nil
 }
 
-func (s *MetromanServer) LoadCity(code string) error {
-	// Get zip date, erroring if this city does not exist
-	zip_date, ok := s.ZipDateLookup[code]
-	if !ok {
-		return fmt.Errorf("city with code '%s' has not been loaded", code)
+// Copy of the holidays for a city, as listed in holiday.csv
+func (s *MetromanServer) GetCityHolidays(code string) ([]MetromanDate, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
 	}
+	return slices.Clone(city.Holidays), nil
+}
 
-	// Download zip (without headers)
-	url := fmt.Sprintf("https://metroman.oss-cn-hangzhou.aliyuncs.com/app/metromanandroid/v202005/%s/%s.zip", code, zip_date)
-	zip_resp, err := http.Get(url)
-	if err != nil {
-		return err
+// Copy of the schedule definitions for a city, keyed by schedule code
+func (s *MetromanServer) GetCitySchedules(code string) (map[string]MetromanSchedule, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
 	}
-	defer zip_resp.Body.Close()
 
-	zip, err := io.ReadAll(zip_resp.Body)
+	schedules := make(map[string]MetromanSchedule, len(city.ScheduleDef))
+	for schedule_code, schedule := range city.ScheduleDef {
+		schedules[schedule_code] = *schedule
+	}
+	return schedules, nil
+}
+
+func (s *MetromanServer) LoadCity(code string) error {
+	zip_date, zip, err := s.downloadCity(code)
 	if err != nil {
 		return err
 	}
@@ -210,58 +779,270 @@ func (s *MetromanServer) LoadCity(code string) error {
 	return nil
 }
 
-func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, city_code string) (*MetromanCity, error) {
-	// Step 1: Create a new zip reader from the []byte data
-	payload_reader, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+// Load only stations, lines, routes, fares and schedule definitions, skipping the per-route timetables.
+// Enough for stops.txt, shapes.txt and the GeoJSON outputs but not trips.txt or stop_times.txt
+func (s *MetromanServer) LoadCityMetadataOnly(code string) error {
+	zip_date, zip_payload, err := s.downloadCity(code)
 	if err != nil {
-		return nil, fmt.Errorf("could not open zip reader: %v", err)
+		return err
 	}
 
-	lines := []*MetromanLine{}
-	routes := []*MetromanRoute{}
-	stations := []*MetromanStation{}
-	stations_by_name := make(map[string]*MetromanStation)
-	stations_by_code := make(map[string]*MetromanStation)
-	lines_by_code := make(map[string]*MetromanLine)
-	routes_by_code := make(map[string]*MetromanRoute)
-	fare_matrices := []*[][]int{}
-	fare_matrix_stations := [][]*MetromanStation{}
-	holidays := []MetromanDate{}
+	s.CityZips[code] = zip_payload
 
-	// Read in stations/lines first from uno.csv
-	uno_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/uno.csv", zip_prefix))
+	payload_reader, err := zip.NewReader(bytes.NewReader(zip_payload), int64(len(zip_payload)))
 	if err != nil {
-		return nil, fmt.Errorf("could not open uno.csv: %v", err)
+		return fmt.Errorf("could not open zip reader: %v", err)
 	}
 
-	// Read through the CSV
-	uno_csv_lines := strings.Split(string(uno_csv_contents), "\r\n")
+	city, err := s.parseCity(payload_reader, zip_date, code, true)
+	if err != nil {
+		return err
+	}
 
-	station_index := 0
-	for _, uno_record_line := range uno_csv_lines {
-		uno_record := strings.Split(uno_record_line, "<,>")
+	s.Cities[code] = city
 
-		if uno_record[1] == "MS" {
-			lat_raw, _ := strconv.ParseFloat(uno_record[8], 64)
-			lng_raw, _ := strconv.ParseFloat(uno_record[9], 64)
-			subway_map_x, _ := strconv.ParseInt(uno_record[10], 10, 0)
-			subway_map_y, _ := strconv.ParseInt(uno_record[11], 10, 0)
+	return nil
+}
 
-			var corrected_coord common.Coordinate
-			// Keep as-is if Taipei, Macao, or Hong Kong
-			if city_code == "tb" || city_code == "am" || city_code == "hk" {
-				corrected_coord = common.Coordinate{
-					Lat: lat_raw,
-					Lng: lng_raw,
-				}
-			} else {
-				corrected_coord = s.ChinaHandler.GCJ02ToWGS84(common.Coordinate{
-					Lat: lat_raw,
-					Lng: lng_raw,
-				})
-			}
+// Download the zip for a city, refreshing versions once if the date is stale
+func (s *MetromanServer) downloadCity(code string) (string, []byte, error) {
+	// Get zip date, erroring if this city does not exist
+	zip_date, ok := s.ZipDate(code)
+	if !ok {
+		return "", nil, fmt.Errorf("city with code '%s' has not been loaded", code)
+	}
 
-			station := MetromanStation{
+	zip, status_code, err := DownloadCityZip(code, zip_date)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// OSS returns 403/404 when our date is stale, refresh version.txt and try once more with the new date
+	if status_code == http.StatusForbidden || status_code == http.StatusNotFound {
+		if err := s.RefreshVersions(); err != nil {
+			return "", nil, fmt.Errorf("could not refresh versions after HTTP %d for %s: %v", status_code, code, err)
+		}
+
+		new_zip_date, ok := s.ZipDate(code)
+		if !ok {
+			return "", nil, fmt.Errorf("city with code '%s' no longer exists", code)
+		}
+		if new_zip_date == zip_date {
+			return "", nil, fmt.Errorf("could not download zip for %s: HTTP %d", code, status_code)
+		}
+
+		zip_date = new_zip_date
+		zip, status_code, err = DownloadCityZip(code, zip_date)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if status_code != http.StatusOK {
+		return "", nil, fmt.Errorf("could not download zip for %s: HTTP %d", code, status_code)
+	}
+
+	return zip_date, zip, nil
+}
+
+// MetroMan files end lines with \r\n, usually including the last one. Empty lines are dropped
+func SplitLines(contents []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(contents), "\r\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Error for a record too short to index its fixed columns, which would otherwise panic
+func requireColumns(filename string, line_idx int, record []string, columns int) error {
+	if len(record) < columns {
+		return fmt.Errorf("%s line %d has %d columns, expected at least %d", filename, line_idx+1, len(record), columns)
+	}
+	return nil
+}
+
+// MetroMan mostly separates columns with "<,>" but some files, like wayschedule.csv, use plain commas
+// and which one a file uses has changed between versions
+func DetectDelimiter(contents string) string {
+	if strings.Contains(contents, "<,>") {
+		return "<,>"
+	}
+	return ","
+}
+
+func StationKey(strategy StationKeyStrategy, station *MetromanStation) string {
+	switch strategy {
+	case STATION_KEY_CODE:
+		return station.Code
+	case STATION_KEY_COMPOSITE:
+		return fmt.Sprintf("%s_%s", station.SimplifiedName, station.Code)
+	default:
+		return station.SimplifiedName
+	}
+}
+
+// Convert a MetroMan coordinate to WGS-84 unless correction is disabled
+func (s *MetromanServer) CorrectCoordinate(city_code string, coord common.Coordinate) common.Coordinate {
+	if s.DisableCoordinateCorrection || s.CityConfigs[city_code].DisableCoordinateCorrection {
+		return coord
+	}
+
+	// Keep as-is if Taipei, Macao, or Hong Kong
+	if city_code == "tb" || city_code == "am" || city_code == "hk" {
+		return coord
+	}
+
+	// Stations without coordinates are (0,0), correcting would hide that they are missing
+	if coord.Lat == 0 && coord.Lng == 0 {
+		return coord
+	}
+
+	return s.ChinaHandler.GCJ02ToWGS84(coord)
+}
+
+// Attempts at a city zip download cut short by a dropped connection
+const CITY_ZIP_DOWNLOAD_ATTEMPTS = 3
+
+// Download a city zip (without headers), returning the HTTP status alongside the body.
+// Truncated downloads are retried, otherwise zip.NewReader fails on them with a cryptic error
+func DownloadCityZip(code string, zip_date string) ([]byte, int, error) {
+	url := fmt.Sprintf("https://metroman.oss-cn-hangzhou.aliyuncs.com/app/metromanandroid/v202005/%s/%s.zip", code, zip_date)
+
+	var truncated_err error
+	for attempt := 1; attempt <= CITY_ZIP_DOWNLOAD_ATTEMPTS; attempt++ {
+		zip, status_code, err := downloadCityZipOnce(url)
+		if err == nil {
+			return zip, status_code, nil
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, err
+		}
+
+		truncated_err = err
+		log.Printf("%s: zip download truncated (attempt %d of %d): %v", code, attempt, CITY_ZIP_DOWNLOAD_ATTEMPTS, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	return nil, 0, fmt.Errorf("could not download complete zip for %s: %w", code, truncated_err)
+}
+
+// Truncation is reported as io.ErrUnexpectedEOF
+func downloadCityZipOnce(url string) ([]byte, int, error) {
+	zip_resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zip_resp.Body.Close()
+
+	zip, err := io.ReadAll(zip_resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// net/http already fails a body shorter than Content-Length, compare anyway so a short read can never reach zip.NewReader
+	if zip_resp.StatusCode == http.StatusOK && zip_resp.ContentLength >= 0 && int64(len(zip)) != zip_resp.ContentLength {
+		return nil, 0, fmt.Errorf("got %d of %d bytes: %w", len(zip), zip_resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	return zip, zip_resp.StatusCode, nil
+}
+
+// Load an already extracted city, dir holds the zip_prefix folder like the zip does
+func (s *MetromanServer) LoadCityFromDir(code string, zip_prefix string, dir string) error {
+	return s.LoadCityFromFS(code, zip_prefix, os.DirFS(dir))
+}
+
+// Load a city from any file system laid out like the MetroMan zip, such as an fstest.MapFS
+func (s *MetromanServer) LoadCityFromFS(code string, zip_prefix string, fsys fs.FS) error {
+	city, err := s.ParseCity(fsys, zip_prefix, code)
+	if err != nil {
+		return err
+	}
+
+	s.Cities[code] = city
+
+	return nil
+}
+
+func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, city_code string) (*MetromanCity, error) {
+	// Step 1: Create a new zip reader from the []byte data
+	payload_reader, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return nil, fmt.Errorf("could not open zip reader: %v", err)
+	}
+
+	return s.ParseCity(payload_reader, zip_prefix, city_code)
+}
+
+// Parse a city from any file system, zip.Reader is one
+func (s *MetromanServer) ParseCity(payload_reader fs.FS, zip_prefix string, city_code string) (*MetromanCity, error) {
+	return s.parseCity(payload_reader, zip_prefix, city_code, false)
+}
+
+// Same as ParseCity, but with metadata_only the per-route timetables are not read
+func (s *MetromanServer) parseCity(payload_reader fs.FS, zip_prefix string, city_code string, metadata_only bool) (*MetromanCity, error) {
+	lines := []*MetromanLine{}
+	routes := []*MetromanRoute{}
+	stations := []*MetromanStation{}
+	stations_by_name := make(map[string][]*MetromanStation)
+	stations_by_code := make(map[string]*MetromanStation)
+	lines_by_code := make(map[string]*MetromanLine)
+	routes_by_code := make(map[string]*MetromanRoute)
+	fare_matrices := []*[][]int{}
+	fare_matrix_stations := [][]*MetromanStation{}
+	holidays := []MetromanDate{}
+
+	// Read in stations/lines first from uno.csv
+	uno_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/uno.csv", zip_prefix))
+	if err != nil {
+		return nil, fmt.Errorf("could not open uno.csv: %v", err)
+	}
+
+	// Read through the CSV
+	uno_csv_lines := SplitLines(uno_csv_contents)
+
+	station_index := 0
+	// Only metro and walking records are understood, anything else (like bus or tram lines unless
+	// IncludeBusAndTram) is counted and skipped
+	unknown_record_types := map[string]int{}
+	// Their rows in line.csv, way.csv and wayschedule.csv are skipped too
+	skipped_codes := map[string]bool{}
+	uno_record_columns := map[string]int{"MS": 12, "ML": 13, "WL": 13, "MW": 6, "WW": 6, "BL": 13, "TL": 13, "BW": 6, "TW": 6}
+	line_record_types := []string{"ML", "WL"}
+	route_record_types := []string{"MW", "WW"}
+	if s.IncludeBusAndTram {
+		line_record_types = append(line_record_types, "BL", "TL")
+		route_record_types = append(route_record_types, "BW", "TW")
+	}
+	for uno_record_line_idx, uno_record_line := range uno_csv_lines {
+		uno_record := strings.Split(uno_record_line, "<,>")
+		if err := requireColumns("uno.csv", uno_record_line_idx, uno_record, 2); err != nil {
+			return nil, err
+		}
+		if err := requireColumns("uno.csv", uno_record_line_idx, uno_record, uno_record_columns[uno_record[1]]); err != nil {
+			return nil, err
+		}
+
+		if uno_record[1] != "MS" && !slices.Contains(line_record_types, uno_record[1]) && !slices.Contains(route_record_types, uno_record[1]) {
+			unknown_record_types[uno_record[1]]++
+			skipped_codes[uno_record[0]] = true
+		}
+
+		if uno_record[1] == "MS" {
+			lat_raw, _ := strconv.ParseFloat(uno_record[8], 64)
+			lng_raw, _ := strconv.ParseFloat(uno_record[9], 64)
+			subway_map_x, _ := strconv.ParseInt(uno_record[10], 10, 0)
+			subway_map_y, _ := strconv.ParseInt(uno_record[11], 10, 0)
+
+			corrected_coord := s.CorrectCoordinate(city_code, common.Coordinate{
+				Lat: lat_raw,
+				Lng: lng_raw,
+			})
+
+			station := MetromanStation{
 				Code:             uno_record[0],
 				Index:            station_index,
 				EnglishName:      uno_record[2],
@@ -272,19 +1053,30 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 				ShortName:        uno_record[7],
 				Lat:              corrected_coord.Lat,
 				Lng:              corrected_coord.Lng,
+				RawLat:           lat_raw,
+				RawLng:           lng_raw,
 				SubwayMapX:       int(subway_map_x),
 				SubwayMapY:       int(subway_map_y),
 			}
 
+			// Codes should be unique, namespace any duplicate by its index so it still gets a distinct stop_id.
+			// Lookups by the original code (fares, paths) keep resolving to the first station
+			if _, duplicate := stations_by_code[station.Code]; duplicate {
+				namespaced_code := fmt.Sprintf("%s_%d", station.Code, station.Index)
+				log.Printf("%s: duplicate station code %s (%s), renamed to %s", city_code, station.Code, station.SimplifiedName, namespaced_code)
+				station.Code = namespaced_code
+			}
+
 			stations = append(stations, &station)
-			stations_by_name[station.SimplifiedName] = &station
+			station_key := StationKey(s.StationKeyStrategy, &station)
+			stations_by_name[station_key] = append(stations_by_name[station_key], &station)
 			stations_by_code[station.Code] = &station
 
 			station_index++
 		}
 
-		// ML is a metro line, WL is a walking line
-		if uno_record[1] == "ML" || uno_record[1] == "WL" {
+		// ML is a metro line, WL is a walking line, BL and TL are bus and tram lines
+		if slices.Contains(line_record_types, uno_record[1]) {
 			line := MetromanLine{
 				Code:            uno_record[0],
 				EnglishName:     uno_record[2],
@@ -293,22 +1085,30 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 				JapaneseName:    uno_record[5],
 				ShortName:       uno_record[7],
 				Color:           uno_record[12],
+				Walking:         uno_record[1] == "WL",
+				RouteType:       uno_line_route_types[uno_record[1]],
 				Stations:        []*MetromanStation{},
 				StationPaths:    map[string][]common.Coordinate{},
 			}
 
+			if operator, ok := s.LineOperators[line.Code]; ok {
+				line.Operator = &operator
+			}
+
 			lines = append(lines, &line)
 			lines_by_code[line.Code] = &line
 		}
 
-		// Metro route and miscellaneous routes (used to specify 2 distinct stations that are connected, hence free to travel between)
-		if uno_record[1] == "MW" || uno_record[1] == "WW" {
+		// Metro route and miscellaneous routes (used to specify 2 distinct stations that are connected, hence free to travel between).
+		// BW and TW are bus and tram routes
+		if slices.Contains(route_record_types, uno_record[1]) {
 			route := MetromanRoute{
 				Code:            uno_record[0],
 				EnglishName:     uno_record[2],
 				SimplifiedName:  uno_record[3],
 				TraditionalName: uno_record[4],
 				JapaneseName:    uno_record[5],
+				Walking:         uno_record[1] == "WW",
 			}
 
 			routes = append(routes, &route)
@@ -317,40 +1117,65 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 	}
 
 	// Read in stations in line from line.csv
-	line_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/line.csv", zip_prefix))
+	line_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/line.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open line.csv: %v", err)
 	}
 
 	// Read through the CSV
-	line_csv_lines := strings.Split(string(line_csv_contents), "\r\n")
+	line_csv_lines := SplitLines(line_csv_contents)
 
-	// Add every station on the line to its list
+	// Add every station on the line to its list. Corrupt data shows up as lines or
+	// station indices uno.csv never defined, skip those rather than panic
+	line_warnings := []string{}
 	for _, line_record_line := range line_csv_lines {
 		line_record := strings.Split(line_record_line, ",")
+		if skipped_codes[line_record[0]] {
+			continue
+		}
+
+		line, exists := lines_by_code[line_record[0]]
+		if !exists {
+			line_warnings = append(line_warnings, fmt.Sprintf("line.csv references line %s not in uno.csv", line_record[0]))
+			continue
+		}
 
-		line := lines_by_code[line_record[0]]
 		for _, station_idx_str := range line_record[1:] {
-			station_idx, _ := strconv.ParseInt(station_idx_str, 10, 0)
+			station_idx, err := strconv.ParseInt(station_idx_str, 10, 0)
+			if err != nil || station_idx < 0 || int(station_idx) >= len(stations) {
+				line_warnings = append(line_warnings, fmt.Sprintf(
+					"line %s references station index %s but uno.csv defines %d stations", line.Code, station_idx_str, len(stations)))
+				continue
+			}
 			line.Stations = append(line.Stations, stations[station_idx])
 		}
 	}
+	line_warnings = append(line_warnings, FindLineStationMismatches(lines, len(stations))...)
 
 	// Read in stations in line from way.csv (the "line.csv" of routes)
-	way_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/way.csv", zip_prefix))
+	way_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/way.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open way.csv: %v", err)
 	}
 
 	// Read through the CSV
-	way_csv_lines := strings.Split(string(way_csv_contents), "\r\n")
+	way_csv_lines := SplitLines(way_csv_contents)
 
 	// Add every station on the route to its list
 	within_line_idx := map[string]int{}
-	for _, way_record_line := range way_csv_lines {
+	for way_record_line_idx, way_record_line := range way_csv_lines {
 		way_record := strings.Split(way_record_line, ",")
+		if err := requireColumns("way.csv", way_record_line_idx, way_record, 3); err != nil {
+			return nil, err
+		}
+		if skipped_codes[way_record[0]] {
+			continue
+		}
 
-		route := routes_by_code[way_record[0]]
+		route, exists := routes_by_code[way_record[0]]
+		if !exists {
+			return nil, fmt.Errorf("way.csv line %d references route %s not in uno.csv", way_record_line_idx+1, way_record[0])
+		}
 
 		for _, station_idx_str := range way_record[3:] {
 			station_idx, _ := strconv.ParseInt(station_idx_str, 10, 0)
@@ -379,16 +1204,19 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 	//spew.Dump(lines_by_code["BJMLSD"])
 
 	// Read in stations/lines from fare.csv (and other files pulled in)
-	fare_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/fare.csv", zip_prefix))
+	fare_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/fare.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open fare.csv: %v", err)
 	}
 
 	// Read through the CSV
-	fare_csv_lines := strings.Split(string(fare_csv_contents), "\r\n")
+	fare_csv_lines := SplitLines(fare_csv_contents)
 
-	for _, fare_record_line := range fare_csv_lines {
+	for fare_record_line_idx, fare_record_line := range fare_csv_lines {
 		fare_record := strings.Split(fare_record_line, ",")
+		if err := requireColumns("fare.csv", fare_record_line_idx, fare_record, 5); err != nil {
+			return nil, err
+		}
 
 		// Fares are assigned per route
 		// TODO currently the lines you take do not factor into price
@@ -399,13 +1227,28 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 		stations := []*MetromanStation{}
 		if len(station_codes) == 1 && station_codes[0] == "" {
 			// Get stations from route
-			stations = routes_by_code[strings.Split(fare_record[1], "|")[0]].Stations
+			if route, ok := routes_by_code[strings.Split(fare_record[1], "|")[0]]; ok {
+				stations = route.Stations
+			}
 		} else {
 			for _, station_code := range station_codes {
-				stations = append(stations, stations_by_code[station_code])
+				station, ok := stations_by_code[station_code]
+				if !ok {
+					// Dropping just this station would misalign the matrix, drop the whole entry
+					log.Printf("%s: fare references unknown station %s", city_code, station_code)
+					stations = []*MetromanStation{}
+					break
+				}
+				stations = append(stations, station)
 			}
 		}
 
+		// A matrix over no stations would break indexing later
+		if len(stations) == 0 {
+			log.Printf("%s: skipping fare for routes %s, no known stations", city_code, fare_record[1])
+			continue
+		}
+
 		// Create 2D fare matrix. First index is start, second is end
 		fare_matrix := [][]int{}
 
@@ -435,18 +1278,53 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 		fare_matrix_stations = append(fare_matrix_stations, stations)
 	}
 
+	// Read in exits, most cities have none so the file is optional. Layout is assumed to follow uno.csv:
+	//     station_code<,>exit_code<,>simplified_name<,>simplified_description
+	station_exits_by_code := make(map[string][]*MetromanExit)
+	exit_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/exit.csv", zip_prefix))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not open exit.csv: %v", err)
+	}
+	for exit_record_line_idx, exit_record_line := range SplitLines(exit_csv_contents) {
+		exit_record := strings.Split(exit_record_line, "<,>")
+		if len(exit_record) < 4 {
+			log.Printf("%s: skipped exit.csv line %d with %d columns, expected at least 4", city_code, exit_record_line_idx+1, len(exit_record))
+			continue
+		}
+
+		if _, exists := stations_by_code[exit_record[0]]; !exists {
+			log.Printf("%s: exit %s is for unknown station %s", city_code, exit_record[1], exit_record[0])
+			continue
+		}
+
+		exit := MetromanExit{
+			Code:                  exit_record[1],
+			StationCode:           exit_record[0],
+			SimplifiedName:        exit_record[2],
+			SimplifiedDescription: exit_record[3],
+		}
+		if IsToiletExit(&exit) {
+			continue
+		}
+
+		station_exits_by_code[exit.StationCode] = append(station_exits_by_code[exit.StationCode], &exit)
+	}
+
 	// Read in holidays
-	holiday_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/holiday.csv", zip_prefix))
+	holiday_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/holiday.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open holiday.csv: %v", err)
 	}
 
 	// Read through the CSV
-	holiday_csv_lines := strings.Split(string(holiday_csv_contents), "\r\n")
+	holiday_csv_lines := SplitLines(holiday_csv_contents)
 
 	// Add every station on the route to its list
-	for _, holiday_record_line := range holiday_csv_lines {
-		// Just 1 column
+	for holiday_record_line_idx, holiday_record_line := range holiday_csv_lines {
+		// Just 1 column, YYYYMMDD
+		if len(holiday_record_line) < 8 {
+			return nil, fmt.Errorf("holiday.csv line %d is not a YYYYMMDD date: %q", holiday_record_line_idx+1, holiday_record_line)
+		}
 		year, _ := strconv.ParseInt(holiday_record_line[0:4], 10, 0)
 		month, _ := strconv.ParseInt(holiday_record_line[4:6], 10, 0)
 		day, _ := strconv.ParseInt(holiday_record_line[6:8], 10, 0)
@@ -460,21 +1338,25 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 	schedule_def := make(map[string]*MetromanSchedule)
 
 	// Read in schedule definitions
-	schedule_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/schedule.csv", zip_prefix))
+	schedule_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/schedule.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open schedule.csv: %v", err)
 	}
 
 	// Read through the CSV
-	schedule_csv_lines := strings.Split(string(schedule_csv_contents), "\r\n")
+	schedule_csv_lines := SplitLines(schedule_csv_contents)
+	schedule_delimiter := DetectDelimiter(string(schedule_csv_contents))
 
 	// Add the schedules for each route
-	for _, schedule_record_line := range schedule_csv_lines {
-		schedule_record := strings.Split(schedule_record_line, "<,>")
+	for schedule_record_line_idx, schedule_record_line := range schedule_csv_lines {
+		schedule_record := strings.Split(schedule_record_line, schedule_delimiter)
+		if err := requireColumns("schedule.csv", schedule_record_line_idx, schedule_record, 10); err != nil {
+			return nil, err
+		}
 
 		schedule_bits := [7]int{}
 		for i, bit_str := range schedule_record[1:8] {
-			if bit_str[0] == '1' {
+			if strings.HasPrefix(bit_str, "1") {
 				schedule_bits[i] = 1
 			} else {
 				schedule_bits[i] = 0
@@ -483,7 +1365,7 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 
 		// TODO whether weekdays-friday and friday are included is also specified
 		include_holidays := false
-		if schedule_record[9][0] == '1' {
+		if strings.HasPrefix(schedule_record[9], "1") {
 			include_holidays = true
 		}
 
@@ -495,24 +1377,34 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 	}
 
 	// Read in schedules for routes
-	wayschedule_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/wayschedule.csv", zip_prefix))
+	wayschedule_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/wayschedule.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open wayschedule.csv: %v", err)
 	}
 
 	// Read through the CSV
-	wayschedule_csv_lines := strings.Split(string(wayschedule_csv_contents), "\r\n")
+	wayschedule_csv_lines := SplitLines(wayschedule_csv_contents)
 
 	// Add the schedules for each route
-	for _, wayschedule_record_line := range wayschedule_csv_lines {
+	for wayschedule_record_line_idx, wayschedule_record_line := range wayschedule_csv_lines {
 		wayschedule_record := strings.Split(wayschedule_record_line, ",")
+		if err := requireColumns("wayschedule.csv", wayschedule_record_line_idx, wayschedule_record, 2); err != nil {
+			return nil, err
+		}
+		if skipped_codes[wayschedule_record[0]] {
+			continue
+		}
 
 		schedules := []*MetromanSchedule{}
 		for _, schedule_code := range wayschedule_record[2:] {
 			schedules = append(schedules, schedule_def[schedule_code])
 		}
 
-		routes_by_code[wayschedule_record[0]].Schedules = schedules
+		route, exists := routes_by_code[wayschedule_record[0]]
+		if !exists {
+			return nil, fmt.Errorf("wayschedule.csv line %d references route %s not in uno.csv", wayschedule_record_line_idx+1, wayschedule_record[0])
+		}
+		route.Schedules = schedules
 	}
 
 	// Read in schedules for every route
@@ -521,15 +1413,25 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 		//	spew.Dump(route.Stations)
 		//}
 
+		schedule_csv_path := fmt.Sprintf("%s/%s.csv", zip_prefix, route.Code)
+
+		if metadata_only {
+			// Only note that a timetable exists so the route still counts as transit
+			if _, err := fs.Stat(payload_reader, schedule_csv_path); err == nil {
+				route.TripsSkipped = true
+			}
+			continue
+		}
+
 		// Read in visit times for route
-		schedule_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/%s.csv", zip_prefix, route.Code))
+		schedule_csv_contents, err := common.ReadFileFromFS(payload_reader, schedule_csv_path)
 		if err != nil {
 			// Some files like the walking routes don't exist, just ignore
 			continue
 		}
 
 		// Read through the CSV
-		schedule_csv_lines := strings.Split(string(schedule_csv_contents), "\r\n")
+		schedule_csv_lines := SplitLines(schedule_csv_contents)
 
 		// The format is as thus:
 		//     The numbers will be increasing until a certain point,
@@ -540,8 +1442,8 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 		//     IMPORTANT: Subsequent stations may add their own trips to the route, meaning there are more trips
 		//         than just those starting at the first station
 
-		trips_by_schedule := [][]MetromanTrip{}
-		station_arrivals_departures := [][]map[int]int{}
+		trips_by_schedule := make([][]MetromanTrip, 0, len(route.Schedules))
+		station_arrivals_departures := make([][]map[int]int, 0, len(route.Schedules))
 
 		// Will read file into here then parse
 		// map is arrival_next -> departure
@@ -552,10 +1454,7 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 			last_depart_min := 0
 
 			for schedule_record_line_idx, schedule_record_line := range schedule_csv_lines {
-				schedule_record := strings.Split(schedule_record_line, ",")
-
-				depart_min, _ := strconv.ParseInt(schedule_record[0], 10, 0)
-				arrive_next_min, _ := strconv.ParseInt(schedule_record[1], 10, 0)
+				depart_min, arrive_next_min := parseScheduleRecord(schedule_record_line)
 
 				if int(depart_min) < last_depart_min {
 					if len(schedule_station_arrivals_departures) == len(route.Stations)-1 {
@@ -590,10 +1489,7 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 				schedule_station_arrivals_departures := []map[int]int{}
 
 				for range len(route.Stations) - 1 {
-					schedule_record := strings.Split(schedule_csv_lines[csv_idx], ",")
-
-					depart_min, _ := strconv.ParseInt(schedule_record[0], 10, 0)
-					arrive_next_min, _ := strconv.ParseInt(schedule_record[1], 10, 0)
+					depart_min, arrive_next_min := parseScheduleRecord(schedule_csv_lines[csv_idx])
 
 					// Only one entry per station
 					schedule_station_arrivals_departures = append(schedule_station_arrivals_departures, map[int]int{
@@ -608,87 +1504,12 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 			}
 		}
 
+		// Maps are reused across schedules, see buildTrips
+		arrival_trip_assigned := make(map[int]int)
+		last_arrival_trip_assigned := make(map[int]int)
 		for _, schedule_station_arrivals_departures := range station_arrivals_departures {
-			// Now determine trips from this
-			trips := []MetromanTrip{}
-			arrival_trip_assigned := make(map[int]int)      // Arrival at next station to trip index (the trips array above)
-			last_arrival_trip_assigned := make(map[int]int) // Same as above but for the last station. Will rotate these out and clear current at the end of each station
-
-			// Iterate over stations rather than the schedule itself, will look up schedule instead
-			for station_i := range len(route.Stations) - 1 {
-				// Look up schedule
-				this_arrivals_departures := schedule_station_arrivals_departures[route.StationToScheduleIndex[route.Stations[station_i].Index]]
-
-				// Sweep over trips and note which are blacklisted (they have ended)
-				trip_ended := make(map[int]bool)
-				for trip_idx, trip := range trips {
-					trip_ended[trip_idx] = trip.TripEnded
-				}
-
-				// Now tentatively note them as ended. This flag will be reverted if that is not true
-				for _, trip := range trips {
-					trip.TripEnded = true
-				}
-
-				if station_i == 0 {
-					// We are going to iterate over the map. Not ordered, but doesn't matter too much
-					for arrival_next_min, depart_min := range this_arrivals_departures {
-						// Always creates new trips
-						// We will create two stops here so we can cover the last station should it not be included
-						trips = append(trips, MetromanTrip{
-							TripEnded: false,
-							Visits: []MetromanStationVisit{{
-								Station:                 route.Stations[0],
-								ArrivalAndDepartMinutes: depart_min,
-							}, {
-								Station:                 route.Stations[1],
-								ArrivalAndDepartMinutes: arrival_next_min,
-							}},
-						})
-
-						// Lookup for the next station
-						arrival_trip_assigned[arrival_next_min] = len(trips) - 1
-					}
-				} else {
-					// Rotate trip assigned map and clear current
-					last_arrival_trip_assigned = arrival_trip_assigned
-					arrival_trip_assigned = make(map[int]int)
-
-					for arrival_next_min, depart_min := range this_arrivals_departures {
-						trip_idx, trip_found := last_arrival_trip_assigned[depart_min]
-						if trip_found && !trip_ended[trip_idx] {
-							// Add to existing trip
-							// NOTE we add the next station after this current one, not the current one. It already exists
-							trips[trip_idx].Visits = append(trips[trip_idx].Visits, MetromanStationVisit{
-								Station:                 route.Stations[station_i+1],
-								ArrivalAndDepartMinutes: arrival_next_min,
-							})
-							trips[trip_idx].TripEnded = false
-
-							// Note down the trip index again
-							arrival_trip_assigned[arrival_next_min] = trip_idx
-						} else {
-							// Need to create a new trip
-							trips = append(trips, MetromanTrip{
-								TripEnded: false,
-								Visits: []MetromanStationVisit{{
-									Station:                 route.Stations[station_i],
-									ArrivalAndDepartMinutes: depart_min,
-								}, {
-									Station:                 route.Stations[station_i+1],
-									ArrivalAndDepartMinutes: arrival_next_min,
-								}},
-							})
-
-							// Lookup for the next station
-							arrival_trip_assigned[arrival_next_min] = len(trips) - 1
-							//trip_idx = len(trips) - 1
-						}
-					}
-				}
-			}
-
-			trips_by_schedule = append(trips_by_schedule, trips)
+			trips_by_schedule = append(trips_by_schedule, buildTrips(route,
+				schedule_station_arrivals_departures, arrival_trip_assigned, last_arrival_trip_assigned))
 		}
 
 		// Finally add it
@@ -696,49 +1517,46 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 	}
 
 	// Read in the coords for lines in their entirety
-	path_latlng_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/path_latlng.csv", zip_prefix))
+	path_latlng_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/path_latlng.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open path_latlng.csv: %v", err)
 	}
 
 	// Read through the CSV
-	path_latlng_csv_lines := strings.Split(string(path_latlng_csv_contents), "\r\n")
+	path_latlng_csv_lines := SplitLines(path_latlng_csv_contents)
 
 	all_latlng_coords := []common.Coordinate{}
-	for _, path_latlng_record_line := range path_latlng_csv_lines {
+	for path_latlng_record_line_idx, path_latlng_record_line := range path_latlng_csv_lines {
 		path_latlng_record := strings.Split(path_latlng_record_line, ",")
+		if err := requireColumns("path_latlng.csv", path_latlng_record_line_idx, path_latlng_record, 2); err != nil {
+			return nil, err
+		}
 
 		lat_raw, _ := strconv.ParseFloat(path_latlng_record[0], 64)
 		lng_raw, _ := strconv.ParseFloat(path_latlng_record[1], 64)
 
-		var corrected_coord common.Coordinate
-		// Keep as-is if Taipei, Macao, or Hong Kong
-		if city_code == "tb" || city_code == "am" || city_code == "hk" {
-			corrected_coord = common.Coordinate{
-				Lat: lat_raw,
-				Lng: lng_raw,
-			}
-		} else {
-			corrected_coord = s.ChinaHandler.GCJ02ToWGS84(common.Coordinate{
-				Lat: lat_raw,
-				Lng: lng_raw,
-			})
-		}
+		corrected_coord := s.CorrectCoordinate(city_code, common.Coordinate{
+			Lat: lat_raw,
+			Lng: lng_raw,
+		})
 
 		// Add a new coord
 		all_latlng_coords = append(all_latlng_coords, corrected_coord)
 	}
 
 	// Read in the mappings for line and stations to their indices (inclusive) in the list of coords
-	path_rail_csv_contents, err := common.ReadFileFromZip(payload_reader, fmt.Sprintf("%s/path_rail.csv", zip_prefix))
+	path_rail_csv_contents, err := common.ReadFileFromFS(payload_reader, fmt.Sprintf("%s/path_rail.csv", zip_prefix))
 	if err != nil {
 		return nil, fmt.Errorf("could not open path_rail.csv: %v", err)
 	}
 
 	// Read through the CSV
-	path_rail_csv_lines := strings.Split(string(path_rail_csv_contents), "\r\n")
-	for _, path_rail_record_line := range path_rail_csv_lines {
+	path_rail_csv_lines := SplitLines(path_rail_csv_contents)
+	for path_rail_record_line_idx, path_rail_record_line := range path_rail_csv_lines {
 		path_rail_record := strings.Split(path_rail_record_line, ",")
+		if err := requireColumns("path_rail.csv", path_rail_record_line_idx, path_rail_record, 5); err != nil {
+			return nil, err
+		}
 
 		lower, _ := strconv.ParseInt(path_rail_record[3], 10, 0)
 		upper, _ := strconv.ParseInt(path_rail_record[4], 10, 0)
@@ -755,75 +1573,578 @@ func (s *MetromanServer) LoadCityInternal(zip_prefix string, payload []byte, cit
 		line.StationPaths[path_code] = all_latlng_coords[lower : upper+1]
 	}
 
-	return &MetromanCity{
+	for _, record_type := range slices.Sorted(maps.Keys(unknown_record_types)) {
+		log.Printf("%s: skipped %d uno.csv records of unknown type %s", city_code, unknown_record_types[record_type], record_type)
+	}
+
+	if s.EstimateMissingTrips != nil && !metadata_only {
+		for _, route := range routes {
+			if !route.Walking && len(route.Trips) == 0 && len(route.Schedules) > 0 && len(route.Stations) > 1 {
+				route.Trips = EstimateTrips(route, *s.EstimateMissingTrips)
+				route.EstimatedTrips = true
+				log.Printf("%s: estimated trips for %s, which has no schedule", city_code, route.Code)
+			}
+		}
+	}
+
+	// Surface routes where the MW/WW label disagrees with the data, which needs trips
+	if !metadata_only {
+		for _, mislabel := range FindSuspectedMislabels(routes) {
+			log.Printf("%s: %s", city_code, mislabel)
+		}
+	}
+
+	for _, line_warning := range line_warnings {
+		log.Printf("%s: %s", city_code, line_warning)
+	}
+
+	city := &MetromanCity{
 		Lines:              lines,
 		Routes:             routes,
 		Stations:           stations,
 		StationsByName:     stations_by_name,
+		StationKeyStrategy: s.StationKeyStrategy,
 		StationsByCode:     stations_by_code,
+		StationExitsByCode: station_exits_by_code,
 		FareMatrices:       fare_matrices,
 		FareMatrixStations: fare_matrix_stations,
 		Holidays:           holidays,
 		ScheduleDef:        schedule_def,
-	}, nil
+		LineWarnings:       line_warnings,
+		MetadataOnly:       metadata_only,
+	}
+	city.IndexStations()
+
+	if excluded_lines := s.CityConfigs[city_code].ExcludedLines; len(excluded_lines) > 0 {
+		kept_lines := []string{}
+		for _, line := range city.Lines {
+			if !slices.Contains(excluded_lines, line.Code) {
+				kept_lines = append(kept_lines, line.Code)
+			}
+		}
+		city = city.FilterLines(kept_lines)
+	}
+
+	return city, nil
 }
 
-func (s *MetromanServer) GetRawZip(code string) ([]byte, error) {
-	zip, ok := s.CityZips[code]
-	if !ok {
-		return []byte{}, fmt.Errorf("city with code '%s' has not been loaded", code)
+// Rebuild LinesByStation and RoutesByStation from Lines and Routes
+func (c *MetromanCity) IndexStations() {
+	c.LinesByStation = make(map[string][]*MetromanLine)
+	c.RoutesByStation = make(map[string][]*MetromanRoute)
+
+	for _, line := range c.Lines {
+		for _, station := range line.Stations {
+			if !slices.Contains(c.LinesByStation[station.Code], line) {
+				c.LinesByStation[station.Code] = append(c.LinesByStation[station.Code], line)
+			}
+		}
+	}
+
+	for _, route := range c.Routes {
+		for _, station := range route.Stations {
+			if !slices.Contains(c.RoutesByStation[station.Code], route) {
+				c.RoutesByStation[station.Code] = append(c.RoutesByStation[station.Code], route)
+			}
+		}
 	}
-	return zip, nil
 }
 
-func CSVToMatrixInt(payload_reader *zip.Reader, filename string) ([][]int, error) {
-	matrix_csv_contents, err := common.ReadFileFromZip(payload_reader, filename)
-	if err != nil {
-		return nil, err
+// Lines with the station on them, interchanges have more than one
+func (c *MetromanCity) LinesForStation(station_code string) []*MetromanLine {
+	return c.LinesByStation[station_code]
+}
+
+// Closest station to coord and its distance in meters, nil if no station has coordinates.
+// Used to map coordinates (like OTP legs) back to MetroMan stations
+func (c *MetromanCity) NearestStation(coord common.Coordinate) (*MetromanStation, float64) {
+	var nearest_station *MetromanStation
+	nearest_meters := math.Inf(1)
+
+	for _, station := range c.Stations {
+		// Stations without coordinates would match points near (0,0)
+		if station.Lat == 0 && station.Lng == 0 {
+			continue
+		}
+
+		meters := common.HaversineDistance(coord, common.Coordinate{Lat: station.Lat, Lng: station.Lng})
+		if meters < nearest_meters {
+			nearest_station = station
+			nearest_meters = meters
+		}
 	}
 
-	// Read through the CSV
-	matrix_csv_lines := strings.Split(string(matrix_csv_contents), "\r\n")
-	output_matrix := [][]int{}
-	for _, matrix_record_line := range matrix_csv_lines {
-		matrix_record := strings.Split(matrix_record_line, ",")
+	if nearest_station == nil {
+		return nil, 0
+	}
 
-		output_line := make([]int, len(matrix_record))
-		for i, elem := range matrix_record {
-			elem_64, _ := strconv.ParseInt(elem, 10, 0)
-			output_line[i] = int(elem_64)
+	return nearest_station, nearest_meters
+}
+
+// Corners of the smallest box holding every station with coordinates, false if there are none
+func (c *MetromanCity) BoundingBox() (common.Coordinate, common.Coordinate, bool) {
+	found := false
+	min_corner := common.Coordinate{Lat: math.Inf(1), Lng: math.Inf(1)}
+	max_corner := common.Coordinate{Lat: math.Inf(-1), Lng: math.Inf(-1)}
+
+	for _, station := range c.Stations {
+		if station.Lat == 0 && station.Lng == 0 {
+			continue
 		}
 
-		output_matrix = append(output_matrix, output_line)
+		found = true
+		min_corner.Lat = min(min_corner.Lat, station.Lat)
+		min_corner.Lng = min(min_corner.Lng, station.Lng)
+		max_corner.Lat = max(max_corner.Lat, station.Lat)
+		max_corner.Lng = max(max_corner.Lng, station.Lng)
 	}
 
-	return output_matrix, nil
+	return min_corner, max_corner, found
+}
+
+// Both directions of the line, indexed by direction_id (IdxWithinLine % 2 like trips.txt). Each is named
+// after the last station of the longest route running that way, so short turns share the full line's terminus
+func (c *MetromanCity) LineDirections(line *MetromanLine) [2]MetromanLineDirection {
+	directions := [2]MetromanLineDirection{{DirectionID: 0}, {DirectionID: 1}}
+	longest := [2]int{}
+
+	for _, route := range c.Routes {
+		if route.Line != line || route.Walking || len(route.Stations) <= longest[route.IdxWithinLine%2] {
+			continue
+		}
+
+		direction := &directions[route.IdxWithinLine%2]
+		longest[route.IdxWithinLine%2] = len(route.Stations)
+		direction.Headsign = route.Stations[len(route.Stations)-1].EnglishName
+		direction.Name = fmt.Sprintf("Towards %s", direction.Headsign)
+	}
+
+	return directions
 }
 
-func (s *MetromanServer) GenerateStopsTXT(code string, full bool) (string, error) {
+func (s *MetromanServer) GetLineDirections(code string, line_code string) ([2]MetromanLineDirection, error) {
 	city, exists := s.Cities[code]
 	if !exists {
-		return "", fmt.Errorf("city %v not loaded", code)
+		return [2]MetromanLineDirection{}, fmt.Errorf("city %v not loaded", code)
 	}
 
-	var buf bytes.Buffer
+	line_idx := slices.IndexFunc(city.Lines, func(line *MetromanLine) bool {
+		return line.Code == line_code
+	})
+	if line_idx == -1 {
+		return [2]MetromanLineDirection{}, fmt.Errorf("line %s not found in city %v", line_code, code)
+	}
+
+	return city.LineDirections(city.Lines[line_idx]), nil
+}
+
+// Routes (either direction or branch of a line) stopping at the station
+func (c *MetromanCity) RoutesForStation(station_code string) []*MetromanRoute {
+	return c.RoutesByStation[station_code]
+}
+
+// Metro lines with a station count that can't be right given uno.csv: too few stations
+// to travel anywhere, or more than the city has
+func FindLineStationMismatches(lines []*MetromanLine, station_count int) []string {
+	mismatches := []string{}
+
+	for _, line := range lines {
+		if line.Walking {
+			continue
+		}
+
+		if len(line.Stations) < 2 {
+			mismatches = append(mismatches, fmt.Sprintf(
+				"line %s (%s) has %d stations in line.csv", line.Code, line.EnglishName, len(line.Stations)))
+		} else if len(line.Stations) > station_count {
+			mismatches = append(mismatches, fmt.Sprintf(
+				"line %s (%s) has %d stations in line.csv but uno.csv defines %d", line.Code, line.EnglishName, len(line.Stations), station_count))
+		}
+	}
+
+	return mismatches
+}
+
+func (s *MetromanServer) GetCityStats(code string) (*MetromanCityStats, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+
+	stats := &MetromanCityStats{
+		Stations:     len(city.Stations),
+		Lines:        len(city.Lines),
+		Routes:       len(city.Routes),
+		LineWarnings: city.LineWarnings,
+	}
+
+	for _, route := range city.Routes {
+		// Not IsTransitRoute, that already excludes routes without trips
+		if route.Walking {
+			continue
+		}
+
+		stats.MetroRoutes++
+		if len(route.Trips) == 0 {
+			stats.RoutesWithoutTrips++
+		}
+		if !RouteHasGeometry(route) {
+			stats.RoutesWithoutShapes++
+		}
+	}
+
+	for _, station := range city.Stations {
+		if station.Lat == 0 && station.Lng == 0 {
+			stats.StationsWithoutCoordinates++
+		}
+	}
+
+	return stats, nil
+}
+
+// Codes of loaded cities whose feeds are missing trips, shapes, or coordinates, for data quality triage
+func (s *MetromanServer) IncompleteCities() []string {
+	incomplete_cities := []string{}
+
+	for _, code := range slices.Sorted(maps.Keys(s.Cities)) {
+		stats, err := s.GetCityStats(code)
+		if err != nil || !stats.Complete() {
+			incomplete_cities = append(incomplete_cities, code)
+		}
+	}
+
+	return incomplete_cities
+}
+
+// MetroMan labels routes as either MW (metro) or WW (walking). Metro routes should have trips and geometry
+// while walking routes should have neither, anything else suggests the label is wrong
+func FindSuspectedMislabels(routes []*MetromanRoute) []string {
+	mislabels := []string{}
+
+	for _, route := range routes {
+		has_trips := len(route.Trips) > 0
+		has_geometry := RouteHasGeometry(route)
+
+		if route.Walking && (has_trips || has_geometry) {
+			mislabels = append(mislabels, fmt.Sprintf(
+				"walking route %s may be transit (has trips: %t, has geometry: %t)", route.Code, has_trips, has_geometry))
+		}
+		if !route.Walking && !has_trips {
+			mislabels = append(mislabels, fmt.Sprintf(
+				"metro route %s may be walking (has trips: %t, has geometry: %t)", route.Code, has_trips, has_geometry))
+		}
+	}
+
+	return mislabels
+}
+
+// Parse a "depart,arrive_next" line from a route timetable, both in minutes. Avoids strings.Split as
+// this runs for every line of every timetable
+func parseScheduleRecord(line string) (int, int) {
+	depart, arrive_next, _ := strings.Cut(line, ",")
+	// Ignore any trailing columns
+	arrive_next, _, _ = strings.Cut(arrive_next, ",")
+
+	depart_min, _ := strconv.Atoi(depart)
+	arrive_next_min, _ := strconv.Atoi(arrive_next)
+	return depart_min, arrive_next_min
+}
+
+// Chain the per-station departure/arrival pairs of one schedule into trips. A pair continues a trip
+// when its departure matches the arrival the trip made at this station, otherwise it starts a new one.
+// The two maps are scratch space owned by the caller so they can be reused between schedules
+func buildTrips(route *MetromanRoute, schedule_station_arrivals_departures []map[int]int,
+	arrival_trip_assigned map[int]int, last_arrival_trip_assigned map[int]int) []MetromanTrip {
+	clear(arrival_trip_assigned)
+	clear(last_arrival_trip_assigned)
+
+	// Trips starting at the first station are the majority
+	first_arrivals_departures := schedule_station_arrivals_departures[route.StationToScheduleIndex[route.Stations[0].Index]]
+	trips := make([]MetromanTrip, 0, len(first_arrivals_departures))
+
+	// Iterate over stations rather than the schedule itself, will look up schedule instead
+	for station_i := range len(route.Stations) - 1 {
+		// Look up schedule
+		this_arrivals_departures := schedule_station_arrivals_departures[route.StationToScheduleIndex[route.Stations[station_i].Index]]
+
+		if station_i == 0 {
+			// We are going to iterate over the map. Not ordered, but doesn't matter too much
+			for arrival_next_min, depart_min := range this_arrivals_departures {
+				// Always creates new trips
+				// We will create two stops here so we can cover the last station should it not be included
+				trips = append(trips, MetromanTrip{
+					TripEnded: false,
+					Visits: []MetromanStationVisit{{
+						Station:                 route.Stations[0],
+						ArrivalAndDepartMinutes: depart_min,
+					}, {
+						Station:                 route.Stations[1],
+						ArrivalAndDepartMinutes: arrival_next_min,
+					}},
+				})
+
+				// Lookup for the next station
+				arrival_trip_assigned[arrival_next_min] = len(trips) - 1
+			}
+		} else {
+			// Rotate trip assigned maps and clear current
+			last_arrival_trip_assigned, arrival_trip_assigned = arrival_trip_assigned, last_arrival_trip_assigned
+			clear(arrival_trip_assigned)
+
+			for arrival_next_min, depart_min := range this_arrivals_departures {
+				trip_idx, trip_found := last_arrival_trip_assigned[depart_min]
+				if trip_found && !trips[trip_idx].TripEnded {
+					// Add to existing trip
+					// NOTE we add the next station after this current one, not the current one. It already exists
+					trips[trip_idx].Visits = append(trips[trip_idx].Visits, MetromanStationVisit{
+						Station:                 route.Stations[station_i+1],
+						ArrivalAndDepartMinutes: arrival_next_min,
+					})
+
+					// Note down the trip index again
+					arrival_trip_assigned[arrival_next_min] = trip_idx
+				} else {
+					// Need to create a new trip
+					trips = append(trips, MetromanTrip{
+						TripEnded: false,
+						Visits: []MetromanStationVisit{{
+							Station:                 route.Stations[station_i],
+							ArrivalAndDepartMinutes: depart_min,
+						}, {
+							Station:                 route.Stations[station_i+1],
+							ArrivalAndDepartMinutes: arrival_next_min,
+						}},
+					})
+
+					// Lookup for the next station
+					arrival_trip_assigned[arrival_next_min] = len(trips) - 1
+				}
+			}
+		}
+	}
+
+	return trips
+}
+
+// Routes emitted to routes.txt, trips.txt, shapes.txt and stop_times.txt. Walking routes are
+// excluded even if they have trips so a mislabeled route never half-appears in the feed, as are routes
+// on walking lines
+func IsTransitRoute(route *MetromanRoute) bool {
+	if route.Line != nil && route.Line.Walking {
+		return false
+	}
+	return !route.Walking && (len(route.Trips) > 0 || route.TripsSkipped)
+}
+
+// Whether any consecutive pair of stations in the route has a path in its line, in either direction
+func RouteHasGeometry(route *MetromanRoute) bool {
+	if route.Line == nil {
+		return false
+	}
+
+	for station_idx := range len(route.Stations) - 1 {
+		from_code := route.Stations[station_idx].Code
+		to_code := route.Stations[station_idx+1].Code
+
+		if _, exists := route.Line.StationPaths[fmt.Sprintf("%s_%s", from_code, to_code)]; exists {
+			return true
+		}
+		if _, exists := route.Line.StationPaths[fmt.Sprintf("%s_%s", to_code, from_code)]; exists {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Copy of the server generating from cities instead of the loaded ones, sharing everything else.
+// Copied field by field since the server holds a lock
+func (s *MetromanServer) WithCities(cities map[string]*MetromanCity) *MetromanServer {
+	s.versions_lock.RLock()
+	defer s.versions_lock.RUnlock()
+
+	return &MetromanServer{
+		CityZips:                    s.CityZips,
+		Cities:                      cities,
+		ZipDateLookup:               s.ZipDateLookup,
+		VersionsCachePath:           s.VersionsCachePath,
+		ChinaHandler:                s.ChinaHandler,
+		DisableCoordinateCorrection: s.DisableCoordinateCorrection,
+		StationKeyStrategy:          s.StationKeyStrategy,
+		ServiceHours:                s.ServiceHours,
+		EstimateMissingTrips:        s.EstimateMissingTrips,
+		EntryFees:                   s.EntryFees,
+		MinimumFares:                s.MinimumFares,
+		LineOperators:               s.LineOperators,
+		License:                     s.License,
+		CityConfigs:                 s.CityConfigs,
+		BaiduServer:                 s.BaiduServer,
+	}
+}
+
+// Copy of the city restricted to the given lines, their routes, and the stations those routes visit.
+// Stations keeps every station so indices into it (used by fares) stay valid
+func (c *MetromanCity) FilterLines(line_codes []string) *MetromanCity {
+	filtered := *c
+	filtered.Lines = []*MetromanLine{}
+	filtered.Routes = []*MetromanRoute{}
+	filtered.StationsByName = make(map[string][]*MetromanStation)
+	filtered.StationsByCode = make(map[string]*MetromanStation)
+
+	for _, line := range c.Lines {
+		if slices.Contains(line_codes, line.Code) {
+			filtered.Lines = append(filtered.Lines, line)
+		}
+	}
+
+	for _, route := range c.Routes {
+		if route.Line != nil && slices.Contains(line_codes, route.Line.Code) {
+			filtered.Routes = append(filtered.Routes, route)
+
+			for _, station := range route.Stations {
+				station_key := StationKey(c.StationKeyStrategy, station)
+				if !slices.Contains(filtered.StationsByName[station_key], station) {
+					filtered.StationsByName[station_key] = append(filtered.StationsByName[station_key], station)
+				}
+				filtered.StationsByCode[station.Code] = station
+			}
+		}
+	}
+
+	filtered.IndexStations()
+
+	return &filtered
+}
+
+func (s *MetromanServer) GetRawZip(code string) ([]byte, error) {
+	zip, ok := s.CityZips[code]
+	if !ok {
+		return []byte{}, fmt.Errorf("city with code '%s' has not been loaded", code)
+	}
+	return zip, nil
+}
+
+func CSVToMatrixInt(payload_reader fs.FS, filename string) ([][]int, error) {
+	matrix_csv_contents, err := common.ReadFileFromFS(payload_reader, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read through the CSV
+	matrix_csv_lines := SplitLines(matrix_csv_contents)
+	output_matrix := [][]int{}
+	for _, matrix_record_line := range matrix_csv_lines {
+		matrix_record := strings.Split(matrix_record_line, ",")
+
+		output_line := make([]int, len(matrix_record))
+		for i, elem := range matrix_record {
+			elem_64, _ := strconv.ParseInt(elem, 10, 0)
+			output_line[i] = int(elem_64)
+		}
+
+		output_matrix = append(output_matrix, output_line)
+	}
+
+	return output_matrix, nil
+}
+
+// Station code to the code of the stop representing it, which is itself unless opts.CollapseStations
+// merges stations sharing a simplified name into the one with the lowest code. Stations without a
+// stop (see opts.IncludeUnservedStations and opts.IncludeZeroCoordinateStations) are missing
+func StopStationCodes(city *MetromanCity, opts GenerateOptions) map[string]string {
+	stop_station_codes := make(map[string]string, len(city.StationsByCode))
+	representatives := map[string]string{}
+
+	for _, station_code := range slices.Sorted(maps.Keys(city.StationsByCode)) {
+		station := city.StationsByCode[station_code]
+		if !opts.IncludeUnservedStations && !slices.ContainsFunc(city.RoutesForStation(station_code), IsTransitRoute) {
+			if opts.Report != nil {
+				opts.Report.Add(GENERATION_EVENT_STOP_OMITTED, station_code, "stop %s: not served by any route", station_code)
+			}
+			continue
+		}
+		if !opts.IncludeZeroCoordinateStations && station.Lat == 0 && station.Lng == 0 {
+			if opts.Report != nil {
+				opts.Report.Add(GENERATION_EVENT_STOP_OMITTED, station_code, "stop %s: no coordinates", station_code)
+			}
+			continue
+		}
+
+		if !opts.CollapseStations {
+			stop_station_codes[station_code] = station_code
+			continue
+		}
+
+		if _, exists := representatives[station.SimplifiedName]; !exists {
+			representatives[station.SimplifiedName] = station_code
+		}
+		stop_station_codes[station_code] = representatives[station.SimplifiedName]
+	}
+
+	return stop_station_codes
+}
+
+func (s *MetromanServer) GenerateStopsTXT(code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", code)
+	}
+
+	if opts.FullBaiduLookups && s.BaiduServer == nil {
+		return "", fmt.Errorf("full stops.txt for %v requires a Baidu server", code)
+	}
+
+	var buf bytes.Buffer
 	csv_writer := csv.NewWriter(&buf)
 
 	// Header
-	if err := csv_writer.Write([]string{
+	header := []string{
 		"stop_id", "stop_code", "stop_name", "tts_stop_name", "stop_desc",
 		"stop_lat", "stop_lon", "zone_id", "stop_url", "location_type",
 		"parent_station", "stop_timezone", "wheelchair_boarding",
 		"level_id", "platform_code", "stop_access",
-	}); err != nil {
+	}
+	if opts.IncludeMetromanCodes {
+		// Extension column, consumers ignore columns not in the GTFS spec
+		header = append(header, "metroman_code")
+	}
+	if err := csv_writer.Write(header); err != nil {
 		return "", err
 	}
 
-	for station_code, station := range city.StationsByCode {
+	stop_station_codes := StopStationCodes(city, opts)
+	stop_exits := StopExits(city, stop_station_codes)
+
+	// Sorted so stops.txt is byte-identical between runs, the float sums below included
+	station_codes := slices.Sorted(maps.Keys(city.StationsByCode))
+
+	// Average the coordinates of every station a stop represents
+	stop_coords := map[string][]common.Coordinate{}
+	for _, station_code := range station_codes {
+		station := city.StationsByCode[station_code]
+		stop_code, exists := stop_station_codes[station_code]
+		if !exists {
+			continue
+		}
+		stop_coords[stop_code] = append(stop_coords[stop_code], common.Coordinate{Lat: station.Lat, Lng: station.Lng})
+	}
+
+	for _, station_code := range station_codes {
+		station := city.StationsByCode[station_code]
+		if stop_station_codes[station_code] != station_code {
+			continue
+		}
+
+		lat, lng := 0.0, 0.0
+		for _, coord := range stop_coords[station_code] {
+			lat += coord.Lat / float64(len(stop_coords[station_code]))
+			lng += coord.Lng / float64(len(stop_coords[station_code]))
+		}
+
 		url := ""
 		use_autocomplete_fallback := false
 
-		if full {
+		if opts.FullBaiduLookups {
 			autocomplete, err := s.BaiduServer.GetAutocomplete(code, station.SimplifiedName)
 			if err != nil {
 				use_autocomplete_fallback = true
@@ -848,31 +2169,85 @@ func (s *MetromanServer) GenerateStopsTXT(code string, full bool) (string, error
 			}
 
 			station_uid, found := baidu_client.GetAutocompleteTypeStation(autocomplete_typing)
-			if !found {
+			if !found && opts.Report != nil {
+				opts.Report.Add(GENERATION_EVENT_STOP_UNRESOLVED, station_code,
+					"stop %s: could not get station from either autocomplete approach for \"%s\"", station_code, station.SimplifiedName)
+			} else if !found {
 				return "", fmt.Errorf("could not get station from either autocomplete approach for \"%s\"", station.SimplifiedName)
 			} else {
 				url = fmt.Sprintf(
 					"https://map.baidu.com/poi//@0,0?uid=%s&info_merge=1&isBizPoi=false&ugc_type=3&ugc_ver=1&device_ratio=2&compat=1&pcevaname=pc4.1&querytype=detailConInfo&da_src=shareurl", station_uid)
+				if opts.Report != nil {
+					opts.Report.Add(GENERATION_EVENT_BAIDU_FALLBACK, station_code,
+						"stop %s: stop_url from typing autocomplete heuristic for \"%s\"", station_code, station.SimplifiedName)
+				}
+			}
+		}
+
+		// Entrances need a station to belong to, the stop becomes its platform
+		parent_station := ""
+		if exits := stop_exits[station_code]; len(exits) > 0 {
+			parent_station = opts.ID(StationParentID(station_code))
+
+			station_record := []string{
+				parent_station, StopCode(code, station.Code), station.EnglishName, "", "",
+				opts.FormatCoordinate(lat), opts.FormatCoordinate(lng), "", url,
+				"1", // location_type
+				"", s.CityTimezone(code), "0", "", "", "",
+			}
+			if opts.IncludeMetromanCodes {
+				station_record = append(station_record, station_code)
+			}
+			if err := csv_writer.Write(station_record); err != nil {
+				return "", err
+			}
+
+			for _, exit := range exits {
+				// MetroMan has no exit coordinates, use the station's
+				exit_record := []string{
+					opts.ID(ExitStopID(exit)), "", exit.SimplifiedName, "", exit.SimplifiedDescription,
+					opts.FormatCoordinate(lat), opts.FormatCoordinate(lng), "", "",
+					"2", // location_type
+					parent_station, "", "0", "", "", "",
+				}
+				if opts.IncludeMetromanCodes {
+					exit_record = append(exit_record, exit.Code)
+				}
+				if err := csv_writer.Write(exit_record); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		stop_desc := ""
+		if opts.FullBaiduLookups && opts.NearbyFacilities {
+			facilities_desc, err := s.NearbyFacilitiesDesc(code, station)
+			if err != nil {
+				return "", err
 			}
+			stop_desc = facilities_desc
 		}
 
 		record := []string{
-			station_code,           // stop_id (potentially internal to MetroMan)
-			station.SimplifiedName, // stop_code (potentially not true for cities other than Beijing)
-			station.EnglishName,    // stop_name
-			"",                     // tts_stop_name
-			"",                     // stop_desc
-			fmt.Sprintf("%f", station.Lat),
-			fmt.Sprintf("%f", station.Lng),
-			fmt.Sprintf("zone_%s", station_code), // Peculiarity of GTFS: fares cannot be specified by distance, this must be done instead
+			opts.ID(station_code),        // stop_id (potentially internal to MetroMan)
+			StopCode(code, station.Code), // stop_code
+			station.EnglishName,          // stop_name (other languages are in translations.txt)
+			"",                           // tts_stop_name
+			stop_desc,                    // stop_desc
+			opts.FormatCoordinate(lat),
+			opts.FormatCoordinate(lng),
+			opts.ID(fmt.Sprintf("zone_%s", station_code)), // Peculiarity of GTFS: fares cannot be specified by distance, this must be done instead
 			url,
-			"0",             // location_type
-			"",              // parent_station
-			"Asia/Shanghai", // stop_timezone
-			"0",             // wheelchair_boarding
-			"",              // level_id
-			"",              // platform_code
-			"",              // stop_access
+			"0",                  // location_type
+			parent_station,       // parent_station
+			s.CityTimezone(code), // stop_timezone
+			"0",                  // wheelchair_boarding
+			"",                   // level_id
+			"",                   // platform_code
+			"",                   // stop_access
+		}
+		if opts.IncludeMetromanCodes {
+			record = append(record, station_code)
 		}
 
 		if err := csv_writer.Write(record); err != nil {
@@ -888,261 +2263,1636 @@ func (s *MetromanServer) GenerateStopsTXT(code string, full bool) (string, error
 	return buf.String(), nil
 }
 
-func (s *MetromanServer) GenerateFaresTXT(code string, full bool) (string, string, error) {
-	city, exists := s.Cities[code]
-	if !exists {
-		return "", "", fmt.Errorf("city %v not loaded", code)
+// Baidu search keywords for facilities near stations, with how they are labelled in stop_desc
+var nearby_facility_keywords = [][2]string{
+	{"Parking", "停车场"},
+	{"Bike share", "共享单车"},
+}
+
+// Nearby parking and bike share from Baidu autocomplete, like "Parking: A, B; Bike share: C". Empty if there are none
+func (s *MetromanServer) NearbyFacilitiesDesc(code string, station *MetromanStation) (string, error) {
+	descs := []string{}
+
+	for _, facility := range nearby_facility_keywords {
+		autocomplete, err := s.BaiduServer.GetAutocomplete(code, fmt.Sprintf("%s站%s", station.SimplifiedName, facility[1]))
+		if err != nil {
+			return "", fmt.Errorf("could not get nearby %s from baidu for \"%s\": %v", facility[1], station.SimplifiedName, err)
+		}
+
+		if names := baidu_client.GetAutocompleteFacilities(autocomplete, facility[1], 3); len(names) > 0 {
+			descs = append(descs, fmt.Sprintf("%s: %s", facility[0], strings.Join(names, ", ")))
+		}
 	}
 
-	// You pay 3 generally if you enter and exit the subway: https://www.reddit.com/r/shanghai/comments/18lrq74/enter_exit_same_metro_station_what_happens/
+	return strings.Join(descs, "; "), nil
+}
 
-	// Will be using GTFS fares v1 and generating every station to station pair in one direction
-	// TODO only do one direction optimization if the fare matrix is mirrored, for now assuming it
+// Exits of every station a stop represents, keyed by stop station code like StopStationCodes
+func StopExits(city *MetromanCity, stop_station_codes map[string]string) map[string][]*MetromanExit {
+	stop_exits := map[string][]*MetromanExit{}
 
-	var rules_buf bytes.Buffer
-	var attrs_buf bytes.Buffer
-	rules_writer := csv.NewWriter(&rules_buf)
-	attrs_writer := csv.NewWriter(&attrs_buf)
+	for _, station_code := range slices.Sorted(maps.Keys(city.StationExitsByCode)) {
+		stop_code, exists := stop_station_codes[station_code]
+		if !exists {
+			continue
+		}
+		stop_exits[stop_code] = append(stop_exits[stop_code], city.StationExitsByCode[station_code]...)
+	}
 
-	// fare_rules.txt header
-	if err := rules_writer.Write([]string{
-		"fare_id", "route_id", "origin_id", "destination_id", "contains_id",
-	}); err != nil {
-		return "", "", err
+	return stop_exits
+}
+
+// Toilets are listed alongside exits but are not a way out of the station
+func IsToiletExit(exit *MetromanExit) bool {
+	for _, toilet := range []string{"卫生间", "洗手间", "厕所"} {
+		if strings.Contains(exit.SimplifiedName, toilet) {
+			return true
+		}
 	}
+	return false
+}
 
-	// fare_attributes.txt header
-	if err := attrs_writer.Write([]string{
-		"fare_id", "price", "currency_type", "payment_method", "transfers", "agency_id", "transfer_duration",
+// location_type 1 station grouping a stop and its entrances
+func StationParentID(station_code string) string {
+	return fmt.Sprintf("station_%s", station_code)
+}
+
+func ExitStopID(exit *MetromanExit) string {
+	return fmt.Sprintf("exit_%s_%s", exit.StationCode, exit.Code)
+}
+
+// Walkways between each entrance and its station's platform, in both directions as MetroMan only
+// knows that an exit exists. Empty apart from the header when the city has no exits
+func (s *MetromanServer) GeneratePathwaysTXT(city_code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"pathway_id", "from_stop_id", "to_stop_id", "pathway_mode", "is_bidirectional",
 	}); err != nil {
-		return "", "", err
+		return "", err
 	}
 
-	for i, fare_matrix_stations := range city.FareMatrixStations {
-		for x, start_station := range fare_matrix_stations {
-			for y, end_station := range fare_matrix_stations {
-				// I am allowing ALL station pairs so transit apps don't choke
-				// if end_station.Index >= start_station.Index
+	stop_exits := StopExits(city, StopStationCodes(city, opts))
+	for _, stop_code := range slices.Sorted(maps.Keys(stop_exits)) {
+		for _, exit := range stop_exits[stop_code] {
+			if err := csv_writer.Write([]string{
+				opts.ID(fmt.Sprintf("pathway_%s", ExitStopID(exit))),
+				opts.ID(ExitStopID(exit)),
+				opts.ID(stop_code),
+				"1", // Walkway
+				"1", // Bidirectional
+			}); err != nil {
+				return "", err
+			}
+		}
+	}
 
-				fare_id := fmt.Sprintf("fare_%s_%s",
-					city.Stations[start_station.Index].Code,
-					city.Stations[end_station.Index].Code,
-				)
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
 
-				// rules
-				if err := rules_writer.Write([]string{
-					fare_id,
-					"", // route_id
-					fmt.Sprintf("zone_%s", city.Stations[start_station.Index].Code),
-					fmt.Sprintf("zone_%s", city.Stations[end_station.Index].Code),
-					"", // contains_id
-				}); err != nil {
-					return "", "", err
+	return buf.String(), nil
+}
+
+// MetroMan station codes are stable between versions but prefixed with the city and
+// record type (like "BJMS"), strip that so riders get a short code. Other codes are kept whole
+func StopCode(city_code string, station_code string) string {
+	prefix := strings.ToUpper(city_code) + "MS"
+	if short_code, found := strings.CutPrefix(station_code, prefix); found && short_code != "" {
+		return short_code
+	}
+	return station_code
+}
+
+// Station names in every language MetroMan provides, keyed to stops.txt stop_name
+func (s *MetromanServer) GenerateTranslationsTXT(code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"table_name", "field_name", "language", "translation", "record_id",
+	}); err != nil {
+		return "", err
+	}
+
+	stop_station_codes := StopStationCodes(city, opts)
+
+	// Same stations as stops.txt, sorted so output is stable
+	for _, station_code := range slices.Sorted(maps.Keys(city.StationsByCode)) {
+		station := city.StationsByCode[station_code]
+		if stop_station_codes[station_code] != station_code {
+			continue
+		}
+
+		for _, translation := range [][2]string{
+			{"zh-Hans", station.SimplifiedName},
+			{"zh-Hant", station.TraditionalName},
+			{"ja", station.JapaneseName},
+			{"en", station.EnglishName},
+		} {
+			if translation[1] == "" {
+				continue
+			}
+
+			if err := csv_writer.Write([]string{
+				"stops",
+				"stop_name",
+				translation[0],
+				translation[1],
+				opts.ID(station.Code),
+			}); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (s *MetromanServer) GenerateFaresTXT(code string, opts GenerateOptions) (string, string, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return "", "", fmt.Errorf("city %v not loaded", code)
+	}
+
+	// You pay 3 generally if you enter and exit the subway: https://www.reddit.com/r/shanghai/comments/18lrq74/enter_exit_same_metro_station_what_happens/
+
+	// Will be using GTFS fares v1 and generating every station to station pair in one direction
+	// TODO only do one direction optimization if the fare matrix is mirrored, for now assuming it
+
+	var rules_buf bytes.Buffer
+	var attrs_buf bytes.Buffer
+	rules_writer := csv.NewWriter(&rules_buf)
+	attrs_writer := csv.NewWriter(&attrs_buf)
+
+	// fare_rules.txt header
+	if err := rules_writer.Write([]string{
+		"fare_id", "route_id", "origin_id", "destination_id", "contains_id",
+	}); err != nil {
+		return "", "", err
+	}
+
+	// fare_attributes.txt header
+	if err := attrs_writer.Write([]string{
+		"fare_id", "price", "currency_type", "payment_method", "transfers", "agency_id", "transfer_duration",
+	}); err != nil {
+		return "", "", err
+	}
+
+	// A fare without rules applies to every journey, so a flat fare needs no station pairs
+	if fare_mode, fixed_price := s.GetFareMode(code); fare_mode == FARE_MODE_FIXED {
+		if err := attrs_writer.Write([]string{
+			opts.ID("fare_flat"),
+			fmt.Sprintf("%d", max(fixed_price, s.MinimumFare(code))),
+			s.CityCurrency(code),
+			"1", // payment_method
+			opts.FareTransfers(),
+			opts.AgencyID(code),
+			"", // transfer_duration
+		}); err != nil {
+			return "", "", err
+		}
+
+		rules_writer.Flush()
+		attrs_writer.Flush()
+
+		if err := rules_writer.Error(); err != nil {
+			return "", "", err
+		}
+		if err := attrs_writer.Error(); err != nil {
+			return "", "", err
+		}
+
+		return rules_buf.String(), attrs_buf.String(), nil
+	}
+
+	// Zones belong to stops, collapsed stations share one so only the first fare between two stops is kept
+	stop_station_codes := StopStationCodes(city, opts)
+	written_fares := map[string]bool{}
+
+	for i, fare_matrix_stations := range city.FareMatrixStations {
+		for x, start_station := range fare_matrix_stations {
+			for y, end_station := range fare_matrix_stations {
+				// I am allowing ALL station pairs so transit apps don't choke
+				// if end_station.Index >= start_station.Index
+
+				start_code, start_exists := stop_station_codes[city.Stations[start_station.Index].Code]
+				end_code, end_exists := stop_station_codes[city.Stations[end_station.Index].Code]
+				if !start_exists || !end_exists {
+					continue
+				}
+
+				fare_id := opts.ID(fmt.Sprintf("fare_%s_%s", start_code, end_code))
+				if written_fares[fare_id] {
+					continue
+				}
+
+				// Matrices smaller than their station list or with negative prices are corrupt
+				fare_matrix := *city.FareMatrices[i]
+				if x >= len(fare_matrix) || y >= len(fare_matrix[x]) || fare_matrix[x][y] < 0 {
+					if opts.Report == nil {
+						return "", "", fmt.Errorf("no valid fare in matrix %d from %s to %s", i, start_code, end_code)
+					}
+					opts.Report.Add(GENERATION_EVENT_FARE_INVALID, fare_id,
+						"%s: no valid fare in matrix %d from %s to %s", fare_id, i, start_code, end_code)
+					continue
+				}
+				written_fares[fare_id] = true
+
+				// rules
+				if err := rules_writer.Write([]string{
+					fare_id,
+					"", // route_id
+					opts.ID(fmt.Sprintf("zone_%s", start_code)),
+					opts.ID(fmt.Sprintf("zone_%s", end_code)),
+					"", // contains_id
+				}); err != nil {
+					return "", "", err
+				}
+
+				// attributes
+				if err := attrs_writer.Write([]string{
+					fare_id,
+					fmt.Sprintf("%d", s.DistanceFare(code, fare_matrix[x][y])),
+					s.CityCurrency(code),
+					"1", // payment_method
+					opts.FareTransfers(),
+					opts.AgencyID(code),
+					"", // transfer_duration
+				}); err != nil {
+					return "", "", err
+				}
+			}
+		}
+	}
+
+	rules_writer.Flush()
+	attrs_writer.Flush()
+
+	if err := rules_writer.Error(); err != nil {
+		return "", "", err
+	}
+	if err := attrs_writer.Error(); err != nil {
+		return "", "", err
+	}
+
+	return rules_buf.String(), attrs_buf.String(), nil
+}
+
+// Price charged for a distance fare from the matrix, after the city's entry fee and minimum fare
+func (s *MetromanServer) DistanceFare(code string, matrix_price int) int {
+	return max(matrix_price+s.EntryFee(code), s.MinimumFare(code))
+}
+
+// Cities are fixed fare when every matrix holds a single price, unless Baidu marks them as
+// distance-based (cxfDis). The fixed price is returned alongside FARE_MODE_FIXED
+func (s *MetromanServer) GetFareMode(code string) (FareMode, int) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return FARE_MODE_DISTANCE, 0
+	}
+
+	if s.BaiduServer != nil {
+		if cross_distance, ok := s.BaiduServer.GetCityCrossDistance(code); ok && cross_distance > 0 {
+			return FARE_MODE_DISTANCE, 0
+		}
+	}
+
+	fixed_price := -1
+	for _, fare_matrix := range city.FareMatrices {
+		for _, row := range *fare_matrix {
+			for _, price := range row {
+				if fixed_price != -1 && price != fixed_price {
+					return FARE_MODE_DISTANCE, 0
+				}
+				fixed_price = price
+			}
+		}
+	}
+
+	if fixed_price == -1 {
+		return FARE_MODE_DISTANCE, 0
+	}
+	return FARE_MODE_FIXED, fixed_price
+}
+
+func (s *MetromanServer) GetFareMatrices(code string) ([]MetromanFareMatrix, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+
+	fare_matrices := []MetromanFareMatrix{}
+	for i, fare_matrix_stations := range city.FareMatrixStations {
+		station_codes := []string{}
+		for _, station := range fare_matrix_stations {
+			station_codes = append(station_codes, station.Code)
+		}
+
+		fares := [][]int{}
+		for _, row := range *city.FareMatrices[i] {
+			fares = append(fares, slices.Clone(row))
+		}
+
+		fare_matrices = append(fare_matrices, MetromanFareMatrix{
+			StationCodes: station_codes,
+			Fares:        fares,
+		})
+	}
+
+	return fare_matrices, nil
+}
+
+// Every station pair of every fare matrix as one row, easier for analysis than the GTFS fare rules
+func (s *MetromanServer) GenerateFareMatrixCSV(code string) (string, error) {
+	fare_matrices, err := s.GetFareMatrices(code)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"matrix", "origin_code", "destination_code", "fare",
+	}); err != nil {
+		return "", err
+	}
+
+	for i, fare_matrix := range fare_matrices {
+		for x, start_code := range fare_matrix.StationCodes {
+			for y, end_code := range fare_matrix.StationCodes {
+				if x >= len(fare_matrix.Fares) || y >= len(fare_matrix.Fares[x]) {
+					continue
+				}
+
+				if err := csv_writer.Write([]string{
+					fmt.Sprintf("%d", i),
+					start_code,
+					end_code,
+					fmt.Sprintf("%d", fare_matrix.Fares[x][y]),
+				}); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (s *MetromanServer) GenerateAgencyTXT(code string, opts GenerateOptions) string {
+	// Fall back to the code when there is no Baidu server or no mapping for this city
+	city_name := code
+	if s.BaiduServer != nil {
+		if mapping, ok := s.BaiduServer.CityUIDMappingsByMetromanCode[code]; ok && mapping.EnglishName != "" {
+			city_name = mapping.EnglishName
+		}
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	_ = csv_writer.Write([]string{
+		"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang", "agency_phone",
+	})
+	_ = csv_writer.Write([]string{
+		opts.AgencyID(code),
+		fmt.Sprintf("China-GTFS %s", city_name),
+		"https://tgrcode.com/",
+		s.CityTimezone(code),
+		"zh",
+		"",
+	})
+
+	// Then every operator running a line in the feed
+	if city, exists := s.Cities[code]; exists {
+		operators := map[string]*MetromanOperator{}
+		for _, route := range city.Routes {
+			if opts.IncludesRoute(route) && route.Line.Operator != nil {
+				operators[route.Line.Operator.ID] = route.Line.Operator
+			}
+		}
+
+		for _, operator_id := range slices.Sorted(maps.Keys(operators)) {
+			// agency_url is required
+			url := operators[operator_id].URL
+			if url == "" {
+				url = "https://tgrcode.com/"
+			}
+
+			_ = csv_writer.Write([]string{
+				opts.AgencyIDPrefix + operator_id,
+				operators[operator_id].Name,
+				url,
+				s.CityTimezone(code),
+				"zh",
+				"",
+			})
+		}
+	}
+
+	csv_writer.Flush()
+	return buf.String()
+}
+
+func (s *MetromanServer) GenerateRoutesTXT(city_code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"agency_id", "route_id", "route_short_name", "route_long_name", "route_desc",
+		"route_type", "route_url", "route_color", "route_text_color",
+	}); err != nil {
+		return "", err
+	}
+
+	for _, route := range city.Routes {
+		if opts.IncludesRoute(route) {
+			// No hashtag in color
+			color := ""
+			if len(route.Line.Color) > 0 {
+				color = route.Line.Color[1:]
+			}
+
+			route_desc := ""
+			if opts.RouteDescriptions {
+				route_desc = RouteDescription(route)
+			}
+
+			if err := csv_writer.Write([]string{
+				opts.LineAgencyID(city_code, route.Line),
+				opts.ID(route.Code),
+				route.SimplifiedName,
+				route.EnglishName,
+				route_desc,
+				RouteType(route.Line), // https://gtfs.org/documentation/schedule/reference/#routestxt
+				"",                    // No URL YET
+				color,
+				"000000",
+			}); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// GTFS route_type by uno.csv line record type. Walking lines only become routes with WALKING_WAY_MODE_ROUTES,
+// GTFS has no walking type so they use the extended miscellaneous service type
+var uno_line_route_types = map[string]string{
+	"ML": "1",    // Subway, metro
+	"BL": "3",    // Bus
+	"TL": "0",    // Tram
+	"WL": "1700", // Miscellaneous service
+}
+
+// GTFS route_type for a line, subway unless it is a bus or tram line kept by IncludeBusAndTram
+func RouteType(line *MetromanLine) string {
+	if line.RouteType == "" {
+		return "1"
+	}
+	return line.RouteType
+}
+
+// Like "Line 1: Pingguoyuan to Sihui East"
+func RouteDescription(route *MetromanRoute) string {
+	if len(route.Stations) == 0 {
+		return route.Line.EnglishName
+	}
+
+	return fmt.Sprintf("%s: %s to %s",
+		route.Line.EnglishName,
+		route.Stations[0].EnglishName,
+		route.Stations[len(route.Stations)-1].EnglishName,
+	)
+}
+
+// Shortest time in minutes between two stations of a walking way across its trips, false if no trip visits both.
+// Most walking ways have no timetable at all
+func WalkingMinutes(route *MetromanRoute, from_station *MetromanStation, to_station *MetromanStation) (int, bool) {
+	best_minutes := -1
+
+	for _, trips := range route.Trips {
+		for _, trip := range trips {
+			from_idx := slices.IndexFunc(trip.Visits, func(visit MetromanStationVisit) bool {
+				return visit.Station == from_station
+			})
+			to_idx := slices.IndexFunc(trip.Visits, func(visit MetromanStationVisit) bool {
+				return visit.Station == to_station
+			})
+			if from_idx == -1 || to_idx == -1 {
+				continue
+			}
+
+			minutes := trip.Visits[to_idx].ArrivalAndDepartMinutes - trip.Visits[from_idx].ArrivalAndDepartMinutes
+			if minutes < 0 {
+				minutes = -minutes
+			}
+			if best_minutes == -1 || minutes < best_minutes {
+				best_minutes = minutes
+			}
+		}
+	}
+
+	return best_minutes, best_minutes != -1
+}
+
+// Walking ways not written as routes as transfers between their stops in both directions, see opts.WalkingWayMode. Pairs with
+// a MetroMan walking time get a minimum transfer time, the rest are recommended transfer points
+func (s *MetromanServer) GenerateTransfersTXT(city_code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"from_stop_id", "to_stop_id", "transfer_type", "min_transfer_time",
+	}); err != nil {
+		return "", err
+	}
+
+	if opts.WalkingWayMode != WALKING_WAY_MODE_IGNORE {
+		stop_station_codes := StopStationCodes(city, opts)
+		// Each pair once, keeping the shortest walk seen across all walking ways. -1 when unknown
+		transfers := [][2]string{}
+		transfer_minutes := map[[2]string]int{}
+
+		for _, route := range city.Routes {
+			// Walking ways written as routes need no transfers
+			if !route.Walking || opts.IncludesRoute(route) {
+				continue
+			}
+
+			for i, from_station := range route.Stations {
+				for _, to_station := range route.Stations[i+1:] {
+					from_code, from_exists := stop_station_codes[from_station.Code]
+					to_code, to_exists := stop_station_codes[to_station.Code]
+					// Collapsed stations need no transfer to themselves
+					if !from_exists || !to_exists || from_code == to_code {
+						continue
+					}
+
+					// Walking is assumed to take as long in both directions
+					minutes, has_minutes := WalkingMinutes(route, from_station, to_station)
+					if !has_minutes {
+						minutes = -1
+					}
+
+					for _, transfer := range [][2]string{{from_code, to_code}, {to_code, from_code}} {
+						existing_minutes, seen := transfer_minutes[transfer]
+						if !seen {
+							transfers = append(transfers, transfer)
+							transfer_minutes[transfer] = minutes
+						} else if minutes != -1 && (existing_minutes == -1 || minutes < existing_minutes) {
+							transfer_minutes[transfer] = minutes
+						}
+					}
+				}
+			}
+		}
+
+		for _, transfer := range transfers {
+			// Recommended transfer point unless MetroMan gives a walking time
+			transfer_type := "0"
+			min_transfer_time := ""
+			if minutes := transfer_minutes[transfer]; minutes != -1 {
+				transfer_type = "2"
+				min_transfer_time = strconv.Itoa(minutes * 60)
+			}
+
+			if err := csv_writer.Write([]string{
+				opts.ID(transfer[0]),
+				opts.ID(transfer[1]),
+				transfer_type,
+				min_transfer_time,
+			}); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Fares v2 networks, one per line so leg rules can price a whole line. Returns networks.txt and route_networks.txt
+func (s *MetromanServer) GenerateNetworksTXT(city_code string, opts GenerateOptions) (string, string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	var networks_buf bytes.Buffer
+	networks_writer := csv.NewWriter(&networks_buf)
+	var route_networks_buf bytes.Buffer
+	route_networks_writer := csv.NewWriter(&route_networks_buf)
+
+	if err := networks_writer.Write([]string{"network_id", "network_name"}); err != nil {
+		return "", "", err
+	}
+	if err := route_networks_writer.Write([]string{"network_id", "route_id"}); err != nil {
+		return "", "", err
+	}
+
+	written_networks := map[string]bool{}
+
+	// Every route belongs to exactly one line, so to exactly one network
+	for _, route := range city.Routes {
+		if !opts.IncludesRoute(route) {
+			continue
+		}
+
+		network_id := opts.ID(fmt.Sprintf("network_%s", route.Line.Code))
+
+		if !written_networks[network_id] {
+			written_networks[network_id] = true
+
+			if err := networks_writer.Write([]string{
+				network_id,
+				route.Line.EnglishName,
+			}); err != nil {
+				return "", "", err
+			}
+		}
+
+		if err := route_networks_writer.Write([]string{
+			network_id,
+			opts.ID(route.Code),
+		}); err != nil {
+			return "", "", err
+		}
+	}
+
+	networks_writer.Flush()
+	if err := networks_writer.Error(); err != nil {
+		return "", "", err
+	}
+	route_networks_writer.Flush()
+	if err := route_networks_writer.Error(); err != nil {
+		return "", "", err
+	}
+
+	return networks_buf.String(), route_networks_buf.String(), nil
+}
+
+func (s *MetromanServer) GenerateCalendarTXT(city_code string, opts GenerateOptions) (string, string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	start_date, end_date, err := s.GetServiceWindow(city_code)
+	if err != nil {
+		return "", "", err
+	}
+
+	var cal_buf bytes.Buffer
+	var dates_buf bytes.Buffer
+	cal_writer := csv.NewWriter(&cal_buf)
+	dates_writer := csv.NewWriter(&dates_buf)
+
+	if err := cal_writer.Write([]string{
+		"service_id", "monday", "tuesday", "wednesday", "thursday",
+		"friday", "saturday", "sunday", "start_date", "end_date",
+	}); err != nil {
+		return "", "", err
+	}
+	if err := dates_writer.Write([]string{
+		"service_id", "date", "exception_type",
+	}); err != nil {
+		return "", "", err
+	}
+
+	// Sorted so the output is stable between runs
+	holidays := slices.SortedFunc(slices.Values(city.Holidays), CompareDates)
+
+	schedule_def := maps.Clone(city.ScheduleDef)
+	if opts.DeduplicateTrips {
+		for _, route := range city.Routes {
+			for _, service := range s.RouteServices(route, opts) {
+				schedule_def[service.Schedule.Code] = service.Schedule
+			}
+		}
+	}
+
+	for _, schedule_code := range slices.Sorted(maps.Keys(schedule_def)) {
+		schedule := schedule_def[schedule_code]
+		any_day_of_week_set := schedule.DaysOfWeek[0] == 1 || schedule.DaysOfWeek[1] == 1 || schedule.DaysOfWeek[2] == 1 || schedule.DaysOfWeek[3] == 1 || schedule.DaysOfWeek[4] == 1 || schedule.DaysOfWeek[5] == 1 || schedule.DaysOfWeek[6] == 1
+
+		// A day of the week must be specified or this must have holidays set (as holidays must still reference a schedule)
+		if any_day_of_week_set || schedule.Holidays {
+			if err := cal_writer.Write([]string{
+				opts.ID(schedule.Code),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[0]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[1]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[2]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[3]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[4]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[5]),
+				fmt.Sprintf("%d", schedule.DaysOfWeek[6]),
+				FormatDate(start_date),
+				FormatDate(end_date),
+			}); err != nil {
+				return "", "", err
+			}
+		}
+
+		date_action := 2 // Remove the date
+		if schedule.Holidays {
+			date_action = 1 // Add the date
+		}
+
+		// Note every single holiday day
+		for _, holiday := range holidays {
+			if err := dates_writer.Write([]string{
+				opts.ID(schedule.Code),
+				FormatDate(holiday),
+				fmt.Sprintf("%d", date_action),
+			}); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	cal_writer.Flush()
+	dates_writer.Flush()
+
+	if err := cal_writer.Error(); err != nil {
+		return "", "", err
+	}
+	if err := dates_writer.Error(); err != nil {
+		return "", "", err
+	}
+
+	return cal_buf.String(), dates_buf.String(), nil
+}
+
+func CompareDates(a MetromanDate, b MetromanDate) int {
+	if a.Year != b.Year {
+		return a.Year - b.Year
+	}
+	if a.Month != b.Month {
+		return a.Month - b.Month
+	}
+	return a.Day - b.Day
+}
+
+// GTFS dates are YYYYMMDD
+func FormatDate(date MetromanDate) string {
+	return fmt.Sprintf("%04d%02d%02d", date.Year, date.Month, date.Day)
+}
+
+// MetroMan schedules carry no validity dates and stay in use until a new zip replaces them, so service
+// never ends. The only dated data is the holiday list, service starts with the first holiday year.
+// Without holidays or trips the window is open at both ends
+func (s *MetromanServer) GetServiceWindow(city_code string) (MetromanDate, MetromanDate, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return MetromanDate{}, MetromanDate{}, fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	start_date := MetromanDate{Year: 2000, Month: 1, Day: 1} // Day in the past
+	end_date := MetromanDate{Year: 9999, Month: 12, Day: 31} // Day in the future
+
+	has_trips := false
+	for _, route := range city.Routes {
+		for _, trips := range route.Trips {
+			if len(trips) > 0 {
+				has_trips = true
+			}
+		}
+	}
+
+	if !has_trips || len(city.Holidays) == 0 {
+		return start_date, end_date, nil
+	}
+
+	first_year := city.Holidays[0].Year
+	for _, holiday := range city.Holidays {
+		first_year = min(first_year, holiday.Year)
+	}
+
+	return MetromanDate{Year: first_year, Month: 1, Day: 1}, end_date, nil
+}
+
+func (s *MetromanServer) GenerateFeedInfoTXT(city_code string) (string, error) {
+	start_date, end_date, err := s.GetServiceWindow(city_code)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"feed_publisher_name", "feed_publisher_url", "feed_lang", "feed_start_date", "feed_end_date", "feed_version",
+		"feed_contact_url",
+	}); err != nil {
+		return "", err
+	}
+
+	// MetroMan zip date
+	zip_date, _ := s.ZipDate(city_code)
+
+	if err := csv_writer.Write([]string{
+		"China-GTFS",
+		"https://tgrcode.com/",
+		"zh",
+		FormatDate(start_date),
+		FormatDate(end_date),
+		zip_date,
+		s.License.URL,
+	}); err != nil {
+		return "", err
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// MetroMan and this project produce the feed, Baidu is credited when it was used for stops and agencies
+func (s *MetromanServer) DefaultAttributions() []MetromanAttribution {
+	attributions := []MetromanAttribution{
+		{OrganizationName: "MetroMan", URL: "https://www.metroman.cn/", IsProducer: true},
+		{OrganizationName: "China-GTFS", URL: "https://tgrcode.com/", IsProducer: true},
+	}
+
+	if s.BaiduServer != nil {
+		attributions = append(attributions, MetromanAttribution{OrganizationName: "Baidu Maps", URL: "https://map.baidu.com/", IsProducer: true})
+	}
+
+	return attributions
+}
+
+func (s *MetromanServer) GenerateAttributionsTXT(city_code string, opts GenerateOptions) (string, error) {
+	if _, exists := s.Cities[city_code]; !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	attributions := opts.Attributions
+	if attributions == nil {
+		attributions = s.DefaultAttributions()
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"attribution_id", "organization_name", "is_producer", "is_operator", "is_authority", "attribution_url",
+	}); err != nil {
+		return "", err
+	}
+
+	flag := func(value bool) string {
+		if value {
+			return "1"
+		}
+		return "0"
+	}
+
+	for i, attribution := range attributions {
+		if err := csv_writer.Write([]string{
+			opts.ID(fmt.Sprintf("attribution_%d", i)),
+			attribution.OrganizationName,
+			flag(attribution.IsProducer),
+			flag(attribution.IsOperator),
+			flag(attribution.IsAuthority),
+			attribution.URL,
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (s *MetromanServer) GenerateTripsTXT(city_code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+	if city.MetadataOnly {
+		return "", fmt.Errorf("city %v was loaded without schedules", city_code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"route_id", "service_id", "trip_id", "trip_headsign", "direction_id", "shape_id",
+		"wheelchair_accessible", "bikes_allowed",
+	}); err != nil {
+		return "", err
+	}
+
+	for _, route := range city.Routes {
+		if opts.IncludesRoute(route) {
+			if route.EstimatedTrips && opts.Report != nil {
+				opts.Report.Add(GENERATION_EVENT_TRIPS_ESTIMATED, route.Code,
+					"route %s: trips estimated, MetroMan has no timetable", route.Code)
+			}
+
+			headsign := route.EnglishName
+			if opts.TerminusHeadsigns {
+				headsign = city.LineDirections(route.Line)[route.IdxWithinLine%2].Headsign
+			}
+
+			for _, service := range s.RouteServices(route, opts) {
+				trip_ids := TripIDs(route, service.ScheduleIdx, SortTrips(s.FilterServiceHours(route.Trips[service.ScheduleIdx])))
+
+				for _, trip_id := range trip_ids {
+					if err := csv_writer.Write([]string{
+						opts.ID(route.Code),
+						opts.ID(service.Schedule.Code),
+						opts.ID(trip_id),
+						headsign,
+						fmt.Sprintf("%d", route.IdxWithinLine%2), // 0 or 1
+						opts.ID(RouteShapeID(route)),
+						fmt.Sprintf("%d", opts.WheelchairAccessible),
+						fmt.Sprintf("%d", opts.BikesAllowed),
+					}); err != nil {
+						return "", err
+					}
+				}
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (s *MetromanServer) GenerateShapesTXT(city_code string, opts GenerateOptions) (string, error) {
+	city, exists := s.Cities[city_code]
+	if !exists {
+		return "", fmt.Errorf("city %v not loaded", city_code)
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+
+	if err := csv_writer.Write([]string{
+		"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence", "shape_dist_traveled",
+	}); err != nil {
+		return "", err
+	}
+
+	for _, route := range city.Routes {
+		if opts.IncludesRoute(route) {
+			if opts.Report != nil {
+				if !RouteHasGeometry(route) {
+					opts.Report.Add(GENERATION_EVENT_SHAPE_MISSING, RouteShapeID(route),
+						"shape %s: no path between any stations of route %s", RouteShapeID(route), route.Code)
+				} else {
+					// The shape jumps straight over segments without a path
+					for station_idx := range len(route.Stations) - 1 {
+						if len(RouteSegment(route, station_idx)) == 0 {
+							opts.Report.Add(GENERATION_EVENT_SHAPE_SEGMENT_SYNTHESIZED, RouteShapeID(route),
+								"shape %s: straight line from %s to %s", RouteShapeID(route),
+								route.Stations[station_idx].Code, route.Stations[station_idx+1].Code)
+						}
+					}
+				}
+			}
+
+			// A single bad point from correction or decoding would stretch the shape across the globe
+			route_shape := RouteShape(route)
+			shape := []common.Coordinate{}
+			for _, coord := range route_shape {
+				if common.IsPlausibleChinaCoordinate(coord) {
+					shape = append(shape, coord)
+				}
+			}
+			if dropped := len(route_shape) - len(shape); dropped > 0 {
+				if opts.Report != nil {
+					opts.Report.Add(GENERATION_EVENT_SHAPE_POINTS_DROPPED, RouteShapeID(route),
+						"shape %s: dropped %d points outside China", RouteShapeID(route), dropped)
+				} else {
+					log.Printf("%s: dropped %d points outside China from shape %s", city_code, dropped, RouteShapeID(route))
+				}
+			}
+
+			for counter, coord := range shape {
+				if err := csv_writer.Write([]string{
+					opts.ID(RouteShapeID(route)),
+					opts.FormatCoordinate(coord.Lat),
+					opts.FormatCoordinate(coord.Lng),
+					fmt.Sprintf("%d", counter),
+					"",
+				}); err != nil {
+					return "", err
 				}
+			}
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// Every MetroMan route runs in one direction (the opposite direction is its own route)
+// so each route gets its own shape, oriented in the order its trips visit stations
+func RouteShapeID(route *MetromanRoute) string {
+	return fmt.Sprintf("shape_%s", route.Code)
+}
+
+func RouteShape(route *MetromanRoute) []common.Coordinate {
+	shape := []common.Coordinate{}
+
+	for station_idx := range len(route.Stations) - 1 {
+		shape = append(shape, RouteSegment(route, station_idx)...)
+	}
+
+	return shape
+}
+
+// Path from the station at station_idx to the next one on the route, empty if MetroMan has none
+func RouteSegment(route *MetromanRoute, station_idx int) []common.Coordinate {
+	coords, exists := route.Line.StationPaths[fmt.Sprintf("%s_%s", route.Stations[station_idx].Code, route.Stations[station_idx+1].Code)]
+	if exists {
+		// Go forwards
+		return coords
+	}
+
+	coords = route.Line.StationPaths[fmt.Sprintf("%s_%s", route.Stations[station_idx+1].Code, route.Stations[station_idx].Code)]
+	// Go backwards, the path was only stored for the opposite direction
+	segment := []common.Coordinate{}
+	for i := len(coords) - 1; i >= 0; i-- {
+		segment = append(segment, coords[i])
+	}
+
+	return segment
+}
+
+// Trips every HeadwayMinutes for each schedule, timed by the path length between stations
+// (or the straight line when there is no path) at SpeedKmh
+func EstimateTrips(route *MetromanRoute, estimate MetromanTripEstimate) [][]MetromanTrip {
+	travel_minutes := []int{}
+	for station_idx := range len(route.Stations) - 1 {
+		meters := 0.0
+		segment := RouteSegment(route, station_idx)
+		if len(segment) > 1 {
+			for i := range len(segment) - 1 {
+				meters += common.HaversineDistance(segment[i], segment[i+1])
+			}
+		} else {
+			meters = common.HaversineDistance(
+				common.Coordinate{Lat: route.Stations[station_idx].Lat, Lng: route.Stations[station_idx].Lng},
+				common.Coordinate{Lat: route.Stations[station_idx+1].Lat, Lng: route.Stations[station_idx+1].Lng},
+			)
+		}
+
+		// Always at least a minute so stops never share a time
+		travel_minutes = append(travel_minutes, max(1, int(math.Round(meters/1000/estimate.SpeedKmh*60))))
+	}
+
+	trips := []MetromanTrip{}
+	for depart_min := estimate.StartMinutes; depart_min <= estimate.EndMinutes; depart_min += max(estimate.HeadwayMinutes, 1) {
+		trip := MetromanTrip{
+			Visits: []MetromanStationVisit{{
+				Station:                 route.Stations[0],
+				ArrivalAndDepartMinutes: depart_min,
+			}},
+		}
+
+		minutes := depart_min
+		for station_idx, travel := range travel_minutes {
+			minutes += travel
+			trip.Visits = append(trip.Visits, MetromanStationVisit{
+				Station:                 route.Stations[station_idx+1],
+				ArrivalAndDepartMinutes: minutes,
+			})
+		}
+
+		trips = append(trips, trip)
+	}
+
+	// Every schedule runs the same estimated trips
+	trips_by_schedule := [][]MetromanTrip{}
+	for range route.Schedules {
+		trips_by_schedule = append(trips_by_schedule, trips)
+	}
+
+	return trips_by_schedule
+}
+
+// Trips with every visit inside ServiceHours. Times before the start are treated as after midnight
+func (s *MetromanServer) FilterServiceHours(trips []MetromanTrip) []MetromanTrip {
+	if s.ServiceHours == nil {
+		return trips
+	}
+
+	filtered_trips := []MetromanTrip{}
+	for _, trip := range trips {
+		in_service := true
+		for _, visit := range trip.Visits {
+			minutes := visit.ArrivalAndDepartMinutes
+			if minutes < s.ServiceHours.StartMinutes {
+				minutes += 24 * 60
+			}
+			if minutes > s.ServiceHours.EndMinutes {
+				in_service = false
+				break
+			}
+		}
+
+		if in_service {
+			filtered_trips = append(filtered_trips, trip)
+		}
+	}
+
+	return filtered_trips
+}
+
+// GTFS times are HH:MM:SS
+func FormatTime(minutes int) string {
+	return fmt.Sprintf("%02d:%02d:00", minutes/60, minutes%60)
+}
+
+// Look up a trip by the trip_id it has in trips.txt
+func (s *MetromanServer) GetTripTimetable(code string, trip_id string) (MetromanTripTimetable, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return MetromanTripTimetable{}, fmt.Errorf("city %v not loaded", code)
+	}
 
-				// attributes
-				if err := attrs_writer.Write([]string{
-					fare_id,
-					fmt.Sprintf("%d", (*city.FareMatrices[i])[x][y]),
-					"CNY",
-					"1", // payment_method
-					"0", // transfers
-					"",  // agency_id
-					"",  // transfer_duration
-				}); err != nil {
-					return "", "", err
+	for _, route := range city.Routes {
+		// Trip ids start with the route code, skip routes that cannot match
+		if !IsTransitRoute(route) || !strings.HasPrefix(trip_id, route.Code) {
+			continue
+		}
+
+		for schedule_idx, trips := range route.Trips {
+			sorted_trips := SortTrips(s.FilterServiceHours(trips))
+
+			for trip_idx, candidate_id := range TripIDs(route, schedule_idx, sorted_trips) {
+				if candidate_id != trip_id {
+					continue
 				}
+
+				return TripTimetable(route, schedule_idx, trip_id, sorted_trips[trip_idx]), nil
 			}
 		}
 	}
 
-	rules_writer.Flush()
-	attrs_writer.Flush()
+	return MetromanTripTimetable{}, fmt.Errorf("trip %s not found in city %v", trip_id, code)
+}
 
-	if err := rules_writer.Error(); err != nil {
-		return "", "", err
+func TripTimetable(route *MetromanRoute, schedule_idx int, trip_id string, trip MetromanTrip) MetromanTripTimetable {
+	stops := []MetromanTimetableStop{}
+	for _, visit := range trip.Visits {
+		stops = append(stops, MetromanTimetableStop{
+			StationCode: visit.Station.Code,
+			EnglishName: visit.Station.EnglishName,
+			Minutes:     visit.ArrivalAndDepartMinutes,
+			Time:        FormatTime(visit.ArrivalAndDepartMinutes),
+		})
 	}
-	if err := attrs_writer.Error(); err != nil {
-		return "", "", err
+
+	departure := ""
+	if len(trip.Visits) > 0 {
+		departure = fmt.Sprintf("%02d:%02d", trip.Visits[0].ArrivalAndDepartMinutes/60, trip.Visits[0].ArrivalAndDepartMinutes%60)
 	}
 
-	return rules_buf.String(), attrs_buf.String(), nil
+	return MetromanTripTimetable{
+		TripID:       trip_id,
+		RouteCode:    route.Code,
+		ScheduleCode: route.Schedules[schedule_idx].Code,
+		Departure:    departure,
+		Stops:        stops,
+	}
 }
 
-func (s *MetromanServer) GenerateAgencyTXT(code string) string {
-	var buf bytes.Buffer
-	csv_writer := csv.NewWriter(&buf)
+// Every trip of a route as stop_times.txt has them, grouped by schedule for checking schedule parsing
+func (s *MetromanServer) GetRouteSchedule(code string, route_code string) ([]MetromanRouteSchedule, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+	if city.MetadataOnly {
+		return nil, fmt.Errorf("city %v was loaded without schedules", code)
+	}
 
-	_ = csv_writer.Write([]string{
-		"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang", "agency_phone",
-	})
-	_ = csv_writer.Write([]string{
-		code,
-		fmt.Sprintf("China-GTFS %s", s.BaiduServer.CityUIDMappingsByMetromanCode[code].EnglishName),
-		"https://tgrcode.com/",
-		"Asia/Shanghai",
-		"zh",
-		"",
+	route_idx := slices.IndexFunc(city.Routes, func(route *MetromanRoute) bool {
+		return route.Code == route_code
 	})
+	if route_idx == -1 {
+		return nil, fmt.Errorf("route %s not found in city %v", route_code, code)
+	}
+	route := city.Routes[route_idx]
 
-	csv_writer.Flush()
-	return buf.String()
+	route_schedules := []MetromanRouteSchedule{}
+	for schedule_idx, trips := range route.Trips {
+		sorted_trips := SortTrips(s.FilterServiceHours(trips))
+		trip_ids := TripIDs(route, schedule_idx, sorted_trips)
+
+		timetables := []MetromanTripTimetable{}
+		for trip_idx, trip := range sorted_trips {
+			timetables = append(timetables, TripTimetable(route, schedule_idx, trip_ids[trip_idx], trip))
+		}
+
+		route_schedules = append(route_schedules, MetromanRouteSchedule{
+			ScheduleCode: route.Schedules[schedule_idx].Code,
+			Trips:        timetables,
+		})
+	}
+
+	return route_schedules, nil
 }
 
-func (s *MetromanServer) GenerateRoutesTXT(city_code string) (string, error) {
-	city, exists := s.Cities[city_code]
-	if !exists {
-		return "", fmt.Errorf("city %v not loaded", city_code)
+// Schedules running on date, holidays replace the weekday schedules entirely
+// to match calendar_dates.txt
+func (c *MetromanCity) SchedulesForDate(date MetromanDate) []*MetromanSchedule {
+	is_holiday := slices.Contains(c.Holidays, date)
+
+	// DaysOfWeek starts on monday
+	weekday := time.Date(date.Year, time.Month(date.Month), date.Day, 0, 0, 0, 0, time.UTC).Weekday()
+	day_idx := (int(weekday) + 6) % 7
+
+	schedules := []*MetromanSchedule{}
+	for _, schedule_code := range slices.Sorted(maps.Keys(c.ScheduleDef)) {
+		schedule := c.ScheduleDef[schedule_code]
+		if is_holiday && schedule.Holidays || !is_holiday && schedule.DaysOfWeek[day_idx] == 1 {
+			schedules = append(schedules, schedule)
+		}
 	}
 
-	var buf bytes.Buffer
-	csv_writer := csv.NewWriter(&buf)
+	return schedules
+}
 
-	if err := csv_writer.Write([]string{
-		"agency_id", "route_id", "route_short_name", "route_long_name",
-		"route_type", "route_url", "route_color", "route_text_color",
-	}); err != nil {
-		return "", err
+// Earliest and latest departure from a station for each route direction running schedule_code.
+// Directions ending at the station have no departures and are left out
+func (c *MetromanCity) FirstLastTrain(station_code string, schedule_code string) ([]MetromanFirstLastTrain, error) {
+	if _, exists := c.StationsByCode[station_code]; !exists {
+		return nil, fmt.Errorf("station %s not found", station_code)
+	}
+	if _, exists := c.ScheduleDef[schedule_code]; !exists {
+		return nil, fmt.Errorf("schedule %s not found", schedule_code)
 	}
 
-	for _, route := range city.Routes {
-		if len(route.Trips) > 0 {
-			// No hashtag in color
-			color := ""
-			if len(route.Line.Color) > 0 {
-				color = route.Line.Color[1:]
+	first_last_trains := []MetromanFirstLastTrain{}
+	for _, route := range c.Routes {
+		if !IsTransitRoute(route) {
+			continue
+		}
+
+		found := false
+		first_last_train := MetromanFirstLastTrain{
+			RouteCode: route.Code,
+			Headsign:  route.Stations[len(route.Stations)-1].EnglishName,
+		}
+
+		for schedule_idx, trips := range route.Trips {
+			if route.Schedules[schedule_idx].Code != schedule_code {
+				continue
 			}
 
-			if err := csv_writer.Write([]string{
-				city_code,
-				route.Code,
-				route.SimplifiedName,
-				route.EnglishName,
-				"2", // https://gtfs.org/documentation/schedule/reference/#routestxt
-				"",  // No URL YET
-				color,
-				"000000",
-			}); err != nil {
-				return "", err
+			for _, trip := range trips {
+				for _, visit := range trip.Visits[:max(len(trip.Visits)-1, 0)] {
+					if visit.Station.Code != station_code {
+						continue
+					}
+
+					if !found {
+						first_last_train.FirstMinutes = visit.ArrivalAndDepartMinutes
+						first_last_train.LastMinutes = visit.ArrivalAndDepartMinutes
+						found = true
+					} else {
+						first_last_train.FirstMinutes = min(first_last_train.FirstMinutes, visit.ArrivalAndDepartMinutes)
+						first_last_train.LastMinutes = max(first_last_train.LastMinutes, visit.ArrivalAndDepartMinutes)
+					}
+				}
 			}
 		}
-	}
 
-	csv_writer.Flush()
-	if err := csv_writer.Error(); err != nil {
-		return "", err
+		if found {
+			first_last_trains = append(first_last_trains, first_last_train)
+		}
 	}
 
-	return buf.String(), nil
+	return first_last_trains, nil
 }
 
-func (s *MetromanServer) GenerateCalendarTXT(city_code string) (string, string, error) {
-	city, exists := s.Cities[city_code]
+// Next departures at or after after_minutes on date, at most limit per route direction.
+// Arrivals at the last station of a trip are not departures
+func (s *MetromanServer) GetDepartures(code string, station_code string, date MetromanDate, after_minutes int, limit int) ([]MetromanDepartures, error) {
+	city, exists := s.Cities[code]
 	if !exists {
-		return "", "", fmt.Errorf("city %v not loaded", city_code)
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+	if _, exists := city.StationsByCode[station_code]; !exists {
+		return nil, fmt.Errorf("station %s not found in city %v", station_code, code)
 	}
 
-	var cal_buf bytes.Buffer
-	var dates_buf bytes.Buffer
-	cal_writer := csv.NewWriter(&cal_buf)
-	dates_writer := csv.NewWriter(&dates_buf)
+	active_schedules := city.SchedulesForDate(date)
 
-	if err := cal_writer.Write([]string{
-		"service_id", "monday", "tuesday", "wednesday", "thursday",
-		"friday", "saturday", "sunday", "start_date", "end_date",
-	}); err != nil {
-		return "", "", err
-	}
-	if err := dates_writer.Write([]string{
-		"service_id", "date", "exception_type",
-	}); err != nil {
-		return "", "", err
-	}
+	all_departures := []MetromanDepartures{}
+	for _, route := range city.RoutesForStation(station_code) {
+		if !IsTransitRoute(route) {
+			continue
+		}
 
-	for _, schedule := range city.ScheduleDef {
-		any_day_of_week_set := schedule.DaysOfWeek[0] == 1 || schedule.DaysOfWeek[1] == 1 || schedule.DaysOfWeek[2] == 1 || schedule.DaysOfWeek[3] == 1 || schedule.DaysOfWeek[4] == 1 || schedule.DaysOfWeek[5] == 1 || schedule.DaysOfWeek[6] == 1
+		departures := []MetromanDeparture{}
+		for schedule_idx, trips := range route.Trips {
+			if !slices.Contains(active_schedules, route.Schedules[schedule_idx]) {
+				continue
+			}
 
-		// A day of the week must be specified or this must have holidays set (as holidays must still reference a schedule)
-		if any_day_of_week_set || schedule.Holidays {
-			if err := cal_writer.Write([]string{
-				schedule.Code,
-				fmt.Sprintf("%d", schedule.DaysOfWeek[0]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[1]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[2]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[3]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[4]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[5]),
-				fmt.Sprintf("%d", schedule.DaysOfWeek[6]),
-				fmt.Sprintf("%04d%02d%02d", 2000, 1, 1),   // Day in the past
-				fmt.Sprintf("%04d%02d%02d", 9999, 12, 31), // Day in the future
-			}); err != nil {
-				return "", "", err
+			sorted_trips := SortTrips(s.FilterServiceHours(trips))
+			trip_ids := TripIDs(route, schedule_idx, sorted_trips)
+
+			for trip_idx, trip := range sorted_trips {
+				for _, visit := range trip.Visits[:max(len(trip.Visits)-1, 0)] {
+					if visit.Station.Code == station_code && visit.ArrivalAndDepartMinutes >= after_minutes {
+						departures = append(departures, MetromanDeparture{
+							TripID:       trip_ids[trip_idx],
+							ScheduleCode: route.Schedules[schedule_idx].Code,
+							Minutes:      visit.ArrivalAndDepartMinutes,
+							Time:         FormatTime(visit.ArrivalAndDepartMinutes),
+						})
+						break
+					}
+				}
 			}
 		}
 
-		date_action := 2 // Remove the date
-		if schedule.Holidays {
-			date_action = 1 // Add the date
+		if len(departures) == 0 {
+			continue
 		}
 
-		// Note every single holiday day
-		for _, holiday := range city.Holidays {
-			if err := dates_writer.Write([]string{
-				schedule.Code,
-				fmt.Sprintf("%04d%02d%02d", holiday.Year, holiday.Month, holiday.Day),
-				fmt.Sprintf("%d", date_action),
-			}); err != nil {
-				return "", "", err
+		slices.SortStableFunc(departures, func(a MetromanDeparture, b MetromanDeparture) int {
+			return a.Minutes - b.Minutes
+		})
+
+		all_departures = append(all_departures, MetromanDepartures{
+			RouteCode:   route.Code,
+			EnglishName: route.EnglishName,
+			Headsign:    route.Stations[len(route.Stations)-1].EnglishName,
+			Departures:  departures[:min(len(departures), limit)],
+		})
+	}
+
+	return all_departures, nil
+}
+
+// Copy of the trips ordered by first departure, ties broken by the remaining visits so the order is total
+func SortTrips(trips []MetromanTrip) []MetromanTrip {
+	sorted_trips := slices.Clone(trips)
+	slices.SortFunc(sorted_trips, func(a MetromanTrip, b MetromanTrip) int {
+		for i := range min(len(a.Visits), len(b.Visits)) {
+			if a.Visits[i].ArrivalAndDepartMinutes != b.Visits[i].ArrivalAndDepartMinutes {
+				return a.Visits[i].ArrivalAndDepartMinutes - b.Visits[i].ArrivalAndDepartMinutes
+			}
+			if a.Visits[i].Station.Index != b.Visits[i].Station.Index {
+				return a.Visits[i].Station.Index - b.Visits[i].Station.Index
+			}
+		}
+		return len(a.Visits) - len(b.Visits)
+	})
+	return sorted_trips
+}
+
+// Trips of a route written under one service_id. Schedule is the route's own schedule unless
+// trips were deduplicated, then it combines every schedule sharing the trips
+type MetromanRouteService struct {
+	ScheduleIdx int // Trips are taken from this schedule, and its code names the trips
+	Schedule    *MetromanSchedule
+}
+
+// One service per schedule of the route. With opts.DeduplicateTrips schedules with identical trips and the same
+// holiday handling are merged, running on every day any of them ran
+func (s *MetromanServer) RouteServices(route *MetromanRoute, opts GenerateOptions) []MetromanRouteService {
+	services := []MetromanRouteService{}
+	merged_schedules := [][]*MetromanSchedule{}
+	merged_trips := [][]MetromanTrip{}
+
+	for schedule_idx, trips := range route.Trips {
+		sorted_trips := SortTrips(s.FilterServiceHours(trips))
+		schedule := route.Schedules[schedule_idx]
+
+		merged := false
+		if opts.DeduplicateTrips {
+			for i := range services {
+				if merged_schedules[i][0].Holidays == schedule.Holidays && SameTrips(merged_trips[i], sorted_trips) {
+					merged_schedules[i] = append(merged_schedules[i], schedule)
+					merged = true
+					break
+				}
 			}
 		}
+
+		if !merged {
+			services = append(services, MetromanRouteService{
+				ScheduleIdx: schedule_idx,
+				Schedule:    schedule,
+			})
+			merged_schedules = append(merged_schedules, []*MetromanSchedule{schedule})
+			merged_trips = append(merged_trips, sorted_trips)
+		}
 	}
 
-	cal_writer.Flush()
-	dates_writer.Flush()
+	for i, schedules := range merged_schedules {
+		if len(schedules) > 1 {
+			services[i].Schedule = MergeSchedules(schedules)
+		}
+	}
 
-	if err := cal_writer.Error(); err != nil {
-		return "", "", err
+	return services
+}
+
+// Schedule running on every day any of the schedules do, named after all of them in sorted order
+// so every route merging the same schedules shares it. Schedules must agree on holidays
+func MergeSchedules(schedules []*MetromanSchedule) *MetromanSchedule {
+	codes := []string{}
+	merged := &MetromanSchedule{
+		Holidays: schedules[0].Holidays,
 	}
-	if err := dates_writer.Error(); err != nil {
-		return "", "", err
+
+	for _, schedule := range schedules {
+		codes = append(codes, schedule.Code)
+		for day := range merged.DaysOfWeek {
+			merged.DaysOfWeek[day] = max(merged.DaysOfWeek[day], schedule.DaysOfWeek[day])
+		}
 	}
 
-	return cal_buf.String(), dates_buf.String(), nil
+	slices.Sort(codes)
+	merged.Code = strings.Join(codes, "+")
+
+	return merged
+}
+
+// Trips visiting the same stations at the same times, both sorted by SortTrips
+func SameTrips(a []MetromanTrip, b []MetromanTrip) bool {
+	return slices.EqualFunc(a, b, func(a_trip MetromanTrip, b_trip MetromanTrip) bool {
+		return slices.EqualFunc(a_trip.Visits, b_trip.Visits, func(a_visit MetromanStationVisit, b_visit MetromanStationVisit) bool {
+			return a_visit.Station.Index == b_visit.Station.Index && a_visit.ArrivalAndDepartMinutes == b_visit.ArrivalAndDepartMinutes
+		})
+	})
 }
 
-func (s *MetromanServer) GenerateTripsTXT(city_code string) (string, error) {
+// Trip ids come from where and when each trip starts rather than its position, so trips.txt and
+// stop_times.txt agree. Trips sharing a start get a suffix in the order given by SortTrips
+func TripIDs(route *MetromanRoute, schedule_idx int, sorted_trips []MetromanTrip) []string {
+	trip_ids := []string{}
+	seen := make(map[string]int)
+
+	for _, trip := range sorted_trips {
+		trip_id := fmt.Sprintf("%s_trip_%s_%s_%04d",
+			route.Code,
+			route.Schedules[schedule_idx].Code,
+			trip.Visits[0].Station.Code,
+			trip.Visits[0].ArrivalAndDepartMinutes,
+		)
+
+		occurrence := seen[trip_id]
+		seen[trip_id]++
+
+		if occurrence > 0 {
+			trip_id = fmt.Sprintf("%s_%d", trip_id, occurrence)
+		}
+
+		trip_ids = append(trip_ids, trip_id)
+	}
+
+	return trip_ids
+}
+
+// MetroMan schedules hold a departure and next arrival for every consecutive station pair,
+// so stops normally have an exact time and timepoint is 1. Route stations a trip passes between
+// two timed visits are written with blank times and timepoint 0 for consumers to interpolate.
+// Estimated trips (see EstimateMissingTrips) are approximate and use timepoint 0
+func (s *MetromanServer) GenerateStopTimesTXT(city_code string, opts GenerateOptions) (string, error) {
 	city, exists := s.Cities[city_code]
 	if !exists {
 		return "", fmt.Errorf("city %v not loaded", city_code)
 	}
+	if city.MetadataOnly {
+		return "", fmt.Errorf("city %v was loaded without schedules", city_code)
+	}
+
+	stop_station_codes := StopStationCodes(city, opts)
 
 	var buf bytes.Buffer
 	csv_writer := csv.NewWriter(&buf)
 
 	if err := csv_writer.Write([]string{
-		"route_id", "service_id", "trip_id", "trip_headsign", "direction_id", "shape_id",
+		"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "timepoint",
 	}); err != nil {
 		return "", err
 	}
 
 	for _, route := range city.Routes {
-		if len(route.Trips) > 0 {
-			for schedule_idx, trips := range route.Trips {
-				for trip_idx := range trips {
-					trip_id := fmt.Sprintf("%s_trip_%s_%d",
-						route.Code,
-						route.Schedules[schedule_idx].Code,
-						trip_idx,
-					)
+		// Must match the routes.txt and trips.txt filter
+		if !opts.IncludesRoute(route) {
+			continue
+		}
 
-					if err := csv_writer.Write([]string{
-						route.Code,
-						route.Schedules[schedule_idx].Code,
+		timepoint := "1" // Timepoints are considered exact
+		if route.EstimatedTrips {
+			timepoint = "0"
+		}
+
+		for _, service := range s.RouteServices(route, opts) {
+			sorted_trips := SortTrips(s.FilterServiceHours(route.Trips[service.ScheduleIdx]))
+			trip_ids := TripIDs(route, service.ScheduleIdx, sorted_trips)
+
+			for trip_idx, trip := range sorted_trips {
+				trip_id := opts.ID(trip_ids[trip_idx])
+
+				// Sequence only has to increase, so leaving a stop out is fine
+				stop_sequence := 0
+				writeStopTime := func(station *MetromanStation, time_str string, timepoint string) error {
+					stop_code, exists := stop_station_codes[station.Code]
+					if !exists {
+						return nil
+					}
+
+					stop_sequence++
+					return csv_writer.Write([]string{
 						trip_id,
-						route.EnglishName,
-						fmt.Sprintf("%d", route.IdxWithinLine%2), // 0 or 1
-						fmt.Sprintf("shape_%s", route.Code),
-					}); err != nil {
+						time_str, // We only care about this
+						time_str,
+						opts.ID(stop_code),
+						fmt.Sprintf("%d", stop_sequence-1),
+						timepoint,
+					})
+				}
+
+				// Index in route.Stations of the previous visit, searched forward so loops visiting a station twice work
+				previous_route_idx := -1
+				for _, station_visit := range trip.Visits {
+					if route_idx := slices.Index(route.Stations[previous_route_idx+1:], station_visit.Station); route_idx != -1 {
+						route_idx += previous_route_idx + 1
+
+						if previous_route_idx != -1 {
+							for _, passed_station := range route.Stations[previous_route_idx+1 : route_idx] {
+								if err := writeStopTime(passed_station, "", "0"); err != nil {
+									return "", err
+								}
+							}
+						}
+						previous_route_idx = route_idx
+					}
+
+					if err := writeStopTime(station_visit.Station, FormatTime(station_visit.ArrivalAndDepartMinutes), timepoint); err != nil {
 						return "", err
 					}
 				}
@@ -1158,124 +3908,68 @@ func (s *MetromanServer) GenerateTripsTXT(city_code string) (string, error) {
 	return buf.String(), nil
 }
 
-func (s *MetromanServer) GenerateShapesTXT(city_code string) (string, error) {
+func (s *MetromanServer) GenerateLinesGeoJSON(city_code string) ([]byte, error) {
 	city, exists := s.Cities[city_code]
 	if !exists {
-		return "", fmt.Errorf("city %v not loaded", city_code)
+		return nil, fmt.Errorf("city %v not loaded", city_code)
 	}
 
-	var buf bytes.Buffer
-	csv_writer := csv.NewWriter(&buf)
+	feature_collection := geojson.NewFeatureCollection()
 
-	if err := csv_writer.Write([]string{
-		"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence", "shape_dist_traveled",
-	}); err != nil {
-		return "", err
-	}
+	for _, line := range city.Lines {
+		// Walking lines generally have no geometry
+		if len(line.StationPaths) == 0 {
+			continue
+		}
 
-	for _, route := range city.Routes {
-		if len(route.Trips) > 0 {
-			counter := 0
-			for station_idx := range len(route.Stations) - 1 {
-				coords, exists := route.Line.StationPaths[fmt.Sprintf("%s_%s", route.Stations[station_idx].Code, route.Stations[station_idx+1].Code)]
-				if exists {
-					// Go forwards
-					for i := 0; i < len(coords); i++ {
-						if err := csv_writer.Write([]string{
-							fmt.Sprintf("shape_%s", route.Code),
-							fmt.Sprintf("%f", coords[i].Lat),
-							fmt.Sprintf("%f", coords[i].Lng),
-							fmt.Sprintf("%d", counter),
-							"",
-						}); err != nil {
-							return "", err
-						}
-						counter++
-					}
-				} else {
-					coords := route.Line.StationPaths[fmt.Sprintf("%s_%s", route.Stations[station_idx+1].Code, route.Stations[station_idx].Code)]
-					// Go backwards
-					for i := len(coords) - 1; i >= 0; i-- {
-						if err := csv_writer.Write([]string{
-							fmt.Sprintf("shape_%s", route.Code),
-							fmt.Sprintf("%f", coords[i].Lat),
-							fmt.Sprintf("%f", coords[i].Lng),
-							fmt.Sprintf("%d", counter),
-							"",
-						}); err != nil {
-							return "", err
-						}
-						counter++
-					}
-				}
+		// Every path between two stations is its own segment, sorted so output is stable
+		multi_line_string := orb.MultiLineString{}
+		for _, path_code := range slices.Sorted(maps.Keys(line.StationPaths)) {
+			line_string := orb.LineString{}
+			for _, coord := range line.StationPaths[path_code] {
+				line_string = append(line_string, orb.Point{coord.Lng, coord.Lat})
 			}
+			multi_line_string = append(multi_line_string, line_string)
 		}
-	}
 
-	csv_writer.Flush()
-	if err := csv_writer.Error(); err != nil {
-		return "", err
+		feature := geojson.NewFeature(multi_line_string)
+		feature.Properties["code"] = line.Code
+		feature.Properties["english_name"] = line.EnglishName
+		feature.Properties["simplified_name"] = line.SimplifiedName
+		feature.Properties["color"] = line.Color
+		feature_collection.Append(feature)
 	}
 
-	return buf.String(), nil
+	return json.Marshal(feature_collection)
 }
 
-func (s *MetromanServer) GenerateStopTimesTXT(city_code string) (string, error) {
+func (s *MetromanServer) GenerateStopsGeoJSON(city_code string) ([]byte, error) {
 	city, exists := s.Cities[city_code]
 	if !exists {
-		return "", fmt.Errorf("city %v not loaded", city_code)
-	}
-
-	var buf bytes.Buffer
-	csv_writer := csv.NewWriter(&buf)
-
-	if err := csv_writer.Write([]string{
-		"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence", "timepoint",
-	}); err != nil {
-		return "", err
+		return nil, fmt.Errorf("city %v not loaded", city_code)
 	}
 
-	for _, route := range city.Routes {
-		for schedule_idx, trips := range route.Trips {
-			// Sort trips
-			sorted_trips := make([]MetromanTrip, len(trips))
-			copy(sorted_trips, trips)
-			slices.SortFunc(sorted_trips, func(a MetromanTrip, b MetromanTrip) int {
-				return a.Visits[0].ArrivalAndDepartMinutes - b.Visits[0].ArrivalAndDepartMinutes
-			})
+	feature_collection := geojson.NewFeatureCollection()
 
-			for trip_idx, trip := range sorted_trips {
-				for i, station_visit := range trip.Visits {
-					// We only care about this
-					depart_hour := station_visit.ArrivalAndDepartMinutes / 60
-					depart_min := station_visit.ArrivalAndDepartMinutes % 60
-
-					trip_id := fmt.Sprintf("%s_trip_%s_%d",
-						route.Code,
-						route.Schedules[schedule_idx].Code,
-						trip_idx,
-					)
-					time_str := fmt.Sprintf("%02d:%02d:00", depart_hour, depart_min)
+	for _, station := range city.Stations {
+		// Stations without coordinates cannot be plotted
+		if station.Lat == 0 && station.Lng == 0 {
+			continue
+		}
 
-					if err := csv_writer.Write([]string{
-						trip_id,
-						time_str,
-						time_str,
-						station_visit.Station.Code,
-						fmt.Sprintf("%d", i),
-						"1", // Timepoints are considered exact
-					}); err != nil {
-						return "", err
-					}
-				}
-			}
+		lines := []string{}
+		for _, line := range city.LinesForStation(station.Code) {
+			lines = append(lines, line.Code)
 		}
-	}
 
-	csv_writer.Flush()
-	if err := csv_writer.Error(); err != nil {
-		return "", err
+		feature := geojson.NewFeature(orb.Point{station.Lng, station.Lat})
+		feature.Properties["code"] = station.Code
+		feature.Properties["english_name"] = station.EnglishName
+		feature.Properties["simplified_name"] = station.SimplifiedName
+		feature.Properties["traditional_name"] = station.TraditionalName
+		feature.Properties["lines"] = lines
+		feature_collection.Append(feature)
 	}
 
-	return buf.String(), nil
+	return json.Marshal(feature_collection)
 }
@@ -0,0 +1,2343 @@
+package metroman_client
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"tgrcode.com/baidu_client"
+	"tgrcode.com/china_gtfs/common"
+)
+
+// testdata/xx holds a small made up city laid out like a MetroMan zip: two metro lines meeting at
+// Charlie, one walking way between Bravo and Delta, and weekday/weekend schedules
+const test_city_code = "xx"
+const test_zip_prefix = "20250615"
+
+func newTestServer() *MetromanServer {
+	return &MetromanServer{
+		CityZips:      map[string][]byte{},
+		Cities:        map[string]*MetromanCity{},
+		ZipDateLookup: map[string]string{test_city_code: test_zip_prefix},
+		ChinaHandler:  &common.ChinaHandler{},
+	}
+}
+
+// The fixture as a MapFS, files in overrides (named without the prefix) replace or add to it and an
+// empty value removes the file
+func testCityFS(t testing.TB, overrides map[string]string) fstest.MapFS {
+	t.Helper()
+
+	fsys := fstest.MapFS{}
+	err := fs.WalkDir(os.DirFS("testdata/xx"), ".", func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		contents, err := os.ReadFile(path.Join("testdata/xx", file_path))
+		if err != nil {
+			return err
+		}
+		fsys[file_path] = &fstest.MapFile{Data: contents}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read fixture: %v", err)
+	}
+
+	for filename, contents := range overrides {
+		file_path := path.Join(test_zip_prefix, filename)
+		if contents == "" {
+			delete(fsys, file_path)
+			continue
+		}
+		fsys[file_path] = &fstest.MapFile{Data: []byte(contents)}
+	}
+
+	return fsys
+}
+
+// A fixture file as stored, to derive overrides from
+func fixtureFile(t testing.TB, filename string) string {
+	t.Helper()
+
+	contents, err := os.ReadFile(path.Join("testdata/xx", test_zip_prefix, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// Join lines the way MetroMan does, CRLF terminated
+func crlf(lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Load the fixture (with overrides) into s as test_city_code
+func loadTestCity(t testing.TB, s *MetromanServer, overrides map[string]string) *MetromanCity {
+	t.Helper()
+
+	if err := s.LoadCityFromFS(test_city_code, test_zip_prefix, testCityFS(t, overrides)); err != nil {
+		t.Fatalf("could not load fixture: %v", err)
+	}
+	return s.Cities[test_city_code]
+}
+
+// The fixture (with overrides) zipped like MetroMan does under zip_prefix
+func testCityZip(t testing.TB, zip_prefix string, overrides map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zip_writer := zip.NewWriter(&buf)
+	for file_path, file := range testCityFS(t, overrides) {
+		file_writer, err := zip_writer.Create(path.Join(zip_prefix, path.Base(file_path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file_writer.Write(file.Data)
+	}
+	if err := zip_writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Send the standard logger to a buffer for the rest of the test
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	return &output
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Serve every request made through http.DefaultTransport (like MetroMan's OSS) from handler until the test ends
+func mockTransport(t testing.TB, handler http.HandlerFunc) {
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		return recorder.Result(), nil
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+}
+
+func findRoute(t testing.TB, city *MetromanCity, route_code string) *MetromanRoute {
+	t.Helper()
+
+	for _, route := range city.Routes {
+		if route.Code == route_code {
+			return route
+		}
+	}
+	t.Fatalf("route %s not in city", route_code)
+	return nil
+}
+
+// Records of a generated CSV keyed by column name
+func readCSV(t testing.TB, contents string) []map[string]string {
+	t.Helper()
+
+	records, err := csv.NewReader(strings.NewReader(contents)).ReadAll()
+	if err != nil {
+		t.Fatalf("could not parse generated CSV: %v", err)
+	}
+	if len(records) == 0 {
+		t.Fatalf("generated CSV has no header")
+	}
+
+	rows := []map[string]string{}
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, column := range records[0] {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// The walking way given a timetable, as if it were mislabeled
+func scheduledWalkingWayOverrides() map[string]string {
+	return map[string]string{
+		"wayschedule.csv": crlf("XXMW01,0,WD,WE", "XXMW02,0,WD,WE", "XXMW03,0,WD,WE", "XXMW04,0,WD,WE", "XXWW01,0,WD"),
+		"XXWW01.csv":      crlf("500,505", "560,565"),
+	}
+}
+
+func TestFindSuspectedMislabelsWalkingRouteWithSchedule(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, scheduledWalkingWayOverrides())
+
+	walking_route := findRoute(t, city, "XXWW01")
+	if len(walking_route.Trips) == 0 {
+		t.Fatalf("XXWW01 has no trips, the fixture schedule was not read")
+	}
+
+	mislabels := FindSuspectedMislabels(city.Routes)
+	if len(mislabels) != 1 || !strings.Contains(mislabels[0], "walking route XXWW01 may be transit") {
+		t.Fatalf("expected only XXWW01 to be flagged, got %q", mislabels)
+	}
+	if IsTransitRoute(walking_route) {
+		t.Errorf("XXWW01 is labeled walking and should stay out of the feed")
+	}
+}
+
+func TestFindSuspectedMislabelsFixture(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, nil)
+
+	if mislabels := FindSuspectedMislabels(city.Routes); len(mislabels) != 0 {
+		t.Errorf("expected no mislabels in the fixture, got %q", mislabels)
+	}
+}
+
+func TestReverseRouteShapeIsReversed(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	shapes_txt, err := s.GenerateShapesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trips_txt, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shape_points := map[string][]string{}
+	for _, row := range readCSV(t, shapes_txt) {
+		shape_points[row["shape_id"]] = append(shape_points[row["shape_id"]], row["shape_pt_lat"]+","+row["shape_pt_lon"])
+	}
+
+	// Paths are only stored from Alpha towards Charlie, XXMW02 runs the other way
+	forward := shape_points["shape_XXMW01"]
+	reverse := shape_points["shape_XXMW02"]
+	if len(forward) == 0 || len(forward) != len(reverse) {
+		t.Fatalf("expected shapes of equal length, got %d and %d points", len(forward), len(reverse))
+	}
+	for i := range forward {
+		if forward[i] != reverse[len(reverse)-1-i] {
+			t.Fatalf("point %d of shape_XXMW02 is %s, expected %s", i, reverse[len(reverse)-1-i], forward[i])
+		}
+	}
+
+	for _, row := range readCSV(t, trips_txt) {
+		if row["route_id"] == "XXMW02" && row["shape_id"] != "shape_XXMW02" {
+			t.Errorf("trip %s of XXMW02 uses shape %s", row["trip_id"], row["shape_id"])
+		}
+	}
+}
+
+func TestGenerateAgencyWithoutBaiduMapping(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	// No Baidu server at all, then one that knows no city
+	for _, baidu_server := range []*baidu_client.BaiduServer{nil, {}} {
+		s.BaiduServer = baidu_server
+
+		agency := readCSV(t, s.GenerateAgencyTXT(test_city_code, GenerateOptions{}))
+		if len(agency) != 1 || agency[0]["agency_name"] != "China-GTFS xx" {
+			t.Errorf("expected the agency to fall back to the city code, got %v", agency)
+		}
+	}
+}
+
+func TestGenerateStopsGeoJSON(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, nil)
+
+	stops_geojson, err := s.GenerateStopsGeoJSON(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var feature_collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Type     string `json:"type"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(stops_geojson, &feature_collection); err != nil {
+		t.Fatalf("stops GeoJSON is not valid JSON: %v", err)
+	}
+
+	if feature_collection.Type != "FeatureCollection" {
+		t.Errorf("expected a FeatureCollection, got %q", feature_collection.Type)
+	}
+	if len(feature_collection.Features) != len(city.Stations) {
+		t.Fatalf("expected one feature per station (%d), got %d", len(city.Stations), len(feature_collection.Features))
+	}
+
+	for i, feature := range feature_collection.Features {
+		station := city.Stations[i]
+		if feature.Type != "Feature" || feature.Geometry.Type != "Point" {
+			t.Errorf("feature %d is a %s of %s, expected a Feature of Point", i, feature.Type, feature.Geometry.Type)
+		}
+		if feature.Properties["code"] != station.Code {
+			t.Errorf("feature %d is %v, expected %s", i, feature.Properties["code"], station.Code)
+		}
+		// GeoJSON is longitude first
+		if len(feature.Geometry.Coordinates) != 2 || feature.Geometry.Coordinates[0] != station.Lng || feature.Geometry.Coordinates[1] != station.Lat {
+			t.Errorf("feature %d is at %v, expected [%v %v]", i, feature.Geometry.Coordinates, station.Lng, station.Lat)
+		}
+	}
+}
+
+func TestDownloadCityRefreshesStaleZipDate(t *testing.T) {
+	const stale_zip_date = "20250101"
+	city_zip := testCityZip(t, test_zip_prefix, nil)
+
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/metromanandroid/v202005/version.txt":
+			fmt.Fprintf(w, "xx,%s,1\n", test_zip_prefix)
+		case fmt.Sprintf("/app/metromanandroid/v202005/xx/%s.zip", test_zip_prefix):
+			w.Write(city_zip)
+		default:
+			// OSS answers stale dates like missing files
+			http.NotFound(w, r)
+		}
+	})
+
+	s := newTestServer()
+	s.SetVersions(map[string]string{test_city_code: stale_zip_date})
+
+	if err := s.LoadCity(test_city_code); err != nil {
+		t.Fatalf("expected the refreshed date to load: %v", err)
+	}
+	if zip_date, _ := s.GetCityVersion(test_city_code); zip_date != test_zip_prefix {
+		t.Errorf("expected version %s after the refresh, got %s", test_zip_prefix, zip_date)
+	}
+	if len(s.Cities[test_city_code].Stations) == 0 {
+		t.Errorf("city loaded without stations")
+	}
+}
+
+// Run with -race, RefreshVersions swaps the lookup while generation reads it
+func TestRefreshVersionsWhileReading(t *testing.T) {
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "xx,%s,1\n", test_zip_prefix)
+	})
+
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	var wait_group sync.WaitGroup
+	for range 4 {
+		wait_group.Add(2)
+		go func() {
+			defer wait_group.Done()
+			for range 20 {
+				if err := s.RefreshVersions(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wait_group.Done()
+			for range 20 {
+				if _, err := s.GetCityVersion(test_city_code); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.GenerateFeedInfoTXT(test_city_code); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wait_group.Wait()
+}
+
+func TestServiceWindow(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	calendar_txt, _, err := s.GenerateCalendarTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed_info_txt, err := s.GenerateFeedInfoTXT(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fixture's holidays are all in 2025, service continues past them
+	calendar := readCSV(t, calendar_txt)
+	if len(calendar) != 2 {
+		t.Fatalf("expected the WD and WE schedules, got %v", calendar)
+	}
+	for _, row := range calendar {
+		if row["start_date"] != "20250101" || row["end_date"] != "99991231" {
+			t.Errorf("schedule %s runs %s to %s, expected 20250101 to 99991231", row["service_id"], row["start_date"], row["end_date"])
+		}
+	}
+
+	feed_info := readCSV(t, feed_info_txt)
+	if len(feed_info) != 1 || feed_info[0]["feed_start_date"] != "20250101" || feed_info[0]["feed_end_date"] != "99991231" {
+		t.Errorf("expected feed_info.txt to cover 20250101 to 99991231, got %v", feed_info)
+	}
+	if feed_info[0]["feed_version"] != test_zip_prefix {
+		t.Errorf("expected feed_version %s, got %s", test_zip_prefix, feed_info[0]["feed_version"])
+	}
+
+	// Without holidays nothing dates the schedules
+	loadTestCity(t, s, map[string]string{"holiday.csv": "\r\n"})
+	start_date, end_date, err := s.GetServiceWindow(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FormatDate(start_date) != "20000101" || FormatDate(end_date) != "99991231" {
+		t.Errorf("expected an open window without holidays, got %s to %s", FormatDate(start_date), FormatDate(end_date))
+	}
+}
+
+func TestDuplicateStationCodesAreNamespaced(t *testing.T) {
+	s := newTestServer()
+	// Golf is listed with Foxtrot's code
+	city := loadTestCity(t, s, map[string]string{
+		"uno.csv": strings.Replace(fixtureFile(t, "uno.csv"), "XXMS07<,>MS", "XXMS06<,>MS", 1),
+	})
+
+	if city.Stations[5].Code != "XXMS06" || city.Stations[6].Code != "XXMS06_6" {
+		t.Fatalf("expected XXMS06 and XXMS06_6, got %s and %s", city.Stations[5].Code, city.Stations[6].Code)
+	}
+	// Lookups by the original code keep resolving to the first station
+	if city.StationsByCode["XXMS06"].EnglishName != "Foxtrot" || city.StationsByCode["XXMS06_6"].EnglishName != "Golf" {
+		t.Errorf("codes resolve to %s and %s", city.StationsByCode["XXMS06"].EnglishName, city.StationsByCode["XXMS06_6"].EnglishName)
+	}
+
+	stops_txt, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{IncludeUnservedStations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop_names := map[string]string{}
+	for _, row := range readCSV(t, stops_txt) {
+		stop_names[row["stop_id"]] = row["stop_name"]
+	}
+	if stop_names["XXMS06"] != "Foxtrot" || stop_names["XXMS06_6"] != "Golf" {
+		t.Errorf("expected distinct stops for Foxtrot and Golf, got %v", stop_names)
+	}
+}
+
+func TestStopTimesOnlyForTripsRoutes(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, scheduledWalkingWayOverrides())
+
+	routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trips_txt, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	route_ids := map[string]bool{}
+	for _, row := range readCSV(t, routes_txt) {
+		route_ids[row["route_id"]] = true
+	}
+	trip_ids := map[string]bool{}
+	for _, row := range readCSV(t, trips_txt) {
+		if !route_ids[row["route_id"]] {
+			t.Errorf("trip %s is for route %s, which is not in routes.txt", row["trip_id"], row["route_id"])
+		}
+		trip_ids[row["trip_id"]] = true
+	}
+	for _, row := range readCSV(t, stop_times_txt) {
+		if !trip_ids[row["trip_id"]] {
+			t.Errorf("stop_times.txt has trip %s, which is not in trips.txt", row["trip_id"])
+		}
+	}
+
+	// The walking way has trips of its own but is not transit
+	if route_ids["XXWW01"] || len(route_ids) != 4 {
+		t.Errorf("expected only the 4 metro routes, got %v", route_ids)
+	}
+	if strings.Contains(stop_times_txt, "XXWW01") {
+		t.Errorf("stop_times.txt has rows for the walking way")
+	}
+}
+
+func TestDisableCoordinateCorrection(t *testing.T) {
+	s := newTestServer()
+	corrected_city := loadTestCity(t, s, nil)
+
+	s.DisableCoordinateCorrection = true
+	raw_city := loadTestCity(t, s, nil)
+
+	for i, station := range raw_city.Stations {
+		if station.Lat != station.RawLat || station.Lng != station.RawLng {
+			t.Errorf("%s moved to %v,%v from %v,%v without correction", station.Code, station.Lat, station.Lng, station.RawLat, station.RawLng)
+		}
+		// GCJ-02 is offset by hundreds of meters around Beijing
+		corrected_station := corrected_city.Stations[i]
+		if corrected_station.Lat == corrected_station.RawLat || corrected_station.Lng == corrected_station.RawLng {
+			t.Errorf("%s was not corrected by default", corrected_station.Code)
+		}
+	}
+
+	// Paths are kept as-is too
+	if alpha := raw_city.Lines[0].StationPaths["XXMS01_XXMS02"][0]; alpha.Lat != 39.9 || alpha.Lng != 116.35 {
+		t.Errorf("expected the raw path to start at 39.9,116.35, got %v,%v", alpha.Lat, alpha.Lng)
+	}
+}
+
+func TestGetCityHolidaysAndSchedules(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	holidays, err := s.GetCityHolidays(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As listed in holiday.csv
+	if len(holidays) != 3 || holidays[0] != (MetromanDate{Year: 2025, Month: 10, Day: 1}) {
+		t.Errorf("expected 3 holidays starting with 2025-10-01, got %v", holidays)
+	}
+	// A copy, callers cannot change the city
+	holidays[0].Year = 1999
+	if s.Cities[test_city_code].Holidays[0].Year != 2025 {
+		t.Errorf("GetCityHolidays returned the city's own slice")
+	}
+
+	schedules, err := s.GetCitySchedules(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedules["WD"].DaysOfWeek != [7]int{1, 1, 1, 1, 1, 0, 0} || schedules["WD"].Holidays {
+		t.Errorf("unexpected WD schedule %+v", schedules["WD"])
+	}
+	if schedules["WE"].DaysOfWeek != [7]int{0, 0, 0, 0, 0, 1, 1} || !schedules["WE"].Holidays {
+		t.Errorf("unexpected WE schedule %+v", schedules["WE"])
+	}
+
+	if _, err := s.GetCityHolidays("zz"); err == nil {
+		t.Errorf("expected an error for a city that is not loaded")
+	}
+}
+
+func TestTripIDsMatchBetweenFiles(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	// Dropping the 03:00 trip must not shift the ids of the rest
+	for _, service_hours := range []*MetromanServiceHours{nil, {StartMinutes: 300, EndMinutes: 1500}} {
+		s.ServiceHours = service_hours
+
+		trips_txt, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trip_ids := []string{}
+		for _, row := range readCSV(t, trips_txt) {
+			trip_ids = append(trip_ids, row["trip_id"])
+		}
+		stop_time_trip_ids := []string{}
+		for _, row := range readCSV(t, stop_times_txt) {
+			if len(stop_time_trip_ids) == 0 || stop_time_trip_ids[len(stop_time_trip_ids)-1] != row["trip_id"] {
+				stop_time_trip_ids = append(stop_time_trip_ids, row["trip_id"])
+			}
+		}
+		if !slices.Equal(trip_ids, stop_time_trip_ids) {
+			t.Errorf("trips.txt has %v but stop_times.txt has %v", trip_ids, stop_time_trip_ids)
+		}
+
+		// Named after where and when each trip starts, like the short turn from Delta
+		if !slices.Contains(trip_ids, "XXMW03_trip_WD_XXMS04_0445") {
+			t.Errorf("expected trip XXMW03_trip_WD_XXMS04_0445, got %v", trip_ids)
+		}
+	}
+}
+
+func TestStationsSharingSimplifiedNameAreKept(t *testing.T) {
+	// Golf is given Foxtrot's simplified name, like two stations of the same name on different lines
+	overrides := map[string]string{
+		"uno.csv": strings.Replace(fixtureFile(t, "uno.csv"), "Golf<,>高尔夫", "Golf<,>狐步", 1),
+	}
+
+	s := newTestServer()
+	city := loadTestCity(t, s, overrides)
+
+	stations := city.StationsByName["狐步"]
+	if len(stations) != 2 || stations[0].Code != "XXMS06" || stations[1].Code != "XXMS07" {
+		t.Fatalf("expected Foxtrot and Golf under 狐步, got %v", stations)
+	}
+
+	// Keys that include the code never collide
+	s.StationKeyStrategy = STATION_KEY_COMPOSITE
+	city = loadTestCity(t, s, overrides)
+	if len(city.StationsByName["狐步_XXMS06"]) != 1 || len(city.StationsByName["狐步_XXMS07"]) != 1 {
+		t.Errorf("expected one station per composite key, got %v", city.StationsByName)
+	}
+	if len(city.StationsByName) != len(city.Stations) {
+		t.Errorf("expected %d keys, got %d", len(city.Stations), len(city.StationsByName))
+	}
+}
+
+func TestGetFareMatrices(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	fare_matrices, err := s.GetFareMatrices(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fare_matrices) != 1 {
+		t.Fatalf("expected 1 fare matrix, got %d", len(fare_matrices))
+	}
+
+	// Alpha to Charlie and Alpha to Foxtrot, see fare_1.csv
+	fare_matrix := fare_matrices[0]
+	alpha := slices.Index(fare_matrix.StationCodes, "XXMS01")
+	charlie := slices.Index(fare_matrix.StationCodes, "XXMS03")
+	foxtrot := slices.Index(fare_matrix.StationCodes, "XXMS06")
+	if alpha == -1 || charlie == -1 || foxtrot == -1 {
+		t.Fatalf("missing stations in %v", fare_matrix.StationCodes)
+	}
+	if fare := fare_matrix.Fares[alpha][charlie]; fare != 3 {
+		t.Errorf("expected Alpha to Charlie to cost 3, got %d", fare)
+	}
+	if fare := fare_matrix.Fares[alpha][foxtrot]; fare != 4 {
+		t.Errorf("expected Alpha to Foxtrot to cost 4, got %d", fare)
+	}
+
+	fares_csv, err := s.GenerateFareMatrixCSV(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fares_csv, "0,XXMS01,XXMS06,4\n") {
+		t.Errorf("expected an Alpha to Foxtrot row in:\n%s", fares_csv)
+	}
+
+	if _, err := s.GetFareMatrices("zz"); err == nil {
+		t.Errorf("expected an unloaded city to fail")
+	}
+}
+
+func TestFixedPriceFareWithUnknownStationsIsSkipped(t *testing.T) {
+	// A second, fixed-price fare over stations the city does not have
+	fare_csv := strings.TrimRight(fixtureFile(t, "fare.csv"), "\r\n")
+	city := loadTestCity(t, newTestServer(), map[string]string{
+		"fare.csv": crlf(fare_csv, "2,XXMW03|XXMW04,5,,XXMS98|XXMS99"),
+	})
+
+	if len(city.FareMatrices) != 1 || len(city.FareMatrixStations) != 1 {
+		t.Fatalf("expected only the fare_1.csv matrix, got %d", len(city.FareMatrices))
+	}
+	if len(*city.FareMatrices[0]) != len(city.FareMatrixStations[0]) {
+		t.Errorf("matrix does not match its %d stations", len(city.FareMatrixStations[0]))
+	}
+}
+
+func TestFareModeFollowsCrossDistance(t *testing.T) {
+	// Every journey costs 3
+	s := newTestServer()
+	loadTestCity(t, s, map[string]string{
+		"fare.csv": crlf("1,XXMW01|XXMW02|XXMW03|XXMW04,3,,XXMS01|XXMS02|XXMS03|XXMS04|XXMS05|XXMS06"),
+	})
+
+	if fare_mode, fixed_price := s.GetFareMode(test_city_code); fare_mode != FARE_MODE_FIXED || fixed_price != 3 {
+		t.Fatalf("expected a fixed fare of 3, got %v %d", fare_mode, fixed_price)
+	}
+
+	// Baidu marks the city as distance-based
+	baidu_server := &baidu_client.BaiduServer{
+		CityUIDMappingsByMetromanCode: map[string]baidu_client.CityUIDMapping{
+			test_city_code: {BaiduID: "999", MetromanCode: test_city_code},
+		},
+	}
+	if err := json.Unmarshal([]byte(`{"subways_city": {"cities": [{"code": 999, "cxfDis": 1}]}}`), &baidu_server.BaiduSubwayCities); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBaiduServer(baidu_server)
+
+	if cross_distance, ok := s.BaiduServer.GetCityCrossDistance(test_city_code); !ok || cross_distance != 1 {
+		t.Fatalf("expected cxfDis 1, got %d %v", cross_distance, ok)
+	}
+	if fare_mode, _ := s.GetFareMode(test_city_code); fare_mode != FARE_MODE_DISTANCE {
+		t.Errorf("expected cxfDis to select distance fares, got %v", fare_mode)
+	}
+}
+
+func TestStopCodeStableAcrossVersions(t *testing.T) {
+	stopCodes := func(overrides map[string]string) map[string]string {
+		s := newTestServer()
+		loadTestCity(t, s, overrides)
+
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_codes := map[string]string{}
+		for _, stop := range readCSV(t, stops_txt) {
+			stop_codes[stop["stop_id"]] = stop["stop_code"]
+		}
+		return stop_codes
+	}
+
+	old_stop_codes := stopCodes(nil)
+	// The next version renames Bravo and adds Hotel, neither may shift the other codes
+	new_stop_codes := stopCodes(map[string]string{
+		"uno.csv": strings.Replace(
+			strings.Replace(fixtureFile(t, "uno.csv"), "Bravo<,>布拉沃<,>", "Bravo North<,>布拉沃北<,>", 1),
+			"XXML01<,>", "XXMS08<,>MS<,>Hotel<,>酒店<,>酒店<,>ホテル<,>Hot<,>酒<,>39.9500<,>116.3900<,>300<,>600\r\nXXML01<,>", 1),
+	})
+
+	if old_stop_codes["XXMS01"] != "01" {
+		t.Errorf("expected the city and type prefix to be stripped, got %q", old_stop_codes["XXMS01"])
+	}
+	for stop_id, stop_code := range old_stop_codes {
+		if new_stop_codes[stop_id] != stop_code {
+			t.Errorf("%s changed stop_code from %q to %q", stop_id, stop_code, new_stop_codes[stop_id])
+		}
+	}
+}
+
+func TestServiceHoursExcludeDepotMove(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	generate := func() ([]map[string]string, []map[string]string) {
+		trips_txt, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readCSV(t, trips_txt), readCSV(t, stop_times_txt)
+	}
+	hasDepotMove := func(stop_times []map[string]string) bool {
+		return slices.ContainsFunc(stop_times, func(stop_time map[string]string) bool {
+			return stop_time["departure_time"] == "03:00:00"
+		})
+	}
+
+	all_trips, all_stop_times := generate()
+	if !hasDepotMove(all_stop_times) {
+		t.Fatalf("expected the 03:00 trip on XXMW03 without a window")
+	}
+
+	// 04:00 to 01:30 the next day
+	s.ServiceHours = &MetromanServiceHours{StartMinutes: 4 * 60, EndMinutes: 25*60 + 30}
+	trips, stop_times := generate()
+	if hasDepotMove(stop_times) {
+		t.Errorf("expected the 03:00 trip to be excluded")
+	}
+	if len(trips) != len(all_trips)-1 {
+		t.Errorf("expected exactly one trip to be dropped, went from %d to %d", len(all_trips), len(trips))
+	}
+
+	// After midnight is still inside the window
+	late_trip := MetromanTrip{Visits: []MetromanStationVisit{{ArrivalAndDepartMinutes: 23*60 + 50}, {ArrivalAndDepartMinutes: 30}}}
+	if kept_trips := s.FilterServiceHours([]MetromanTrip{late_trip}); len(kept_trips) != 1 {
+		t.Errorf("expected a trip ending at 00:30 to be kept")
+	}
+}
+
+func TestGetTripTimetable(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	timetable, err := s.GetTripTimetable(test_city_code, "XXMW01_trip_WD_XXMS01_0360")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timetable.RouteCode != "XXMW01" || timetable.ScheduleCode != "WD" || timetable.Departure != "06:00" {
+		t.Errorf("unexpected trip %+v", timetable)
+	}
+
+	stops := []string{}
+	for _, stop := range timetable.Stops {
+		stops = append(stops, stop.StationCode+" "+stop.Time)
+	}
+	expected_stops := []string{"XXMS01 06:00:00", "XXMS02 06:03:00", "XXMS03 06:06:00"}
+	if !slices.Equal(stops, expected_stops) {
+		t.Errorf("expected stops %v, got %v", expected_stops, stops)
+	}
+
+	if _, err := s.GetTripTimetable(test_city_code, "XXMW01_trip_WD_XXMS01_0361"); err == nil {
+		t.Errorf("expected an unknown trip to fail")
+	}
+}
+
+func TestDeparturesSortedAfterTime(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	// Bravo on a Monday from 06:10
+	after_minutes := 6*60 + 10
+	all_departures, err := s.GetDepartures(test_city_code, "XXMS02", MetromanDate{2025, 6, 16}, after_minutes, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all_departures) != 2 {
+		t.Fatalf("expected a direction each way on line 1, got %+v", all_departures)
+	}
+
+	for _, departures := range all_departures {
+		if len(departures.Departures) == 0 {
+			t.Errorf("%s has no departures", departures.RouteCode)
+		}
+		for i, departure := range departures.Departures {
+			if departure.Minutes < after_minutes {
+				t.Errorf("%s departs at %s, before 06:10", departure.TripID, departure.Time)
+			}
+			if i > 0 && departure.Minutes < departures.Departures[i-1].Minutes {
+				t.Errorf("%s departures are not sorted: %+v", departures.RouteCode, departures.Departures)
+			}
+		}
+	}
+
+	// The 06:03 from Alpha has left
+	if first := all_departures[0].Departures[0]; all_departures[0].RouteCode != "XXMW01" || first.Time != "07:03:00" {
+		t.Errorf("expected the next train towards Charlie at 07:03:00, got %s %+v", all_departures[0].RouteCode, first)
+	}
+}
+
+func TestSchedulesForDateHolidayOverridesWeekday(t *testing.T) {
+	city := loadTestCity(t, newTestServer(), nil)
+
+	scheduleCodes := func(date MetromanDate) []string {
+		schedule_codes := []string{}
+		for _, schedule := range city.SchedulesForDate(date) {
+			schedule_codes = append(schedule_codes, schedule.Code)
+		}
+		return schedule_codes
+	}
+
+	// October 7th 2025 is a Tuesday holiday, the 14th an ordinary Tuesday
+	if schedule_codes := scheduleCodes(MetromanDate{2025, 10, 7}); !slices.Equal(schedule_codes, []string{"WE"}) {
+		t.Errorf("expected only the holiday schedule on a Tuesday holiday, got %v", schedule_codes)
+	}
+	if schedule_codes := scheduleCodes(MetromanDate{2025, 10, 14}); !slices.Equal(schedule_codes, []string{"WD"}) {
+		t.Errorf("expected the weekday schedule on a Tuesday, got %v", schedule_codes)
+	}
+	if schedule_codes := scheduleCodes(MetromanDate{2025, 10, 11}); !slices.Equal(schedule_codes, []string{"WE"}) {
+		t.Errorf("expected the weekend schedule on a Saturday, got %v", schedule_codes)
+	}
+}
+
+func TestFirstLastTrainAtTerminal(t *testing.T) {
+	city := loadTestCity(t, newTestServer(), nil)
+
+	// Line 2 only departs Foxtrot towards Charlie, XXMW03 trips end there
+	first_last_trains, err := city.FirstLastTrain("XXMS06", "WD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_trains := []MetromanFirstLastTrain{{RouteCode: "XXMW04", Headsign: "Charlie", FirstMinutes: 6*60 + 15, LastMinutes: 7*60 + 15}}
+	if !slices.Equal(first_last_trains, expected_trains) {
+		t.Errorf("expected %+v at Foxtrot, got %+v", expected_trains, first_last_trains)
+	}
+
+	// Fewer trains run on holidays
+	first_last_trains, err = city.FirstLastTrain("XXMS01", "WE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_trains = []MetromanFirstLastTrain{{RouteCode: "XXMW01", Headsign: "Charlie", FirstMinutes: 6*60 + 30, LastMinutes: 7*60 + 30}}
+	if !slices.Equal(first_last_trains, expected_trains) {
+		t.Errorf("expected %+v at Alpha, got %+v", expected_trains, first_last_trains)
+	}
+
+	if _, err := city.FirstLastTrain("XXMS06", "SU"); err == nil {
+		t.Errorf("expected an unknown schedule to fail")
+	}
+}
+
+func TestLoadCityFromDir(t *testing.T) {
+	s := newTestServer()
+	if err := s.LoadCityFromDir(test_city_code, test_zip_prefix, "testdata/xx"); err != nil {
+		t.Fatal(err)
+	}
+
+	city := s.Cities[test_city_code]
+	if len(city.Stations) != 7 || len(city.Lines) != 3 || len(city.Routes) != 5 {
+		t.Errorf("expected 7 stations, 3 lines and 5 routes, got %d, %d and %d", len(city.Stations), len(city.Lines), len(city.Routes))
+	}
+	if station := city.StationsByCode["XXMS01"]; station == nil || station.EnglishName != "Alpha" {
+		t.Errorf("expected XXMS01 to be Alpha, got %+v", station)
+	}
+
+	// The zip prefix is a directory inside dir
+	if err := newTestServer().LoadCityFromDir(test_city_code, "20250101", "testdata/xx"); err == nil {
+		t.Errorf("expected a missing zip prefix to fail")
+	}
+}
+
+func TestParseCityFromMapFS(t *testing.T) {
+	// Same parse from memory as from the zip MetroMan serves
+	s := newTestServer()
+	if err := s.LoadCityFromFS(test_city_code, test_zip_prefix, testCityFS(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+	map_fs_stops, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zip_city, err := s.LoadCityInternal(test_zip_prefix, testCityZip(t, test_zip_prefix, nil), test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Cities[test_city_code] = zip_city
+	zip_stops, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if map_fs_stops != zip_stops {
+		t.Errorf("stops.txt differs between fstest.MapFS and zip:\n%s\n%s", map_fs_stops, zip_stops)
+	}
+
+	// Required files are read through the same FS
+	err = newTestServer().LoadCityFromFS(test_city_code, test_zip_prefix, testCityFS(t, map[string]string{"uno.csv": ""}))
+	if err == nil || !strings.Contains(err.Error(), "20250615/uno.csv") {
+		t.Errorf("expected a missing uno.csv to be reported, got %v", err)
+	}
+}
+
+// A bus line from Alpha to Delta with its route and weekday timetable, MetroMan's metro data has no stops of
+// its own for them
+func busLineOverrides(t testing.TB) map[string]string {
+	return map[string]string{
+		"uno.csv": fixtureFile(t, "uno.csv") + crlf(
+			"XXBL01<,>BL<,>Bus 1<,>1路<,>1路<,>1路<,><,>1<,><,><,><,><,>#00A651",
+			"XXBW01<,>BW<,>Bus 1 (Alpha - Delta)<,>1路(阿尔法-德尔塔)<,>1路(阿尔法-德尔塔)<,>1路(阿尔法-德尔塔)",
+		),
+		"line.csv":        fixtureFile(t, "line.csv") + crlf("XXBL01,0,3"),
+		"way.csv":         fixtureFile(t, "way.csv") + crlf("XXBW01,3,0,0,3"),
+		"wayschedule.csv": fixtureFile(t, "wayschedule.csv") + crlf("XXBW01,0,WD"),
+		"XXBW01.csv":      crlf("400,410", "460,470"),
+	}
+}
+
+func TestBusLineIsSkipped(t *testing.T) {
+	output := captureLog(t)
+
+	city := loadTestCity(t, newTestServer(), busLineOverrides(t))
+
+	if len(city.Lines) != 3 || len(city.Routes) != 5 || len(city.Stations) != 7 {
+		t.Errorf("expected the bus records to be left out, got %d lines, %d routes and %d stations", len(city.Lines), len(city.Routes), len(city.Stations))
+	}
+	for _, record_type := range []string{"BL", "BW"} {
+		if !strings.Contains(output.String(), "xx: skipped 1 uno.csv records of unknown type "+record_type) {
+			t.Errorf("expected skipping %s to be logged, got:\n%s", record_type, output.String())
+		}
+	}
+	if strings.Contains(output.String(), "XXBL01") {
+		t.Errorf("expected the bus line's line.csv row to be skipped quietly, got:\n%s", output.String())
+	}
+}
+
+func TestBusLineIncluded(t *testing.T) {
+	s := newTestServer()
+	s.IncludeBusAndTram = true
+	city := loadTestCity(t, s, busLineOverrides(t))
+
+	bus_route := findRoute(t, city, "XXBW01")
+	if bus_route.Line.Code != "XXBL01" || len(bus_route.Stations) != 2 || len(bus_route.Trips) != 1 || len(bus_route.Trips[0]) != 2 {
+		t.Fatalf("expected the bus route from Alpha to Delta with 2 trips, got %+v", bus_route)
+	}
+
+	routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route_types := map[string]string{}
+	for _, route := range readCSV(t, routes_txt) {
+		route_types[route["route_id"]] = route["route_type"]
+	}
+	if route_types["XXBW01"] != "3" || route_types["XXMW01"] != "1" {
+		t.Errorf("expected the bus route as a bus alongside the subway, got %v", route_types)
+	}
+
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(readCSV(t, stop_times_txt), func(stop_time map[string]string) bool {
+		return stop_time["trip_id"] == "XXBW01_trip_WD_XXMS01_0400" && stop_time["stop_id"] == "XXMS04" && stop_time["arrival_time"] == "06:50:00"
+	}) {
+		t.Errorf("expected the 06:40 bus to reach Delta at 06:50:\n%s", stop_times_txt)
+	}
+}
+
+func TestCalendarIsByteStable(t *testing.T) {
+	generate := func() (string, string) {
+		// Reload so map iteration order gets a fresh chance to differ
+		s := newTestServer()
+		loadTestCity(t, s, nil)
+
+		calendar_txt, calendar_dates_txt, err := s.GenerateCalendarTXT(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return calendar_txt, calendar_dates_txt
+	}
+
+	calendar_txt, calendar_dates_txt := generate()
+	for range 10 {
+		next_calendar_txt, next_calendar_dates_txt := generate()
+		if next_calendar_txt != calendar_txt || next_calendar_dates_txt != calendar_dates_txt {
+			t.Fatalf("calendar differs between generations:\n%s%s\n%s%s", calendar_txt, calendar_dates_txt, next_calendar_txt, next_calendar_dates_txt)
+		}
+	}
+
+	// holiday.csv lists 20251001 before 20250101
+	dates := []string{}
+	for _, calendar_date := range readCSV(t, calendar_dates_txt) {
+		dates = append(dates, calendar_date["service_id"]+" "+calendar_date["date"])
+	}
+	if !slices.IsSorted(dates) {
+		t.Errorf("expected calendar_dates.txt sorted by service and date, got %v", dates)
+	}
+}
+
+func TestRouteDescriptionNamesTermini(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	for _, route_descriptions := range []bool{false, true} {
+		routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{RouteDescriptions: route_descriptions})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, route := range readCSV(t, routes_txt) {
+			if !route_descriptions {
+				if route["route_desc"] != "" {
+					t.Errorf("expected no route_desc by default, got %q", route["route_desc"])
+				}
+				continue
+			}
+
+			city_route := findRoute(t, s.Cities[test_city_code], route["route_id"])
+			for _, terminus := range []*MetromanStation{city_route.Stations[0], city_route.Stations[len(city_route.Stations)-1]} {
+				if !strings.Contains(route["route_desc"], terminus.EnglishName) {
+					t.Errorf("%s: route_desc %q does not name %s", route["route_id"], route["route_desc"], terminus.EnglishName)
+				}
+			}
+		}
+	}
+}
+
+func TestTripAccessibilityColumns(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	for _, test := range []struct {
+		opts                  GenerateOptions
+		wheelchair_accessible string
+		bikes_allowed         string
+	}{
+		{GenerateOptions{}, "0", "0"},
+		{GenerateOptions{WheelchairAccessible: TRIP_ACCESSIBILITY_YES, BikesAllowed: TRIP_ACCESSIBILITY_NO}, "1", "2"},
+	} {
+		trips_txt, err := s.GenerateTripsTXT(test_city_code, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trips := readCSV(t, trips_txt)
+		if len(trips) == 0 {
+			t.Fatalf("trips.txt has no trips")
+		}
+		for _, trip := range trips {
+			if trip["wheelchair_accessible"] != test.wheelchair_accessible || trip["bikes_allowed"] != test.bikes_allowed {
+				t.Errorf("%s: expected wheelchair_accessible %s and bikes_allowed %s, got %q and %q", trip["trip_id"],
+					test.wheelchair_accessible, test.bikes_allowed, trip["wheelchair_accessible"], trip["bikes_allowed"])
+				break
+			}
+		}
+	}
+}
+
+func TestSparseTimesLeaveIntermediateStopsBlank(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, nil)
+
+	// Only Alpha and Charlie are timed, Bravo lies between them
+	route := findRoute(t, city, "XXMW01")
+	route.Trips[0] = []MetromanTrip{{Visits: []MetromanStationVisit{
+		{Station: city.StationsByCode["XXMS01"], ArrivalAndDepartMinutes: 360},
+		{Station: city.StationsByCode["XXMS03"], ArrivalAndDepartMinutes: 366},
+	}}}
+
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop_times := []string{}
+	for _, stop_time := range readCSV(t, stop_times_txt) {
+		if stop_time["trip_id"] == "XXMW01_trip_WD_XXMS01_0360" {
+			stop_times = append(stop_times, strings.Join([]string{stop_time["stop_sequence"], stop_time["stop_id"], stop_time["arrival_time"], stop_time["departure_time"], stop_time["timepoint"]}, " "))
+		}
+	}
+	expected_stop_times := []string{
+		"0 XXMS01 06:00:00 06:00:00 1",
+		"1 XXMS02   0",
+		"2 XXMS03 06:06:00 06:06:00 1",
+	}
+	if !slices.Equal(stop_times, expected_stop_times) {
+		t.Errorf("expected stop_times %q, got %q", expected_stop_times, stop_times)
+	}
+}
+
+func TestEstimatedTripsForRouteWithoutTimetable(t *testing.T) {
+	s := newTestServer()
+	s.EstimateMissingTrips = &MetromanTripEstimate{SpeedKmh: 36, HeadwayMinutes: 10, StartMinutes: 360, EndMinutes: 420}
+	city := loadTestCity(t, s, map[string]string{"XXMW03.csv": ""})
+
+	route := findRoute(t, city, "XXMW03")
+	if !route.EstimatedTrips || len(route.Trips) != len(route.Schedules) {
+		t.Fatalf("expected estimated trips for every schedule, got %v %d", route.EstimatedTrips, len(route.Trips))
+	}
+	// Timetabled routes are left alone
+	if findRoute(t, city, "XXMW01").EstimatedTrips {
+		t.Errorf("expected XXMW01 to keep its timetable")
+	}
+
+	// 06:00 to 07:00 every 10 minutes
+	trips := route.Trips[0]
+	if len(trips) != 7 {
+		t.Fatalf("expected 7 trips, got %d", len(trips))
+	}
+	for _, trip := range trips {
+		if len(trip.Visits) != len(route.Stations) {
+			t.Fatalf("expected every station visited, got %d visits", len(trip.Visits))
+		}
+		// Stations are about 1.1km apart, roughly 2 minutes at 36km/h
+		for i := 1; i < len(trip.Visits); i++ {
+			travel := trip.Visits[i].ArrivalAndDepartMinutes - trip.Visits[i-1].ArrivalAndDepartMinutes
+			if travel < 1 || travel > 4 {
+				t.Errorf("implausible %d minutes from %s to %s", travel, trip.Visits[i-1].Station.Code, trip.Visits[i].Station.Code)
+			}
+		}
+	}
+
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimated_stop_times := 0
+	for _, stop_time := range readCSV(t, stop_times_txt) {
+		if strings.HasPrefix(stop_time["trip_id"], "XXMW03_") {
+			estimated_stop_times++
+			if stop_time["timepoint"] != "0" {
+				t.Errorf("expected estimated times to be marked approximate, got %v", stop_time)
+			}
+		}
+	}
+	if estimated_stop_times == 0 {
+		t.Errorf("expected stop_times for the estimated trips")
+	}
+}
+
+func TestEntryFeeAddedToDistanceFares(t *testing.T) {
+	s := newTestServer()
+	s.EntryFees = map[string]int{test_city_code: 1}
+	loadTestCity(t, s, nil)
+
+	_, fare_attributes_txt, err := s.GenerateFaresTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := map[string]string{}
+	for _, fare_attribute := range readCSV(t, fare_attributes_txt) {
+		prices[fare_attribute["fare_id"]] = fare_attribute["price"]
+	}
+
+	// fare_1.csv prices plus the fee
+	for fare_id, price := range map[string]string{
+		"fare_XXMS01_XXMS02": "3",
+		"fare_XXMS01_XXMS03": "4",
+		"fare_XXMS01_XXMS06": "5",
+	} {
+		if prices[fare_id] != price {
+			t.Errorf("expected %s to cost %s, got %q", fare_id, price, prices[fare_id])
+		}
+	}
+
+	// Other cities pay the matrix price
+	if fare := s.DistanceFare("zz", 4); fare != 4 {
+		t.Errorf("expected no fee without an entry, got %d", fare)
+	}
+}
+
+func TestAttributionsNameSources(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	organizations := func(opts GenerateOptions) []string {
+		attributions_txt, err := s.GenerateAttributionsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, attribution := range readCSV(t, attributions_txt) {
+			if attribution["is_producer"] != "1" || attribution["attribution_url"] == "" {
+				t.Errorf("expected a producer with a URL, got %v", attribution)
+			}
+			names = append(names, attribution["organization_name"])
+		}
+		return names
+	}
+
+	if names := organizations(GenerateOptions{}); !slices.Equal(names, []string{"MetroMan", "China-GTFS"}) {
+		t.Errorf("expected MetroMan and China-GTFS, got %v", names)
+	}
+
+	// Baidu is credited once it supplies data
+	s.SetBaiduServer(&baidu_client.BaiduServer{})
+	if names := organizations(GenerateOptions{}); !slices.Equal(names, []string{"MetroMan", "China-GTFS", "Baidu Maps"}) {
+		t.Errorf("expected Baidu Maps to be credited, got %v", names)
+	}
+
+	// Attributions replace the defaults
+	custom := []MetromanAttribution{{OrganizationName: "Test Metro", URL: "https://example.com/", IsProducer: true}}
+	if names := organizations(GenerateOptions{Attributions: custom}); !slices.Equal(names, []string{"Test Metro"}) {
+		t.Errorf("expected only Test Metro, got %v", names)
+	}
+
+	if _, err := s.GenerateAttributionsTXT("zz", GenerateOptions{}); err == nil {
+		t.Errorf("expected an unloaded city to fail")
+	}
+}
+
+func TestAgencyIDPrefixUsedByReferences(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+	opts := GenerateOptions{AgencyIDPrefix: "cn_"}
+
+	agencies := readCSV(t, s.GenerateAgencyTXT(test_city_code, opts))
+	if len(agencies) != 1 || agencies[0]["agency_id"] != "cn_xx" {
+		t.Fatalf("expected agency cn_xx, got %v", agencies)
+	}
+
+	routes_txt, err := s.GenerateRoutesTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fare_attributes_txt, err := s.GenerateFaresTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, contents := range map[string]string{"routes.txt": routes_txt, "fare_attributes.txt": fare_attributes_txt} {
+		rows := readCSV(t, contents)
+		if len(rows) == 0 {
+			t.Fatalf("expected rows in %s", filename)
+		}
+		for _, row := range rows {
+			if row["agency_id"] != "cn_xx" {
+				t.Errorf("%s: expected agency_id cn_xx, got %v", filename, row)
+				break
+			}
+		}
+	}
+}
+
+func TestCollapseStationsReducesStops(t *testing.T) {
+	// Echo is given Delta's simplified name, like one physical station under two codes
+	s := newTestServer()
+	loadTestCity(t, s, map[string]string{
+		"uno.csv": strings.Replace(fixtureFile(t, "uno.csv"), "Echo<,>回声", "Echo<,>德尔塔", 1),
+	})
+
+	stops := func(opts GenerateOptions) map[string]map[string]string {
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stops_by_id := map[string]map[string]string{}
+		for _, stop := range readCSV(t, stops_txt) {
+			stops_by_id[stop["stop_id"]] = stop
+		}
+		return stops_by_id
+	}
+
+	separate_stops := stops(GenerateOptions{})
+	collapsed_stops := stops(GenerateOptions{CollapseStations: true})
+	if len(collapsed_stops) != len(separate_stops)-1 {
+		t.Fatalf("expected one fewer stop, got %d then %d", len(separate_stops), len(collapsed_stops))
+	}
+	if _, exists := collapsed_stops["XXMS05"]; exists {
+		t.Errorf("expected Echo to be merged into Delta")
+	}
+	// Halfway between Delta and Echo
+	if lat, _ := strconv.ParseFloat(collapsed_stops["XXMS04"]["stop_lat"], 64); lat <= 39.911 || lat >= 39.919 {
+		t.Errorf("expected the merged stop between Delta and Echo, got %v", collapsed_stops["XXMS04"])
+	}
+
+	// Visits to Echo use Delta's stop
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, GenerateOptions{CollapseStations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stop_time := range readCSV(t, stop_times_txt) {
+		if _, exists := collapsed_stops[stop_time["stop_id"]]; !exists {
+			t.Fatalf("stop_times references missing stop %s", stop_time["stop_id"])
+		}
+	}
+}
+
+func TestMetromanCodeColumn(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	stops_txt, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.SplitN(stops_txt, "\n", 2)[0], "metroman_code") {
+		t.Errorf("expected no metroman_code column by default")
+	}
+
+	stops_txt, err = s.GenerateStopsTXT(test_city_code, GenerateOptions{IDPrefix: "xx_", IncludeMetromanCodes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := readCSV(t, stops_txt)
+	if len(stops) == 0 {
+		t.Fatalf("expected stops")
+	}
+	for _, stop := range stops {
+		if "xx_"+stop["metroman_code"] != stop["stop_id"] {
+			t.Errorf("expected metroman_code to match stop %s, got %q", stop["stop_id"], stop["metroman_code"])
+		}
+	}
+}
+
+func TestEveryRouteInOneNetwork(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	networks_txt, route_networks_txt, err := s.GenerateNetworksTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network_names := map[string]string{}
+	for _, network := range readCSV(t, networks_txt) {
+		network_names[network["network_id"]] = network["network_name"]
+	}
+	expected_names := map[string]string{"network_XXML01": "Line 1", "network_XXML02": "Line 2"}
+	if !maps.Equal(network_names, expected_names) {
+		t.Errorf("expected a network per metro line %v, got %v", expected_names, network_names)
+	}
+
+	route_networks := map[string][]string{}
+	for _, route_network := range readCSV(t, route_networks_txt) {
+		route_networks[route_network["route_id"]] = append(route_networks[route_network["route_id"]], route_network["network_id"])
+	}
+	for _, route := range readCSV(t, routes_txt) {
+		network_ids := route_networks[route["route_id"]]
+		if len(network_ids) != 1 || network_names[network_ids[0]] == "" {
+			t.Errorf("expected route %s in exactly one network, got %v", route["route_id"], network_ids)
+		}
+	}
+	if len(route_networks) != 4 || route_networks["XXMW03"][0] != "network_XXML02" {
+		t.Errorf("expected the four metro routes under their lines, got %v", route_networks)
+	}
+}
+
+func TestMismatchedLineWarns(t *testing.T) {
+	output := captureLog(t)
+
+	// Line 1 lists a station uno.csv never defined and a line that doesn't exist follows
+	s := newTestServer()
+	loadTestCity(t, s, map[string]string{
+		"line.csv": crlf("XXML01,0,1,2,9", "XXML02,2,3,4,5,6", "XXWL01,1,3", "XXML09,0,1"),
+	})
+
+	stats, err := s.GetCityStats(test_city_code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_warnings := []string{
+		"line XXML01 references station index 9 but uno.csv defines 7 stations",
+		"line.csv references line XXML09 not in uno.csv",
+	}
+	if !slices.Equal(stats.LineWarnings, expected_warnings) {
+		t.Errorf("expected warnings %q, got %q", expected_warnings, stats.LineWarnings)
+	}
+	for _, warning := range expected_warnings {
+		if !strings.Contains(output.String(), "xx: "+warning) {
+			t.Errorf("expected %q to be logged, got:\n%s", warning, output)
+		}
+	}
+
+	// The fixture as shipped has no warnings
+	loadTestCity(t, s, nil)
+	if stats, _ := s.GetCityStats(test_city_code); len(stats.LineWarnings) != 0 {
+		t.Errorf("expected no warnings for the fixture, got %q", stats.LineWarnings)
+	}
+}
+
+func TestIdenticalSchedulesCollapse(t *testing.T) {
+	// Weekends run the weekday timetable
+	weekend_timetable := func(city *MetromanCity) {
+		route := findRoute(t, city, "XXMW01")
+		route.Trips[1] = route.Trips[0]
+	}
+	route_trips := func(s *MetromanServer, opts GenerateOptions) map[string][]string {
+		trips_txt, err := s.GenerateTripsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips_by_service := map[string][]string{}
+		for _, trip := range readCSV(t, trips_txt) {
+			if trip["route_id"] == "XXMW01" {
+				trips_by_service[trip["service_id"]] = append(trips_by_service[trip["service_id"]], trip["trip_id"])
+			}
+		}
+		return trips_by_service
+	}
+	opts := GenerateOptions{DeduplicateTrips: true}
+
+	// WE also runs on holidays and WD doesn't, so they can't share a service
+	s := newTestServer()
+	weekend_timetable(loadTestCity(t, s, nil))
+	if trips_by_service := route_trips(s, opts); len(trips_by_service["WD"]) != 3 || len(trips_by_service["WE"]) != 3 {
+		t.Fatalf("expected the trips under both schedules, got %v", trips_by_service)
+	}
+
+	s = newTestServer()
+	weekend_timetable(loadTestCity(t, s, map[string]string{
+		"schedule.csv": crlf("WD<,>1<,>1<,>1<,>1<,>1<,>0<,>0<,>0<,>0", "WE<,>0<,>0<,>0<,>0<,>0<,>1<,>1<,>0<,>0"),
+	}))
+	if trips_by_service := route_trips(s, GenerateOptions{}); len(trips_by_service["WD"]) != 3 || len(trips_by_service["WE"]) != 3 {
+		t.Fatalf("expected the trips under both schedules without deduplication, got %v", trips_by_service)
+	}
+	if trips_by_service := route_trips(s, opts); len(trips_by_service) != 1 || len(trips_by_service["WD+WE"]) != 3 {
+		t.Errorf("expected the trips once under WD+WE, got %v", trips_by_service)
+	}
+
+	// Routes with different weekend trips keep both schedules
+	trips_txt, err := s.GenerateTripsTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(trips_txt, "XXMW02,WE,") {
+		t.Errorf("expected XXMW02 to keep its weekend service:\n%s", trips_txt)
+	}
+
+	calendar_txt, _, err := s.GenerateCalendarTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, calendar := range readCSV(t, calendar_txt) {
+		if calendar["service_id"] == "WD+WE" {
+			found = true
+			if calendar["monday"] != "1" || calendar["saturday"] != "1" || calendar["sunday"] != "1" {
+				t.Errorf("expected WD+WE to run every day, got %v", calendar)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected a WD+WE service in calendar.txt:\n%s", calendar_txt)
+	}
+}
+
+func TestInterchangeHasMultipleLines(t *testing.T) {
+	city := loadTestCity(t, newTestServer(), nil)
+
+	line_codes := func(station_code string) []string {
+		codes := []string{}
+		for _, line := range city.LinesForStation(station_code) {
+			codes = append(codes, line.Code)
+		}
+		return codes
+	}
+	route_codes := func(station_code string) []string {
+		codes := []string{}
+		for _, route := range city.RoutesForStation(station_code) {
+			codes = append(codes, route.Code)
+		}
+		return codes
+	}
+
+	// Charlie is where lines 1 and 2 meet
+	if codes := line_codes("XXMS03"); !slices.Equal(codes, []string{"XXML01", "XXML02"}) {
+		t.Errorf("expected Charlie on XXML01 and XXML02, got %v", codes)
+	}
+	if codes := route_codes("XXMS03"); !slices.Equal(codes, []string{"XXMW01", "XXMW02", "XXMW03", "XXMW04"}) {
+		t.Errorf("expected every metro route at Charlie, got %v", codes)
+	}
+	if codes := line_codes("XXMS01"); !slices.Equal(codes, []string{"XXML01"}) {
+		t.Errorf("expected Alpha only on XXML01, got %v", codes)
+	}
+	if codes := line_codes("XXMS99"); len(codes) != 0 {
+		t.Errorf("expected no lines for an unknown station, got %v", codes)
+	}
+}
+
+func TestFareTransfersColumn(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	no_transfers := 0
+	two_transfers := 2
+	for _, test := range []struct {
+		max_fare_transfers *int
+		transfers          string
+	}{
+		{nil, ""},
+		{&no_transfers, "0"},
+		{&two_transfers, "2"},
+	} {
+		_, fare_attributes_txt, err := s.GenerateFaresTXT(test_city_code, GenerateOptions{MaxFareTransfers: test.max_fare_transfers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fare_attribute := range readCSV(t, fare_attributes_txt) {
+			if fare_attribute["transfers"] != test.transfers {
+				t.Errorf("expected transfers %q, got %v", test.transfers, fare_attribute)
+				break
+			}
+		}
+	}
+}
+
+func TestIncompleteCities(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	// A second city where line 2 lost its timetable
+	if err := s.LoadCityFromFS("yy", test_zip_prefix, testCityFS(t, map[string]string{"XXMW03.csv": ""})); err != nil {
+		t.Fatal(err)
+	}
+
+	if incomplete_cities := s.IncompleteCities(); !slices.Equal(incomplete_cities, []string{"yy"}) {
+		t.Errorf("expected only yy to be incomplete, got %v", incomplete_cities)
+	}
+
+	stats, err := s.GetCityStats("yy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MetroRoutes != 4 || stats.RoutesWithoutTrips != 1 || stats.RoutesWithoutShapes != 0 || stats.StationsWithoutCoordinates != 0 {
+		t.Errorf("expected one of 4 metro routes without trips, got %+v", stats)
+	}
+}
+
+func TestFaresBelowMinimumAreRaised(t *testing.T) {
+	s := newTestServer()
+	s.MinimumFares = map[string]int{test_city_code: 3}
+	loadTestCity(t, s, nil)
+
+	_, fare_attributes_txt, err := s.GenerateFaresTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := map[string]string{}
+	for _, fare_attribute := range readCSV(t, fare_attributes_txt) {
+		prices[fare_attribute["fare_id"]] = fare_attribute["price"]
+	}
+
+	// fare_1.csv charges 2 for neighbours, 3 and 4 are kept
+	for fare_id, price := range map[string]string{
+		"fare_XXMS01_XXMS01": "3",
+		"fare_XXMS01_XXMS02": "3",
+		"fare_XXMS01_XXMS03": "3",
+		"fare_XXMS01_XXMS06": "4",
+	} {
+		if prices[fare_id] != price {
+			t.Errorf("expected %s to cost %s, got %q", fare_id, price, prices[fare_id])
+		}
+	}
+
+	// The minimum applies after the entry fee
+	s.EntryFees = map[string]int{test_city_code: 1}
+	if fare := s.DistanceFare(test_city_code, 1); fare != 3 {
+		t.Errorf("expected 1 + 1 to be raised to 3, got %d", fare)
+	}
+	if fare := s.DistanceFare(test_city_code, 4); fare != 5 {
+		t.Errorf("expected 4 + 1 to be kept, got %d", fare)
+	}
+}
+
+func TestRouteScheduleSortedAndPlausible(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	route_schedules, err := s.GetRouteSchedule(test_city_code, "XXMW03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(route_schedules) != 2 || route_schedules[0].ScheduleCode != "WD" || route_schedules[1].ScheduleCode != "WE" {
+		t.Fatalf("expected WD and WE schedules, got %+v", route_schedules)
+	}
+
+	weekday_trips := route_schedules[0].Trips
+	// The 03:00 depot move comes first
+	if len(weekday_trips) == 0 || weekday_trips[0].Departure != "03:00" {
+		t.Fatalf("expected the first weekday trip at 03:00, got %+v", weekday_trips)
+	}
+	for _, route_schedule := range route_schedules {
+		for i, trip := range route_schedule.Trips {
+			if i > 0 && trip.Stops[0].Minutes < route_schedule.Trips[i-1].Stops[0].Minutes {
+				t.Errorf("%s: %s departs before %s", route_schedule.ScheduleCode, trip.TripID, route_schedule.Trips[i-1].TripID)
+			}
+			if trip.Departure != trip.Stops[0].Time[:5] {
+				t.Errorf("%s: departure %s does not match the first stop at %s", trip.TripID, trip.Departure, trip.Stops[0].Time)
+			}
+			for j := 1; j < len(trip.Stops); j++ {
+				if travel := trip.Stops[j].Minutes - trip.Stops[j-1].Minutes; travel < 1 || travel > 10 {
+					t.Errorf("%s: implausible %d minutes from %s to %s", trip.TripID, travel, trip.Stops[j-1].StationCode, trip.Stops[j].StationCode)
+				}
+			}
+		}
+	}
+
+	// The short turn starting at Delta is listed with the rest
+	if !slices.ContainsFunc(weekday_trips, func(trip MetromanTripTimetable) bool {
+		return trip.TripID == "XXMW03_trip_WD_XXMS04_0445" && trip.Departure == "07:25"
+	}) {
+		t.Errorf("expected the short turn from Delta at 07:25, got %+v", weekday_trips)
+	}
+
+	if _, err := s.GetRouteSchedule(test_city_code, "XXMW99"); err == nil {
+		t.Errorf("expected an unknown route to fail")
+	}
+}
+
+func TestLineOperatorsAreAgencies(t *testing.T) {
+	s := newTestServer()
+	s.LineOperators = map[string]MetromanOperator{
+		"XXML01": {ID: "xxmetro", Name: "XX Metro", URL: "https://example.com/"},
+		"XXML02": {ID: "xxrail", Name: "XX Rail"},
+	}
+	loadTestCity(t, s, nil)
+
+	agency_urls := map[string]string{}
+	for _, agency := range readCSV(t, s.GenerateAgencyTXT(test_city_code, GenerateOptions{})) {
+		agency_urls[agency["agency_id"]] = agency["agency_url"]
+	}
+	// The city agency is kept for fares
+	expected_urls := map[string]string{"xx": "https://tgrcode.com/", "xxmetro": "https://example.com/", "xxrail": "https://tgrcode.com/"}
+	if !maps.Equal(agency_urls, expected_urls) {
+		t.Errorf("expected agencies %v, got %v", expected_urls, agency_urls)
+	}
+
+	routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	route_agencies := map[string]string{}
+	for _, route := range readCSV(t, routes_txt) {
+		route_agencies[route["route_id"]] = route["agency_id"]
+	}
+	expected_agencies := map[string]string{"XXMW01": "xxmetro", "XXMW02": "xxmetro", "XXMW03": "xxrail", "XXMW04": "xxrail"}
+	if !maps.Equal(route_agencies, expected_agencies) {
+		t.Errorf("expected route agencies %v, got %v", expected_agencies, route_agencies)
+	}
+}
+
+func TestUnservedStationExcluded(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	stop_ids := func(opts GenerateOptions) []string {
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, stop := range readCSV(t, stops_txt) {
+			ids = append(ids, stop["stop_id"])
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	// Golf is on line 2 but no route reaches it
+	if ids := stop_ids(GenerateOptions{}); slices.Contains(ids, "XXMS07") || len(ids) != 6 {
+		t.Errorf("expected the six served stations, got %v", ids)
+	}
+	if ids := stop_ids(GenerateOptions{IncludeUnservedStations: true}); !slices.Contains(ids, "XXMS07") {
+		t.Errorf("expected Golf when unserved stations are included, got %v", ids)
+	}
+
+	translations_txt, err := s.GenerateTranslationsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(translations_txt, "XXMS07") {
+		t.Errorf("expected no translations for Golf:\n%s", translations_txt)
+	}
+}
+
+func TestOutlierShapePointRemoved(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, nil)
+
+	shape_points := func(opts GenerateOptions) map[string][]map[string]string {
+		shapes_txt, err := s.GenerateShapesTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points_by_shape := map[string][]map[string]string{}
+		for _, point := range readCSV(t, shapes_txt) {
+			points_by_shape[point["shape_id"]] = append(points_by_shape[point["shape_id"]], point)
+		}
+		return points_by_shape
+	}
+	expected_points := len(shape_points(GenerateOptions{})["shape_XXMW01"])
+
+	// The middle point between Alpha and Bravo decoded as (0,0)
+	for _, line := range city.Lines {
+		if line.Code == "XXML01" {
+			line.StationPaths["XXMS01_XXMS02"][1] = common.Coordinate{}
+		}
+	}
+
+	report := &MetromanGenerationReport{}
+	points := shape_points(GenerateOptions{Report: report})["shape_XXMW01"]
+	if len(points) != expected_points-1 {
+		t.Fatalf("expected %d points after dropping one, got %d", expected_points-1, len(points))
+	}
+	for i, point := range points {
+		if lat, _ := strconv.ParseFloat(point["shape_pt_lat"], 64); lat < 39 {
+			t.Errorf("expected the outlier to be removed, got %v", point)
+		}
+		if point["shape_pt_sequence"] != strconv.Itoa(i) {
+			t.Errorf("expected sequences without a gap, got %v at %d", point, i)
+		}
+	}
+
+	if !slices.ContainsFunc(report.Events(), func(event MetromanGenerationEvent) bool {
+		return event.Kind == GENERATION_EVENT_SHAPE_POINTS_DROPPED && event.Subject == "shape_XXMW01"
+	}) {
+		t.Errorf("expected the dropped point to be reported, got %+v", report.Events())
+	}
+}
+
+func TestCoordinatePrecision(t *testing.T) {
+	s := newTestServer()
+	s.DisableCoordinateCorrection = true
+	loadTestCity(t, s, nil)
+
+	for _, test := range []struct {
+		precision int
+		alpha_lon string
+	}{
+		{0, "116.350000"},
+		{3, "116.350"},
+		{8, "116.35000000"},
+	} {
+		opts := GenerateOptions{CoordinatePrecision: test.precision}
+
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stop := range readCSV(t, stops_txt) {
+			if stop["stop_id"] == "XXMS01" && stop["stop_lon"] != test.alpha_lon {
+				t.Errorf("precision %d: expected Alpha at longitude %s, got %s", test.precision, test.alpha_lon, stop["stop_lon"])
+			}
+		}
+
+		shapes_txt, err := s.GenerateShapesTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decimals := len(test.alpha_lon) - strings.Index(test.alpha_lon, ".") - 1
+		for _, point := range readCSV(t, shapes_txt) {
+			if len(point["shape_pt_lat"])-strings.Index(point["shape_pt_lat"], ".")-1 != decimals {
+				t.Errorf("precision %d: expected %d decimals, got %v", test.precision, decimals, point)
+				break
+			}
+		}
+	}
+}
+
+func TestNearestStation(t *testing.T) {
+	s := newTestServer()
+	s.DisableCoordinateCorrection = true
+	city := loadTestCity(t, s, nil)
+
+	// Just west of Charlie, Bravo is 2km further
+	station, meters := city.NearestStation(common.Coordinate{Lat: 39.9002, Lng: 116.3895})
+	if station == nil || station.Code != "XXMS03" || meters < 30 || meters > 60 {
+		t.Errorf("expected Charlie about 45m away, got %v %f", station, meters)
+	}
+
+	// Stations without coordinates never match
+	city.StationsByCode["XXMS07"].Lat = 0
+	city.StationsByCode["XXMS07"].Lng = 0
+	if station, _ := city.NearestStation(common.Coordinate{}); station == nil || station.Code == "XXMS07" {
+		t.Errorf("expected a station with coordinates, got %v", station)
+	}
+
+	if station, _ := (&MetromanCity{}).NearestStation(common.Coordinate{Lat: 39.9, Lng: 116.39}); station != nil {
+		t.Errorf("expected nothing without stations, got %v", station)
+	}
+}
+
+func TestZeroCoordinateStationExcluded(t *testing.T) {
+	// MetroMan has no coordinates for Bravo
+	s := newTestServer()
+	loadTestCity(t, s, map[string]string{
+		"uno.csv": strings.Replace(fixtureFile(t, "uno.csv"), "39.9000<,>116.3700", "0<,>0", 1),
+	})
+
+	for _, test := range []struct {
+		opts  GenerateOptions
+		bravo bool
+	}{
+		{GenerateOptions{}, false},
+		{GenerateOptions{IncludeZeroCoordinateStations: true}, true},
+	} {
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has_bravo := strings.Contains(stops_txt, "XXMS02"); has_bravo != test.bravo {
+			t.Errorf("expected Bravo in stops.txt %v, got %v", test.bravo, has_bravo)
+		}
+
+		stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_times := readCSV(t, stop_times_txt)
+		if has_bravo := slices.ContainsFunc(stop_times, func(stop_time map[string]string) bool {
+			return stop_time["stop_id"] == "XXMS02"
+		}); has_bravo != test.bravo {
+			t.Errorf("expected Bravo in stop_times.txt %v, got %v", test.bravo, has_bravo)
+		}
+		// Alpha and Charlie keep their times either side of the gap
+		if !slices.ContainsFunc(stop_times, func(stop_time map[string]string) bool {
+			return stop_time["trip_id"] == "XXMW01_trip_WD_XXMS01_0360" && stop_time["stop_id"] == "XXMS03"
+		}) {
+			t.Errorf("expected Charlie to stay on the 06:00 trip")
+		}
+	}
+}
+
+func TestDownloadCityZipRetriesShortRead(t *testing.T) {
+	city_zip := testCityZip(t, test_zip_prefix, nil)
+	output := captureLog(t)
+
+	// The connection drops halfway through the first download
+	requests := 0
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", strconv.Itoa(len(city_zip)))
+		if requests == 1 {
+			w.Write(city_zip[:len(city_zip)/2])
+			return
+		}
+		w.Write(city_zip)
+	})
+
+	zip, status_code, err := DownloadCityZip(test_city_code, test_zip_prefix)
+	if err != nil || status_code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d %v", status_code, err)
+	}
+	if requests != 2 || !bytes.Equal(zip, city_zip) {
+		t.Errorf("expected the full zip from the second of 2 requests, got %d bytes from %d", len(zip), requests)
+	}
+	if !strings.Contains(output.String(), "zip download truncated (attempt 1 of 3)") {
+		t.Errorf("expected the truncated attempt to be logged, got:\n%s", output)
+	}
+}
+
+func TestTerminusHeadsignsBothDirections(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	directions, err := s.GetLineDirections(test_city_code, "XXML02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directions[0].Headsign != "Foxtrot" || directions[1].Headsign != "Charlie" || directions[1].Name != "Towards Charlie" {
+		t.Errorf("expected Foxtrot and Charlie, got %+v", directions)
+	}
+
+	trips_txt, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{TerminusHeadsigns: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_headsigns := map[string]string{"XXMW01": "Charlie", "XXMW02": "Alpha", "XXMW03": "Foxtrot", "XXMW04": "Charlie"}
+	for _, trip := range readCSV(t, trips_txt) {
+		if trip["trip_headsign"] != expected_headsigns[trip["route_id"]] {
+			t.Errorf("expected %s to head to %s, got %v", trip["trip_id"], expected_headsigns[trip["route_id"]], trip)
+		}
+	}
+
+	if _, err := s.GetLineDirections(test_city_code, "XXML99"); err == nil {
+		t.Errorf("expected an unknown line to fail")
+	}
+}
+
+func TestWalkingWayModes(t *testing.T) {
+	transfers := func(s *MetromanServer, mode WalkingWayMode) []string {
+		transfers_txt, err := s.GenerateTransfersTXT(test_city_code, GenerateOptions{WalkingWayMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := []string{}
+		for _, transfer := range readCSV(t, transfers_txt) {
+			rows = append(rows, strings.Join([]string{transfer["from_stop_id"], transfer["to_stop_id"], transfer["transfer_type"], transfer["min_transfer_time"]}, " "))
+		}
+		return rows
+	}
+	// route_type of every walking way in routes.txt
+	walking_route_types := func(s *MetromanServer, mode WalkingWayMode) map[string]string {
+		routes_txt, err := s.GenerateRoutesTXT(test_city_code, GenerateOptions{WalkingWayMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		route_types := map[string]string{}
+		for _, route := range readCSV(t, routes_txt) {
+			if strings.HasPrefix(route["route_id"], "XXWW") {
+				route_types[route["route_id"]] = route["route_type"]
+			}
+		}
+		return route_types
+	}
+
+	// XXWW01 joins Bravo and Delta without a timetable, so they are recommended transfer points
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+	if rows := transfers(s, WALKING_WAY_MODE_TRANSFERS); !slices.Equal(rows, []string{"XXMS02 XXMS04 0 ", "XXMS04 XXMS02 0 "}) {
+		t.Errorf("expected recommended transfers both ways, got %q", rows)
+	}
+	if rows := transfers(s, WALKING_WAY_MODE_IGNORE); len(rows) != 0 {
+		t.Errorf("expected no transfers when ignored, got %q", rows)
+	}
+
+	// Without a timetable there are no trips to make it a route, so it stays a transfer
+	if rows := transfers(s, WALKING_WAY_MODE_ROUTES); !slices.Equal(rows, []string{"XXMS02 XXMS04 0 ", "XXMS04 XXMS02 0 "}) {
+		t.Errorf("expected the untimed walking way to stay a transfer, got %q", rows)
+	}
+	for _, mode := range []WalkingWayMode{WALKING_WAY_MODE_TRANSFERS, WALKING_WAY_MODE_IGNORE, WALKING_WAY_MODE_ROUTES} {
+		if route_types := walking_route_types(s, mode); len(route_types) != 0 {
+			t.Errorf("mode %d: expected no walking routes without a timetable, got %v", mode, route_types)
+		}
+	}
+
+	// With a 5 minute walk the transfers get a minimum time
+	s = newTestServer()
+	loadTestCity(t, s, scheduledWalkingWayOverrides())
+	if rows := transfers(s, WALKING_WAY_MODE_TRANSFERS); !slices.Equal(rows, []string{"XXMS02 XXMS04 2 300", "XXMS04 XXMS02 2 300"}) {
+		t.Errorf("expected 5 minute transfers both ways, got %q", rows)
+	}
+	if rows := transfers(s, WALKING_WAY_MODE_IGNORE); len(rows) != 0 {
+		t.Errorf("expected no transfers when ignored, got %q", rows)
+	}
+	for _, mode := range []WalkingWayMode{WALKING_WAY_MODE_TRANSFERS, WALKING_WAY_MODE_IGNORE} {
+		if route_types := walking_route_types(s, mode); len(route_types) != 0 {
+			t.Errorf("mode %d: expected the walking way to stay out of routes.txt, got %v", mode, route_types)
+		}
+	}
+
+	// As a route instead, with its two walks as trips
+	opts := GenerateOptions{WalkingWayMode: WALKING_WAY_MODE_ROUTES}
+	if rows := transfers(s, WALKING_WAY_MODE_ROUTES); len(rows) != 0 {
+		t.Errorf("expected no transfers for a walking way written as a route, got %q", rows)
+	}
+	if route_types := walking_route_types(s, WALKING_WAY_MODE_ROUTES); !maps.Equal(route_types, map[string]string{"XXWW01": "1700"}) {
+		t.Errorf("expected XXWW01 as a miscellaneous service route, got %v", route_types)
+	}
+	trips_txt, err := s.GenerateTripsTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walking_trips := slices.DeleteFunc(readCSV(t, trips_txt), func(trip map[string]string) bool {
+		return trip["route_id"] != "XXWW01"
+	})
+	if len(walking_trips) != 2 {
+		t.Errorf("expected 2 walking trips, got %v", walking_trips)
+	}
+	stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(readCSV(t, stop_times_txt), func(stop_time map[string]string) bool {
+		return stop_time["trip_id"] == "XXWW01_trip_WD_XXMS02_0500" && stop_time["stop_id"] == "XXMS04" && stop_time["arrival_time"] == "08:25:00"
+	}) {
+		t.Errorf("expected the 08:20 walk to reach Delta at 08:25:\n%s", stop_times_txt)
+	}
+}
+
+func TestMetadataOnlyLoadHasStopsButNoTrips(t *testing.T) {
+	city_zip := testCityZip(t, test_zip_prefix, nil)
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(city_zip)
+	})
+
+	s := newTestServer()
+	if err := s.LoadCityMetadataOnly(test_city_code); err != nil {
+		t.Fatal(err)
+	}
+	city := s.Cities[test_city_code]
+	if !city.MetadataOnly {
+		t.Errorf("expected the city to be marked metadata only")
+	}
+
+	stops_txt, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Routes with a timetable still count as served
+	if stops := readCSV(t, stops_txt); len(stops) != 6 {
+		t.Errorf("expected the six served stops, got %d", len(stops))
+	}
+
+	for _, route := range city.Routes {
+		if len(route.Trips) != 0 {
+			t.Errorf("expected no trips for %s, got %d schedules", route.Code, len(route.Trips))
+		}
+		if route.TripsSkipped == route.Walking {
+			t.Errorf("expected only timetabled routes to be marked skipped, %s is not", route.Code)
+		}
+	}
+	// Rather than an empty trips.txt
+	if _, err := s.GenerateTripsTXT(test_city_code, GenerateOptions{}); err == nil || !strings.Contains(err.Error(), "without schedules") {
+		t.Errorf("expected trips.txt to refuse a metadata only city, got %v", err)
+	}
+}
+
+// Trip chaining as it was before buildTrips, kept to check the faster version against
+func referenceBuildTrips(route *MetromanRoute, schedule_station_arrivals_departures []map[int]int) []MetromanTrip {
+	trips := []MetromanTrip{}
+	arrival_trip_assigned := make(map[int]int)
+	last_arrival_trip_assigned := make(map[int]int)
+
+	for station_i := range len(route.Stations) - 1 {
+		this_arrivals_departures := schedule_station_arrivals_departures[route.StationToScheduleIndex[route.Stations[station_i].Index]]
+
+		trip_ended := make(map[int]bool)
+		for trip_idx, trip := range trips {
+			trip_ended[trip_idx] = trip.TripEnded
+		}
+
+		if station_i == 0 {
+			for arrival_next_min, depart_min := range this_arrivals_departures {
+				trips = append(trips, MetromanTrip{
+					Visits: []MetromanStationVisit{
+						{Station: route.Stations[0], ArrivalAndDepartMinutes: depart_min},
+						{Station: route.Stations[1], ArrivalAndDepartMinutes: arrival_next_min},
+					},
+				})
+				arrival_trip_assigned[arrival_next_min] = len(trips) - 1
+			}
+			continue
+		}
+
+		last_arrival_trip_assigned = arrival_trip_assigned
+		arrival_trip_assigned = make(map[int]int)
+
+		for arrival_next_min, depart_min := range this_arrivals_departures {
+			trip_idx, trip_found := last_arrival_trip_assigned[depart_min]
+			if trip_found && !trip_ended[trip_idx] {
+				trips[trip_idx].Visits = append(trips[trip_idx].Visits, MetromanStationVisit{
+					Station:                 route.Stations[station_i+1],
+					ArrivalAndDepartMinutes: arrival_next_min,
+				})
+				arrival_trip_assigned[arrival_next_min] = trip_idx
+			} else {
+				trips = append(trips, MetromanTrip{
+					Visits: []MetromanStationVisit{
+						{Station: route.Stations[station_i], ArrivalAndDepartMinutes: depart_min},
+						{Station: route.Stations[station_i+1], ArrivalAndDepartMinutes: arrival_next_min},
+					},
+				})
+				arrival_trip_assigned[arrival_next_min] = len(trips) - 1
+			}
+		}
+	}
+
+	return trips
+}
+
+// A long route with a busy timetable. Every tenth trip turns back early and every fifth a short
+// working starts midway, so both ending and starting trips are chained
+func syntheticTimetable(num_stations int, num_trips int, num_schedules int) (*MetromanRoute, [][]map[int]int) {
+	route := &MetromanRoute{
+		Code:                   "XXMW99",
+		StationToScheduleIndex: make(map[int]int),
+	}
+	for i := range num_stations {
+		route.Stations = append(route.Stations, &MetromanStation{
+			Code:  fmt.Sprintf("XXMS%02d", i),
+			Index: i,
+		})
+		// Schedules are not in station order
+		route.StationToScheduleIndex[i] = num_stations - 2 - i
+	}
+
+	schedules := [][]map[int]int{}
+	for schedule_i := range num_schedules {
+		schedule := make([]map[int]int, num_stations-1)
+		for i := range schedule {
+			schedule[i] = make(map[int]int)
+		}
+		for trip_i := range num_trips {
+			start := 300 + 3*trip_i + schedule_i
+			first, last := 0, num_stations-1
+			if trip_i%10 == 0 {
+				last = num_stations * 2 / 3
+			}
+			for station_i := first; station_i < last; station_i++ {
+				schedule[route.StationToScheduleIndex[station_i]][start+2*(station_i+1)] = start + 2*station_i
+			}
+			if trip_i%5 == 0 {
+				// Offset by a minute so it never meets the through trips
+				for station_i := num_stations / 3; station_i < num_stations-1; station_i++ {
+					schedule[route.StationToScheduleIndex[station_i]][start+1+2*(station_i+1)] = start + 1 + 2*station_i
+				}
+			}
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return route, schedules
+}
+
+func TestBuildTripsMatchesReference(t *testing.T) {
+	route, schedules := syntheticTimetable(45, 300, 3)
+
+	// Shared between schedules like parseCity does
+	arrival_trip_assigned := make(map[int]int)
+	last_arrival_trip_assigned := make(map[int]int)
+	for schedule_i, schedule := range schedules {
+		trips := SortTrips(buildTrips(route, schedule, arrival_trip_assigned, last_arrival_trip_assigned))
+		expected_trips := SortTrips(referenceBuildTrips(route, schedule))
+
+		if !SameTrips(trips, expected_trips) {
+			t.Errorf("schedule %d: expected %d trips matching the reference, got %d", schedule_i, len(expected_trips), len(trips))
+		}
+		// 300 from the first station and 60 short workings
+		if len(trips) != 360 {
+			t.Errorf("schedule %d: expected 360 trips, got %d", schedule_i, len(trips))
+		}
+	}
+}
+
+func BenchmarkBuildTrips(b *testing.B) {
+	route, schedules := syntheticTimetable(45, 300, 3)
+	arrival_trip_assigned := make(map[int]int)
+	last_arrival_trip_assigned := make(map[int]int)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, schedule := range schedules {
+			buildTrips(route, schedule, arrival_trip_assigned, last_arrival_trip_assigned)
+		}
+	}
+}
+
+func TestCommaDelimitedSchedule(t *testing.T) {
+	expected_city := loadTestCity(t, newTestServer(), nil)
+
+	s := newTestServer()
+	city := loadTestCity(t, s, map[string]string{
+		"schedule.csv": crlf("WD,1,1,1,1,1,0,0,0,0", "WE,0,0,0,0,0,1,1,0,1"),
+	})
+
+	for route_idx, route := range city.Routes {
+		expected_route := expected_city.Routes[route_idx]
+		if len(route.Schedules) != len(expected_route.Schedules) {
+			t.Fatalf("%s: expected %d schedules, got %d", route.Code, len(expected_route.Schedules), len(route.Schedules))
+		}
+		for schedule_idx, schedule := range route.Schedules {
+			if *schedule != *expected_route.Schedules[schedule_idx] {
+				t.Errorf("%s: expected schedule %+v, got %+v", route.Code, *expected_route.Schedules[schedule_idx], *schedule)
+			}
+		}
+	}
+
+	calendar_txt, _, err := s.GenerateCalendarTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, calendar := range readCSV(t, calendar_txt) {
+		if calendar["service_id"] == "WE" && (calendar["saturday"] != "1" || calendar["monday"] != "0") {
+			t.Errorf("expected WE to run on weekends only, got %v", calendar)
+		}
+	}
+}
+
+func TestNearbyFacilitiesInStopDesc(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	text_templates, err := template.ParseGlob("../*.gotxt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBaiduServer(&baidu_client.BaiduServer{
+		TextTemplates: text_templates,
+		CityUIDMappingsByMetromanCode: map[string]baidu_client.CityUIDMapping{
+			test_city_code: {BaiduID: "999", MetromanCode: test_city_code},
+		},
+	})
+
+	// Every station is found, only Bravo has parking and bike share nearby
+	mockTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		switch search_query := r.URL.Query().Get("wd"); search_query {
+		case "布拉沃站停车场":
+			w.Write([]byte(`{"content": [{"name": "布拉沃站", "geo_type": 2, "uid": "bravo"}, {"name": "布拉沃站停车场", "geo_type": 1}, {"name": "布拉沃西停车场", "geo_type": 1}]}`))
+		case "布拉沃站共享单车":
+			w.Write([]byte(`{"content": [{"name": "布拉沃共享单车点", "geo_type": 1}]}`))
+		default:
+			fmt.Fprintf(w, `{"content": [{"name": %q, "geo_type": 2, "uid": "station"}]}`, search_query)
+		}
+	})
+
+	stop_descs := func(opts GenerateOptions) map[string]string {
+		stops_txt, err := s.GenerateStopsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_descs := map[string]string{}
+		for _, stop := range readCSV(t, stops_txt) {
+			stop_descs[stop["stop_id"]] = stop["stop_desc"]
+		}
+		return stop_descs
+	}
+
+	descs := stop_descs(GenerateOptions{FullBaiduLookups: true, NearbyFacilities: true})
+	if descs["XXMS02"] != "Parking: 布拉沃站停车场, 布拉沃西停车场; Bike share: 布拉沃共享单车点" {
+		t.Errorf("expected Bravo's parking and bike share, got %q", descs["XXMS02"])
+	}
+	if descs["XXMS01"] != "" {
+		t.Errorf("expected nothing near Alpha, got %q", descs["XXMS01"])
+	}
+
+	// Off by default
+	for stop_id, desc := range stop_descs(GenerateOptions{FullBaiduLookups: true}) {
+		if desc != "" {
+			t.Errorf("expected no stop_desc without NearbyFacilities, %s has %q", stop_id, desc)
+		}
+	}
+}
+
+func TestStationExits(t *testing.T) {
+	exit_csv, err := os.ReadFile("testdata/exit.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := captureLog(t)
+
+	// Plus a row too short to read and one for a station that doesn't exist
+	s := newTestServer()
+	city := loadTestCity(t, s, map[string]string{
+		"exit.csv": string(exit_csv) + crlf("XXMS05<,>A", "XXMS99<,>A<,>A口<,>"),
+	})
+	for _, expected_log := range []string{
+		"xx: skipped exit.csv line 5 with 2 columns, expected at least 4",
+		"xx: exit A is for unknown station XXMS99",
+	} {
+		if !strings.Contains(output.String(), expected_log) {
+			t.Errorf("expected %q to be logged, got:\n%s", expected_log, output)
+		}
+	}
+	// The toilet is not a way out
+	if exits := city.StationExitsByCode["XXMS02"]; len(exits) != 2 || exits[0].Code != "A" || exits[1].SimplifiedDescription != "布拉沃路西侧" {
+		t.Errorf("expected Bravo's exits A and B, got %+v", exits)
+	}
+
+	stops_txt, err := s.GenerateStopsTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := map[string][2]string{}
+	for _, stop := range readCSV(t, stops_txt) {
+		stops[stop["stop_id"]] = [2]string{stop["location_type"], stop["parent_station"]}
+	}
+	for stop_id, expected := range map[string][2]string{
+		"station_XXMS02": {"1", ""},
+		"XXMS02":         {"0", "station_XXMS02"},
+		"exit_XXMS02_A":  {"2", "station_XXMS02"},
+		"exit_XXMS02_B":  {"2", "station_XXMS02"},
+		"station_XXMS04": {"1", ""},
+		"XXMS04":         {"0", "station_XXMS04"},
+		"exit_XXMS04_A":  {"2", "station_XXMS04"},
+		"XXMS01":         {"0", ""},
+	} {
+		if stops[stop_id] != expected {
+			t.Errorf("expected %s to have location_type and parent_station %q, got %q", stop_id, expected, stops[stop_id])
+		}
+	}
+	if len(stops) != 11 {
+		t.Errorf("expected six stops, two stations and three entrances, got %d", len(stops))
+	}
+
+	pathways_txt, err := s.GeneratePathwaysTXT(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathways := []string{}
+	for _, pathway := range readCSV(t, pathways_txt) {
+		pathways = append(pathways, strings.Join([]string{pathway["pathway_id"], pathway["from_stop_id"], pathway["to_stop_id"], pathway["pathway_mode"], pathway["is_bidirectional"]}, " "))
+	}
+	expected_pathways := []string{
+		"pathway_exit_XXMS02_A exit_XXMS02_A XXMS02 1 1",
+		"pathway_exit_XXMS02_B exit_XXMS02_B XXMS02 1 1",
+		"pathway_exit_XXMS04_A exit_XXMS04_A XXMS04 1 1",
+	}
+	if !slices.Equal(pathways, expected_pathways) {
+		t.Errorf("expected pathways %q, got %q", expected_pathways, pathways)
+	}
+
+	// Only a missing exit.csv is expected
+	fsys := testCityFS(t, nil)
+	fsys[path.Join(test_zip_prefix, "exit.csv")] = &fstest.MapFile{Mode: fs.ModeDir}
+	if err := newTestServer().LoadCityFromFS(test_city_code, test_zip_prefix, fsys); err == nil || !strings.Contains(err.Error(), "could not open exit.csv") {
+		t.Errorf("expected an unreadable exit.csv to fail, got %v", err)
+	}
+}
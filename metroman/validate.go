@@ -0,0 +1,262 @@
+package metroman_client
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+
+	"tgrcode.com/china_gtfs/common"
+)
+
+// Generators format ids independently, cross-check that every id referenced by trips.txt and
+// stop_times.txt is defined by the file it points to
+func ValidateFeedReferences(routes_txt string, calendar_txt string, calendar_dates_txt string, trips_txt string, stop_times_txt string) error {
+	route_ids, err := CSVColumnSet(routes_txt, "route_id")
+	if err != nil {
+		return fmt.Errorf("routes.txt: %v", err)
+	}
+
+	// A service can be defined by either calendar file
+	service_ids, err := CSVColumnSet(calendar_txt, "service_id")
+	if err != nil {
+		return fmt.Errorf("calendar.txt: %v", err)
+	}
+	calendar_dates_service_ids, err := CSVColumnSet(calendar_dates_txt, "service_id")
+	if err != nil {
+		return fmt.Errorf("calendar_dates.txt: %v", err)
+	}
+	for service_id := range calendar_dates_service_ids {
+		service_ids[service_id] = true
+	}
+
+	trip_route_ids, err := CSVColumn(trips_txt, "route_id")
+	if err != nil {
+		return fmt.Errorf("trips.txt: %v", err)
+	}
+	trip_service_ids, err := CSVColumn(trips_txt, "service_id")
+	if err != nil {
+		return fmt.Errorf("trips.txt: %v", err)
+	}
+	trip_ids, err := CSVColumn(trips_txt, "trip_id")
+	if err != nil {
+		return fmt.Errorf("trips.txt: %v", err)
+	}
+
+	for i, trip_id := range trip_ids {
+		if !route_ids[trip_route_ids[i]] {
+			return fmt.Errorf("trip %s references route %s missing from routes.txt", trip_id, trip_route_ids[i])
+		}
+		if !service_ids[trip_service_ids[i]] {
+			return fmt.Errorf("trip %s references service %s missing from calendar.txt and calendar_dates.txt", trip_id, trip_service_ids[i])
+		}
+	}
+
+	trip_id_set, err := CSVColumnSet(trips_txt, "trip_id")
+	if err != nil {
+		return fmt.Errorf("trips.txt: %v", err)
+	}
+	stop_time_trip_ids, err := CSVColumnSet(stop_times_txt, "trip_id")
+	if err != nil {
+		return fmt.Errorf("stop_times.txt: %v", err)
+	}
+
+	for trip_id := range stop_time_trip_ids {
+		if !trip_id_set[trip_id] {
+			return fmt.Errorf("stop_times.txt references trip %s missing from trips.txt", trip_id)
+		}
+	}
+	for trip_id := range trip_id_set {
+		if !stop_time_trip_ids[trip_id] {
+			return fmt.Errorf("trip %s has no stop_times", trip_id)
+		}
+	}
+
+	return nil
+}
+
+// Clear shape_id on trips whose shape has no rows in shapes.txt, such as routes MetroMan has no path for
+// or whose every point was dropped. Returns the new trips.txt and the cleared shape_ids, sorted
+func ReconcileShapeIDs(trips_txt string, shapes_txt string) (string, []string, error) {
+	shape_ids, err := CSVColumnSet(shapes_txt, "shape_id")
+	if err != nil {
+		return "", nil, fmt.Errorf("shapes.txt: %v", err)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(trips_txt)).ReadAll()
+	if err != nil {
+		return "", nil, fmt.Errorf("trips.txt: %v", err)
+	}
+	if len(records) == 0 {
+		return "", nil, fmt.Errorf("trips.txt: missing header")
+	}
+
+	shape_id_idx := slices.Index(records[0], "shape_id")
+	if shape_id_idx == -1 {
+		return trips_txt, []string{}, nil
+	}
+
+	cleared_shape_ids := map[string]bool{}
+	for _, record := range records[1:] {
+		if shape_id := record[shape_id_idx]; shape_id != "" && !shape_ids[shape_id] {
+			cleared_shape_ids[shape_id] = true
+			record[shape_id_idx] = ""
+		}
+	}
+	if len(cleared_shape_ids) == 0 {
+		return trips_txt, []string{}, nil
+	}
+
+	var buf bytes.Buffer
+	csv_writer := csv.NewWriter(&buf)
+	if err := csv_writer.WriteAll(records); err != nil {
+		return "", nil, err
+	}
+
+	return buf.String(), slices.Sorted(maps.Keys(cleared_shape_ids)), nil
+}
+
+// Every value of a column in generated CSV, in row order
+func CSVColumn(contents string, column string) ([]string, error) {
+	records, err := csv.NewReader(strings.NewReader(contents)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header")
+	}
+
+	column_idx := -1
+	for i, name := range records[0] {
+		if name == column {
+			column_idx = i
+			break
+		}
+	}
+	if column_idx == -1 {
+		return nil, fmt.Errorf("missing column %s", column)
+	}
+
+	values := []string{}
+	for _, record := range records[1:] {
+		values = append(values, record[column_idx])
+	}
+
+	return values, nil
+}
+
+func CSVColumnSet(contents string, column string) (map[string]bool, error) {
+	values, err := CSVColumn(contents, column)
+	if err != nil {
+		return nil, err
+	}
+
+	value_set := make(map[string]bool, len(values))
+	for _, value := range values {
+		value_set[value] = true
+	}
+
+	return value_set, nil
+}
+
+// A station farther from its line's path than expected, usually mis-corrected or mis-coded
+type MetromanCoordinateDrift struct {
+	StationCode string  `json:"station_code"`
+	EnglishName string  `json:"english_name"`
+	LineCode    string  `json:"line_code"`
+	Meters      float64 `json:"meters"`
+}
+
+// Stations more than threshold_meters from the nearest path point of a line they belong to.
+// Lines without paths are skipped
+func (s *MetromanServer) FindCoordinateDrift(code string, threshold_meters float64) ([]MetromanCoordinateDrift, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+
+	drifts := []MetromanCoordinateDrift{}
+	for _, line := range city.Lines {
+		if len(line.StationPaths) == 0 {
+			continue
+		}
+
+		for _, station := range line.Stations {
+			station_coord := common.Coordinate{Lat: station.Lat, Lng: station.Lng}
+
+			nearest_meters := math.Inf(1)
+			for _, path := range line.StationPaths {
+				for _, coord := range path {
+					nearest_meters = min(nearest_meters, common.HaversineDistance(station_coord, coord))
+				}
+			}
+
+			if nearest_meters > threshold_meters {
+				drifts = append(drifts, MetromanCoordinateDrift{
+					StationCode: station.Code,
+					EnglishName: station.EnglishName,
+					LineCode:    line.Code,
+					Meters:      nearest_meters,
+				})
+			}
+		}
+	}
+
+	return drifts, nil
+}
+
+// A stop farther from its own route's shape than expected, usually a missing path segment
+type MetromanShapeGap struct {
+	RouteCode   string  `json:"route_code"`
+	StationCode string  `json:"station_code"`
+	EnglishName string  `json:"english_name"`
+	Meters      float64 `json:"meters"`
+}
+
+// Stops more than threshold_meters from every point of the shape written for their route in shapes.txt.
+// Routes without any shape are skipped, FindSuspectedMislabels and the generation report cover those
+func (s *MetromanServer) FindShapeGaps(code string, threshold_meters float64) ([]MetromanShapeGap, error) {
+	city, exists := s.Cities[code]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", code)
+	}
+
+	gaps := []MetromanShapeGap{}
+	for _, route := range city.Routes {
+		if !IsTransitRoute(route) {
+			continue
+		}
+
+		shape := RouteShape(route)
+		if len(shape) == 0 {
+			continue
+		}
+
+		for _, station := range route.Stations {
+			// Stations without coordinates are reported by IncompleteCities instead
+			if station.Lat == 0 && station.Lng == 0 {
+				continue
+			}
+			station_coord := common.Coordinate{Lat: station.Lat, Lng: station.Lng}
+
+			nearest_meters := math.Inf(1)
+			for _, coord := range shape {
+				nearest_meters = min(nearest_meters, common.HaversineDistance(station_coord, coord))
+			}
+
+			if nearest_meters > threshold_meters {
+				gaps = append(gaps, MetromanShapeGap{
+					RouteCode:   route.Code,
+					StationCode: station.Code,
+					EnglishName: station.EnglishName,
+					Meters:      nearest_meters,
+				})
+			}
+		}
+	}
+
+	return gaps, nil
+}
@@ -0,0 +1,147 @@
+package metroman_client
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateFeedReferences(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	generate := func(opts GenerateOptions) map[string]string {
+		routes_txt, err := s.GenerateRoutesTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calendar_txt, calendar_dates_txt, err := s.GenerateCalendarTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips_txt, err := s.GenerateTripsTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop_times_txt, err := s.GenerateStopTimesTXT(test_city_code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]string{
+			"routes.txt":         routes_txt,
+			"calendar.txt":       calendar_txt,
+			"calendar_dates.txt": calendar_dates_txt,
+			"trips.txt":          trips_txt,
+			"stop_times.txt":     stop_times_txt,
+		}
+	}
+	validate := func(files map[string]string) error {
+		return ValidateFeedReferences(files["routes.txt"], files["calendar.txt"], files["calendar_dates.txt"], files["trips.txt"], files["stop_times.txt"])
+	}
+
+	files := generate(GenerateOptions{})
+	if err := validate(files); err != nil {
+		t.Fatalf("generated files should agree: %v", err)
+	}
+
+	// One file formats its ids differently from the rest
+	prefixed_files := generate(GenerateOptions{IDPrefix: "xx_"})
+	for _, diverged_file := range []string{"routes.txt", "calendar.txt", "trips.txt", "stop_times.txt"} {
+		diverged_files := map[string]string{}
+		for filename, contents := range files {
+			diverged_files[filename] = contents
+		}
+		diverged_files[diverged_file] = prefixed_files[diverged_file]
+		// Either calendar file defines a service
+		if diverged_file == "calendar.txt" {
+			diverged_files["calendar_dates.txt"] = prefixed_files["calendar_dates.txt"]
+		}
+
+		if err := validate(diverged_files); err == nil {
+			t.Errorf("expected a diverged %s to be caught", diverged_file)
+		}
+	}
+
+	// A trip with no stop_times
+	lines := strings.Split(files["stop_times.txt"], "\n")
+	last_trip_id := strings.Split(lines[len(lines)-2], ",")[0]
+	kept_lines := []string{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, last_trip_id+",") {
+			kept_lines = append(kept_lines, line)
+		}
+	}
+	files["stop_times.txt"] = strings.Join(kept_lines, "\n")
+	if err := validate(files); err == nil || !strings.Contains(err.Error(), "has no stop_times") {
+		t.Errorf("expected trip %s without stop_times to be caught, got %v", last_trip_id, err)
+	}
+}
+
+func TestFindCoordinateDrift(t *testing.T) {
+	s := newTestServer()
+	city := loadTestCity(t, s, nil)
+
+	drifts, err := s.FindCoordinateDrift(test_city_code, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Golf is listed on line 2 past the end of its path
+	if len(drifts) != 1 || drifts[0].StationCode != "XXMS07" {
+		t.Fatalf("expected only Golf off the paths, got %+v", drifts)
+	}
+
+	// Echo moved about 1.7km east of line 2
+	city.StationsByCode["XXMS05"].Lng += 0.02
+
+	drifts, err = s.FindCoordinateDrift(test_city_code, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts = slices.DeleteFunc(drifts, func(drift MetromanCoordinateDrift) bool {
+		return drift.StationCode == "XXMS07"
+	})
+	if len(drifts) != 1 || drifts[0].StationCode != "XXMS05" || drifts[0].LineCode != "XXML02" || drifts[0].Meters < 1000 {
+		t.Errorf("expected Echo to be flagged on XXML02, got %+v", drifts)
+	}
+
+	if _, err := s.FindCoordinateDrift("zz", 300); err == nil {
+		t.Errorf("expected an unloaded city to fail")
+	}
+}
+
+func TestFindShapeGaps(t *testing.T) {
+	s := newTestServer()
+	loadTestCity(t, s, nil)
+
+	gaps, err := s.FindShapeGaps(test_city_code, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 0 {
+		t.Fatalf("expected every stop on its route's shape, got %+v", gaps)
+	}
+
+	// Line 2 loses its last segment, so its shapes stop at Echo
+	loadTestCity(t, s, map[string]string{
+		"path_rail.csv": crlf(
+			"XXML01,XXMS01,XXMS02,0,2",
+			"XXML01,XXMS02,XXMS03,3,5",
+			"XXML02,XXMS03,XXMS04,6,7",
+			"XXML02,XXMS04,XXMS05,8,9",
+		),
+	})
+	gaps, err = s.FindShapeGaps(test_city_code, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route_codes := []string{}
+	for _, gap := range gaps {
+		if gap.StationCode != "XXMS06" || gap.Meters < 1000 {
+			t.Errorf("expected only Foxtrot to be far from the shape, got %+v", gap)
+		}
+		route_codes = append(route_codes, gap.RouteCode)
+	}
+	if !slices.Equal(route_codes, []string{"XXMW03", "XXMW04"}) {
+		t.Errorf("expected both directions of line 2 to be flagged, got %v", route_codes)
+	}
+}
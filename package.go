@@ -1,10 +1,18 @@
 package china_gtfs
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"tgrcode.com/baidu_client"
 	"tgrcode.com/metroman_client"
@@ -13,39 +21,246 @@ import (
 type ChinaGTFSServer struct {
 	MetromanServer *metroman_client.MetromanServer
 	BaiduServer    *baidu_client.BaiduServer
+
+	// Compression used for generated GTFS zips
+	ZipCompression CompressionLevel
+
+	// Nil until a Chelaile client exists, see ChelaileClient
+	ChelaileClient ChelaileClient
+
+	city_statuses      map[string]CityStatus
+	city_statuses_lock sync.Mutex
+}
+
+type CompressionLevel int
+
+const (
+	COMPRESSION_DEFAULT          CompressionLevel = 0
+	COMPRESSION_STORE            CompressionLevel = 1
+	COMPRESSION_BEST_SPEED       CompressionLevel = 2
+	COMPRESSION_BEST_COMPRESSION CompressionLevel = 3
+)
+
+type GenerateOptions = metroman_client.GenerateOptions
+
+// Chelaile (车来了) is another transit source, usable to enrich or cross-check stops like Baidu.
+// Cities are identified by the Chelaile code in baidu_city_uid_to_city.csv, see ChelaileCode
+type ChelaileClient interface {
+	// Names of every metro station Chelaile knows in the city
+	GetStationNames(chelaile_code string) ([]string, error)
+}
+
+// Health of the most recent generation for a city
+type CityStatus struct {
+	Loaded    bool      `json:"loaded"`
+	Failed    bool      `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ServerOptions struct {
+	// Skip Baidu, stop URLs are unavailable and agency names fall back to the city code
+	Offline bool
+	// Start without MetroMan versions when version.txt cannot be fetched, stored feeds can still be served
+	AllowMissingVersions bool
+	// Keep a copy of version.txt here and fall back to it when the fetch fails
+	VersionsCachePath string
 }
 
 func CreateServer() (*ChinaGTFSServer, error) {
-	metroman_server, err := metroman_client.CreateServer()
+	return CreateServerWithOptions(ServerOptions{})
+}
+
+func CreateOfflineServer() (*ChinaGTFSServer, error) {
+	return CreateServerWithOptions(ServerOptions{Offline: true})
+}
+
+func CreateServerWithOptions(opts ServerOptions) (*ChinaGTFSServer, error) {
+	metroman_server, err := metroman_client.CreateServerWithVersions(map[string]string{})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	metroman_server.VersionsCachePath = opts.VersionsCachePath
 
+	if err := metroman_server.RefreshVersions(); err != nil {
+		cached_versions_lookup, cache_err := metroman_client.LoadVersionsCache(opts.VersionsCachePath)
+
+		switch {
+		case opts.VersionsCachePath != "" && cache_err == nil:
+			log.Printf("Warning: could not get MetroMan versions, using cached %s: %v", opts.VersionsCachePath, err)
+			metroman_server.SetVersions(cached_versions_lookup)
+		case opts.AllowMissingVersions:
+			log.Printf("Warning: could not get MetroMan versions, continuing without them: %v", err)
+		default:
+			return nil, fmt.Errorf("could not get MetroMan versions: %v", err)
+		}
+	}
+
+	server := &ChinaGTFSServer{
+		MetromanServer: metroman_server,
+		city_statuses:  make(map[string]CityStatus),
+	}
+
+	if opts.Offline {
+		return server, nil
+	}
+
+	// Generation only needs Baidu for full stop lookups, so carry on without it like an offline server
 	baidu_server, err := baidu_client.CreateServer()
 	if err != nil {
-		panic(err)
+		log.Printf("Warning: Baidu unavailable, continuing without it: %v", err)
+		return server, nil
 	}
 
 	metroman_server.SetBaiduServer(baidu_server)
+	server.BaiduServer = baidu_server
 
-	return &ChinaGTFSServer{
-		MetromanServer: metroman_server,
-		BaiduServer:    baidu_server,
-	}, nil
+	return server, nil
+}
+
+// Nil when Baidu is reachable, or when running without Baidu at all
+func (s *ChinaGTFSServer) BaiduPing() error {
+	if s.BaiduServer == nil {
+		return nil
+	}
+	return s.BaiduServer.Ping()
+}
+
+// Chelaile code for a MetroMan city code, from the Baidu city mapping
+func (s *ChinaGTFSServer) ChelaileCode(city string) (string, error) {
+	if s.BaiduServer == nil {
+		return "", fmt.Errorf("chelaile codes for %s require a Baidu server", city)
+	}
+
+	chelaile_code, found := s.BaiduServer.GetChelaileCode(city)
+	if !found {
+		return "", fmt.Errorf("no chelaile code for %s", city)
+	}
+
+	return chelaile_code, nil
+}
+
+// Refetch Baidu's subway cities, logging when its subway version moved since the last check. Empty without Baidu
+func (s *ChinaGTFSServer) BaiduRefreshSubwayVersion() (string, error) {
+	if s.BaiduServer == nil {
+		return "", nil
+	}
+
+	previous_version := s.BaiduServer.SubwayVersion()
+	changed, err := s.BaiduServer.RefreshSubwayCities()
+	if err != nil {
+		return "", err
+	}
+
+	current_version := s.BaiduServer.SubwayVersion()
+	if changed {
+		log.Printf("Baidu subway version changed from %s to %s, MetroMan data may be updated soon", previous_version, current_version)
+	}
+
+	return current_version, nil
 }
 
 func (s *ChinaGTFSServer) MetromanLoadCity(city string) error {
 	return s.MetromanServer.LoadCity(city)
 }
 
+func (s *ChinaGTFSServer) MetromanLoadCityMetadataOnly(city string) error {
+	return s.MetromanServer.LoadCityMetadataOnly(city)
+}
+
+func (s *ChinaGTFSServer) SetCityLoaded(city string, version string) {
+	s.city_statuses_lock.Lock()
+	defer s.city_statuses_lock.Unlock()
+
+	s.initCityStatuses()
+	s.city_statuses[city] = CityStatus{
+		Loaded:    true,
+		Version:   version,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// A failure keeps the city marked as loaded if an earlier generation succeeded
+func (s *ChinaGTFSServer) SetCityFailed(city string, version string, err error) {
+	s.city_statuses_lock.Lock()
+	defer s.city_statuses_lock.Unlock()
+
+	s.initCityStatuses()
+	s.city_statuses[city] = CityStatus{
+		Loaded:    s.city_statuses[city].Loaded,
+		Failed:    true,
+		LastError: err.Error(),
+		Version:   version,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// Servers not made by CreateServerWithOptions start without a map, city_statuses_lock must be held
+func (s *ChinaGTFSServer) initCityStatuses() {
+	if s.city_statuses == nil {
+		s.city_statuses = make(map[string]CityStatus)
+	}
+}
+
+func (s *ChinaGTFSServer) GetCityStatuses() map[string]CityStatus {
+	s.city_statuses_lock.Lock()
+	defer s.city_statuses_lock.Unlock()
+
+	statuses := make(map[string]CityStatus, len(s.city_statuses))
+	for city, status := range s.city_statuses {
+		statuses[city] = status
+	}
+	return statuses
+}
+
+// Load the city only if it has not already been loaded
+func (s *ChinaGTFSServer) MetromanEnsureCityLoaded(city string) error {
+	// Cities loaded with only metadata are reloaded in full
+	if loaded_city, loaded := s.MetromanServer.Cities[city]; loaded && !loaded_city.MetadataOnly {
+		return nil
+	}
+	return s.MetromanServer.LoadCity(city)
+}
+
+func (s *ChinaGTFSServer) MetromanRefreshVersions() error {
+	return s.MetromanServer.RefreshVersions()
+}
+
 func (s *ChinaGTFSServer) MetromanGetCityVersion(city string) (string, error) {
 	return s.MetromanServer.GetCityVersion(city)
 }
 
-func addFileToZip(zip_writer *zip.Writer, filename string, contents []byte) error {
+func newZipWriter(output io.Writer, compression CompressionLevel) *zip.Writer {
+	zip_writer := zip.NewWriter(output)
+
+	// Default and store need no compressor, store skips Deflate entirely
+	flate_level := flate.DefaultCompression
+	switch compression {
+	case COMPRESSION_BEST_SPEED:
+		flate_level = flate.BestSpeed
+	case COMPRESSION_BEST_COMPRESSION:
+		flate_level = flate.BestCompression
+	}
+
+	if flate_level != flate.DefaultCompression {
+		zip_writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, flate_level)
+		})
+	}
+
+	return zip_writer
+}
+
+func addFileToZip(zip_writer *zip.Writer, compression CompressionLevel, filename string, contents []byte) error {
+	method := zip.Deflate
+	if compression == COMPRESSION_STORE {
+		method = zip.Store
+	}
+
 	header := &zip.FileHeader{
 		Name:   filename,
-		Method: zip.Deflate,
+		Method: method,
 	}
 
 	file_writer, err := zip_writer.CreateHeader(header)
@@ -57,6 +272,46 @@ func addFileToZip(zip_writer *zip.Writer, filename string, contents []byte) erro
 	return err
 }
 
+// Runs the independent GTFS generators, swapped for runSequentially to compare against
+var runGenerators = runConcurrently
+
+// Run every task in order, stopping at the first error
+func runSequentially(tasks ...func() error) error {
+	for _, task := range tasks {
+		if err := task(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run every task in its own goroutine, returning the error of the earliest failing task in argument order
+func runConcurrently(tasks ...func() error) error {
+	var wait_group sync.WaitGroup
+	errs := make([]error, len(tasks))
+
+	for i, task := range tasks {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+			errs[i] = task()
+		}()
+	}
+	wait_group.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gtfsFile struct {
+	name     string
+	contents string
+}
+
 func writeDebugFile(dir string, filename string, contents []byte) error {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
@@ -66,78 +321,339 @@ func writeDebugFile(dir string, filename string, contents []byte) error {
 	return os.WriteFile(path, contents, 0o644)
 }
 
+func (s *ChinaGTFSServer) MetromanGetCityHolidays(city string) ([]metroman_client.MetromanDate, error) {
+	return s.MetromanServer.GetCityHolidays(city)
+}
+
+func (s *ChinaGTFSServer) MetromanGetCitySchedules(city string) (map[string]metroman_client.MetromanSchedule, error) {
+	return s.MetromanServer.GetCitySchedules(city)
+}
+
+func (s *ChinaGTFSServer) MetromanGetFareMatrices(city string) ([]metroman_client.MetromanFareMatrix, error) {
+	return s.MetromanServer.GetFareMatrices(city)
+}
+
+func (s *ChinaGTFSServer) MetromanGenerateFareMatrixCSV(city string) (string, error) {
+	return s.MetromanServer.GenerateFareMatrixCSV(city)
+}
+
+func (s *ChinaGTFSServer) MetromanGetTripTimetable(city string, trip_id string) (metroman_client.MetromanTripTimetable, error) {
+	return s.MetromanServer.GetTripTimetable(city, trip_id)
+}
+
+func (s *ChinaGTFSServer) MetromanGetDepartures(city string, station_code string, date metroman_client.MetromanDate, after_minutes int, limit int) ([]metroman_client.MetromanDepartures, error) {
+	return s.MetromanServer.GetDepartures(city, station_code, date, after_minutes, limit)
+}
+
+func (s *ChinaGTFSServer) MetromanFindCoordinateDrift(city string, threshold_meters float64) ([]metroman_client.MetromanCoordinateDrift, error) {
+	return s.MetromanServer.FindCoordinateDrift(city, threshold_meters)
+}
+
+func (s *ChinaGTFSServer) MetromanGetCityStats(city string) (*metroman_client.MetromanCityStats, error) {
+	return s.MetromanServer.GetCityStats(city)
+}
+
+func (s *ChinaGTFSServer) MetromanIncompleteCities() []string {
+	return s.MetromanServer.IncompleteCities()
+}
+
+func (s *ChinaGTFSServer) MetromanGetRouteSchedule(city string, route_code string) ([]metroman_client.MetromanRouteSchedule, error) {
+	return s.MetromanServer.GetRouteSchedule(city, route_code)
+}
+
+func (s *ChinaGTFSServer) MetromanFindShapeGaps(city string, threshold_meters float64) ([]metroman_client.MetromanShapeGap, error) {
+	return s.MetromanServer.FindShapeGaps(city, threshold_meters)
+}
+
+func (s *ChinaGTFSServer) MetromanGetLineDirections(city string, line_code string) ([2]metroman_client.MetromanLineDirection, error) {
+	return s.MetromanServer.GetLineDirections(city, line_code)
+}
+
 func (s *ChinaGTFSServer) MetromanGetRawZip(city string) ([]byte, error) {
 	return s.MetromanServer.GetRawZip(city)
 }
 
-func (s *ChinaGTFSServer) MetromanGenerateGTFSZip(city string, debug bool) ([]byte, error) {
+func (s *ChinaGTFSServer) MetromanGenerateLinesGeoJSON(city string) ([]byte, error) {
+	return s.MetromanServer.GenerateLinesGeoJSON(city)
+}
+
+func (s *ChinaGTFSServer) MetromanGenerateStopsGeoJSON(city string) ([]byte, error) {
+	return s.MetromanServer.GenerateStopsGeoJSON(city)
+}
+
+// Generate a feed containing only the given line codes, useful when iterating on a single line
+func (s *ChinaGTFSServer) MetromanGenerateGTFSZipForLines(city string, line_codes []string, opts GenerateOptions) ([]byte, error) {
+	metroman_city, exists := s.MetromanServer.Cities[city]
+	if !exists {
+		return nil, fmt.Errorf("city %v not loaded", city)
+	}
+
+	// Generators look the city up by code, so generate from a copy of the server holding the filtered city
+	filtered_metroman_server := s.MetromanServer.WithCities(map[string]*metroman_client.MetromanCity{
+		city: metroman_city.FilterLines(line_codes),
+	})
+
+	filtered_server := &ChinaGTFSServer{
+		MetromanServer: filtered_metroman_server,
+		BaiduServer:    s.BaiduServer,
+		ZipCompression: s.ZipCompression,
+	}
+
+	return filtered_server.MetromanGenerateGTFSZip(city, opts)
+}
+
+// Load the city if needed and generate its GTFS zip in one call
+func (s *ChinaGTFSServer) GenerateCity(city string, opts GenerateOptions) ([]byte, error) {
+	if err := s.MetromanEnsureCityLoaded(city); err != nil {
+		return nil, fmt.Errorf("loading city %s: %v", city, err)
+	}
 
-	stops_txt, err := s.MetromanServer.GenerateStopsTXT(city, false)
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(city, opts)
 	if err != nil {
+		return nil, fmt.Errorf("generating GTFS zip for %s: %v", city, err)
+	}
+
+	return gtfs_zip, nil
+}
+
+func (s *ChinaGTFSServer) MetromanGenerateGTFSZip(city string, opts GenerateOptions) ([]byte, error) {
+	output_buf := new(bytes.Buffer)
+	if err := s.MetromanWriteGTFSZip(city, output_buf, opts); err != nil {
 		return nil, err
 	}
 
-	agency_txt := s.MetromanServer.GenerateAgencyTXT(city)
+	return output_buf.Bytes(), nil
+}
+
+// Generate the GTFS zip, collecting non-fatal problems and data-quality compromises (see GenerateOptions.Report)
+// rather than failing on them. The events marshal to a JSON generation log
+func (s *ChinaGTFSServer) MetromanGenerateGTFSZipWithReport(city string, opts GenerateOptions) ([]byte, []metroman_client.MetromanGenerationEvent, error) {
+	report := &metroman_client.MetromanGenerationReport{}
+	opts.Report = report
 
-	routes_txt, err := s.MetromanServer.GenerateRoutesTXT(city)
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(city, opts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	calendar_txt, calendar_dates_txt, err := s.MetromanServer.GenerateCalendarTXT(city)
+	return gtfs_zip, report.Events(), nil
+}
+
+// Write the GTFS zip to any writer, such as an HTTP response or upload. Every file is
+// generated before anything is written so a failure never leaves a partial zip behind
+func (s *ChinaGTFSServer) MetromanWriteGTFSZip(city string, output io.Writer, opts GenerateOptions) error {
+	files, err := s.metromanGenerateGTFSFiles(city, opts)
 	if err != nil {
+		return err
+	}
+
+	zip_writer := newZipWriter(output, s.ZipCompression)
+
+	for _, file := range files {
+		if err := addFileToZip(zip_writer, s.ZipCompression, file.name, []byte(file.contents)); err != nil {
+			return err
+		}
+	}
+
+	return zip_writer.Close()
+}
+
+func (s *ChinaGTFSServer) MetromanGenerateGTFSTarGz(city string, opts GenerateOptions) ([]byte, error) {
+	output_buf := new(bytes.Buffer)
+	if err := s.MetromanWriteGTFSTarGz(city, output_buf, opts); err != nil {
 		return nil, err
 	}
 
-	trips_txt, err := s.MetromanServer.GenerateTripsTXT(city)
+	return output_buf.Bytes(), nil
+}
+
+// Same files as MetromanWriteGTFSZip in a gzipped tarball, compressed at ZipCompression
+func (s *ChinaGTFSServer) MetromanWriteGTFSTarGz(city string, output io.Writer, opts GenerateOptions) error {
+	files, err := s.metromanGenerateGTFSFiles(city, opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	shapes_txt, err := s.MetromanServer.GenerateShapesTXT(city)
+	gzip_level := gzip.DefaultCompression
+	switch s.ZipCompression {
+	case COMPRESSION_STORE:
+		gzip_level = gzip.NoCompression
+	case COMPRESSION_BEST_SPEED:
+		gzip_level = gzip.BestSpeed
+	case COMPRESSION_BEST_COMPRESSION:
+		gzip_level = gzip.BestCompression
+	}
+
+	gzip_writer, err := gzip.NewWriterLevel(output, gzip_level)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	tar_writer := tar.NewWriter(gzip_writer)
+
+	modified := time.Now()
+	for _, file := range files {
+		if err := tar_writer.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0o644,
+			Size:    int64(len(file.contents)),
+			ModTime: modified,
+		}); err != nil {
+			return err
+		}
 
-	stop_times_txt, err := s.MetromanServer.GenerateStopTimesTXT(city)
+		if _, err := tar_writer.Write([]byte(file.contents)); err != nil {
+			return err
+		}
+	}
+
+	if err := tar_writer.Close(); err != nil {
+		return err
+	}
+	return gzip_writer.Close()
+}
+
+// Every file of the feed in the chosen dialect, leaving out files opts excludes
+func (s *ChinaGTFSServer) metromanGenerateGTFSFiles(city string, opts GenerateOptions) ([]gtfsFile, error) {
+	var stops_txt, translations_txt, agency_txt, routes_txt, calendar_txt, calendar_dates_txt, feed_info_txt, trips_txt, shapes_txt, stop_times_txt string
+	var fare_rules_txt, fare_attributes_txt, networks_txt, route_networks_txt, attributions_txt, transfers_txt, pathways_txt string
+
+	// Generators only read the loaded city so they can all run at once
+	err := runGenerators(
+		func() (err error) {
+			stops_txt, err = s.MetromanServer.GenerateStopsTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			translations_txt, err = s.MetromanServer.GenerateTranslationsTXT(city, opts)
+			return err
+		},
+		func() error {
+			agency_txt = s.MetromanServer.GenerateAgencyTXT(city, opts)
+			return nil
+		},
+		func() (err error) {
+			routes_txt, err = s.MetromanServer.GenerateRoutesTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			calendar_txt, calendar_dates_txt, err = s.MetromanServer.GenerateCalendarTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			feed_info_txt, err = s.MetromanServer.GenerateFeedInfoTXT(city)
+			return err
+		},
+		func() (err error) {
+			attributions_txt, err = s.MetromanServer.GenerateAttributionsTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			trips_txt, err = s.MetromanServer.GenerateTripsTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			shapes_txt, err = s.MetromanServer.GenerateShapesTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			stop_times_txt, err = s.MetromanServer.GenerateStopTimesTXT(city, opts)
+			return err
+		},
+		func() (err error) {
+			if opts.IncludeFares {
+				fare_rules_txt, fare_attributes_txt, err = s.MetromanServer.GenerateFaresTXT(city, opts)
+			}
+			return err
+		},
+		func() (err error) {
+			if opts.WalkingWayMode != metroman_client.WALKING_WAY_MODE_IGNORE {
+				transfers_txt, err = s.MetromanServer.GenerateTransfersTXT(city, opts)
+			}
+			return err
+		},
+		func() (err error) {
+			if opts.IncludeFares {
+				networks_txt, route_networks_txt, err = s.MetromanServer.GenerateNetworksTXT(city, opts)
+			}
+			return err
+		},
+		func() (err error) {
+			pathways_txt, err = s.MetromanServer.GeneratePathwaysTXT(city, opts)
+			return err
+		},
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	// --------------------------------------------------------
-	// Debug output
-	// --------------------------------------------------------
+	// Trips cannot reference a shape shapes.txt has no rows for
+	trips_txt, cleared_shape_ids, err := metroman_client.ReconcileShapeIDs(trips_txt, shapes_txt)
+	if err != nil {
+		return nil, fmt.Errorf("could not reconcile shapes for %s: %v", city, err)
+	}
+	for _, shape_id := range cleared_shape_ids {
+		if opts.Report != nil {
+			opts.Report.Add(metroman_client.GENERATION_EVENT_SHAPE_ID_CLEARED, shape_id, "shape %s: cleared from trips, shapes.txt has no rows for it", shape_id)
+		}
+	}
+
+	if err := metroman_client.ValidateFeedReferences(routes_txt, calendar_txt, calendar_dates_txt, trips_txt, stop_times_txt); err != nil {
+		return nil, fmt.Errorf("inconsistent GTFS for %s: %v", city, err)
+	}
 
-	if debug {
-		debug_dir := "debug"
+	files := []gtfsFile{
+		{"stops.txt", stops_txt},
+		{"translations.txt", translations_txt},
+		{"agency.txt", agency_txt},
+		{"routes.txt", routes_txt},
+		{"calendar.txt", calendar_txt},
+		{"calendar_dates.txt", calendar_dates_txt},
+		{"feed_info.txt", feed_info_txt},
+		{"attributions.txt", attributions_txt},
+		{"trips.txt", trips_txt},
+		{"shapes.txt", shapes_txt},
+		{"stop_times.txt", stop_times_txt},
+	}
+	if opts.WalkingWayMode != metroman_client.WALKING_WAY_MODE_IGNORE {
+		files = append(files, gtfsFile{"transfers.txt", transfers_txt})
+	}
+	// Only with exits, pathways.txt makes validators expect every station to have pathways
+	if len(s.MetromanServer.Cities[city].StationExitsByCode) > 0 {
+		files = append(files, gtfsFile{"pathways.txt", pathways_txt})
+	}
+	if opts.IncludeFares {
+		files = append(files,
+			gtfsFile{"fare_rules.txt", fare_rules_txt},
+			gtfsFile{"fare_attributes.txt", fare_attributes_txt},
+			gtfsFile{"networks.txt", networks_txt},
+			gtfsFile{"route_networks.txt", route_networks_txt},
+		)
+	}
 
-		writeDebugFile(debug_dir, "stops.txt", []byte(stops_txt))
-		writeDebugFile(debug_dir, "agency.txt", []byte(agency_txt))
-		writeDebugFile(debug_dir, "routes.txt", []byte(routes_txt))
-		writeDebugFile(debug_dir, "calendar.txt", []byte(calendar_txt))
-		writeDebugFile(debug_dir, "calendar_dates.txt", []byte(calendar_dates_txt))
-		writeDebugFile(debug_dir, "trips.txt", []byte(trips_txt))
-		writeDebugFile(debug_dir, "shapes.txt", []byte(shapes_txt))
-		writeDebugFile(debug_dir, "stop_times.txt", []byte(stop_times_txt))
+	for i := range files {
+		contents, err := opts.ApplyExcludeColumns(files[i].name, files[i].contents)
+		if err != nil {
+			return nil, err
+		}
+		files[i].contents = opts.ApplyLineEnding(contents)
 	}
 
 	// --------------------------------------------------------
-	// Build ZIP
+	// Debug output
 	// --------------------------------------------------------
 
-	output_buf := new(bytes.Buffer)
-	zip_writer := zip.NewWriter(output_buf)
-
-	addFileToZip(zip_writer, "stops.txt", []byte(stops_txt))
-	addFileToZip(zip_writer, "agency.txt", []byte(agency_txt))
-	addFileToZip(zip_writer, "routes.txt", []byte(routes_txt))
-	addFileToZip(zip_writer, "calendar.txt", []byte(calendar_txt))
-	addFileToZip(zip_writer, "calendar_dates.txt", []byte(calendar_dates_txt))
-	addFileToZip(zip_writer, "trips.txt", []byte(trips_txt))
-	addFileToZip(zip_writer, "shapes.txt", []byte(shapes_txt))
-	addFileToZip(zip_writer, "stop_times.txt", []byte(stop_times_txt))
+	if opts.Debug {
+		for _, file := range files {
+			writeDebugFile("debug", file.name, []byte(file.contents))
+		}
+	}
 
-	zip_writer.Close()
+	included_files := []gtfsFile{}
+	for _, file := range files {
+		if opts.IncludesFile(file.name) {
+			included_files = append(included_files, file)
+		}
+	}
 
-	return output_buf.Bytes(), nil
+	return included_files, nil
 }
@@ -0,0 +1,762 @@
+package china_gtfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"tgrcode.com/baidu_client"
+	"tgrcode.com/china_gtfs/common"
+	"tgrcode.com/metroman_client"
+)
+
+// Fixture city shared with the metroman tests, see metroman/package_test.go
+const test_city_code = "xx"
+const test_zip_prefix = "20250615"
+
+// A server without Baidu holding the fixture city, built without touching the network
+func newTestServer(t testing.TB) *ChinaGTFSServer {
+	t.Helper()
+
+	metroman_server := &metroman_client.MetromanServer{
+		CityZips:      map[string][]byte{},
+		Cities:        map[string]*metroman_client.MetromanCity{},
+		ZipDateLookup: map[string]string{test_city_code: test_zip_prefix},
+		ChinaHandler:  &common.ChinaHandler{},
+	}
+	if err := metroman_server.LoadCityFromDir(test_city_code, test_zip_prefix, "metroman/testdata/xx"); err != nil {
+		t.Fatalf("could not load fixture: %v", err)
+	}
+
+	return &ChinaGTFSServer{
+		MetromanServer: metroman_server,
+		city_statuses:  make(map[string]CityStatus),
+	}
+}
+
+// Filename to contents of every file in a zip
+func readZip(t testing.TB, contents []byte) map[string]string {
+	t.Helper()
+
+	zip_reader, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("could not open generated zip: %v", err)
+	}
+
+	files := map[string]string{}
+	for _, file := range zip_reader.File {
+		file_reader, err := file.Open()
+		if err != nil {
+			t.Fatalf("could not open %s: %v", file.Name, err)
+		}
+		file_contents, err := io.ReadAll(file_reader)
+		file_reader.Close()
+		if err != nil {
+			t.Fatalf("could not read %s: %v", file.Name, err)
+		}
+		files[file.Name] = string(file_contents)
+	}
+	return files
+}
+
+// Every value of a column in a generated CSV
+func csvColumn(t testing.TB, contents string, column string) []string {
+	t.Helper()
+
+	records, err := csv.NewReader(strings.NewReader(contents)).ReadAll()
+	if err != nil || len(records) == 0 {
+		t.Fatalf("could not parse generated CSV: %v", err)
+	}
+	column_idx := slices.Index(records[0], column)
+	if column_idx == -1 {
+		t.Fatalf("generated CSV has no %s column", column)
+	}
+
+	values := []string{}
+	for _, record := range records[1:] {
+		values = append(values, record[column_idx])
+	}
+	return values
+}
+
+func TestGenerateWithoutBaidu(t *testing.T) {
+	s := newTestServer(t)
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{IncludeFares: true})
+	if err != nil {
+		t.Fatalf("could not generate without Baidu: %v", err)
+	}
+
+	files := readZip(t, gtfs_zip)
+	for _, filename := range []string{"stops.txt", "agency.txt", "routes.txt", "trips.txt", "stop_times.txt", "fare_attributes.txt"} {
+		if strings.Count(files[filename], "\n") < 2 {
+			t.Errorf("%s has no records:\n%s", filename, files[filename])
+		}
+	}
+	if strings.Contains(files["attributions.txt"], "Baidu") {
+		t.Errorf("Baidu is credited without being used:\n%s", files["attributions.txt"])
+	}
+
+	// Stop URLs need Baidu, asking for them fails instead of panicking
+	if _, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{FullBaiduLookups: true}); err == nil {
+		t.Errorf("expected an error for full Baidu lookups without Baidu")
+	}
+}
+
+func TestZipCompressionLevels(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, compression := range []CompressionLevel{COMPRESSION_DEFAULT, COMPRESSION_STORE, COMPRESSION_BEST_SPEED, COMPRESSION_BEST_COMPRESSION} {
+		s.ZipCompression = compression
+
+		gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{})
+		if err != nil {
+			t.Fatalf("compression %d: %v", compression, err)
+		}
+
+		zip_reader, err := zip.NewReader(bytes.NewReader(gtfs_zip), int64(len(gtfs_zip)))
+		if err != nil {
+			t.Fatalf("compression %d: invalid zip: %v", compression, err)
+		}
+
+		expected_method := zip.Deflate
+		if compression == COMPRESSION_STORE {
+			expected_method = zip.Store
+		}
+		for _, file := range zip_reader.File {
+			if file.Method != expected_method {
+				t.Errorf("compression %d: %s uses method %d, expected %d", compression, file.Name, file.Method, expected_method)
+			}
+		}
+
+		if files := readZip(t, gtfs_zip); !strings.HasPrefix(files["stops.txt"], "stop_id,") {
+			t.Errorf("compression %d: stops.txt did not survive the round trip:\n%s", compression, files["stops.txt"])
+		}
+	}
+}
+
+func TestGenerateForLines(t *testing.T) {
+	s := newTestServer(t)
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZipForLines(test_city_code, []string{"XXML01"}, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readZip(t, gtfs_zip)
+
+	if route_ids := csvColumn(t, files["routes.txt"], "route_id"); !slices.Equal(route_ids, []string{"XXMW01", "XXMW02"}) {
+		t.Errorf("expected only line 1's routes, got %v", route_ids)
+	}
+	// Alpha, Bravo and Charlie
+	if stop_ids := csvColumn(t, files["stops.txt"], "stop_id"); !slices.Equal(stop_ids, []string{"XXMS01", "XXMS02", "XXMS03"}) {
+		t.Errorf("expected only line 1's stations, got %v", stop_ids)
+	}
+	for _, shape_id := range csvColumn(t, files["shapes.txt"], "shape_id") {
+		if shape_id != "shape_XXMW01" && shape_id != "shape_XXMW02" {
+			t.Errorf("shapes.txt has %s from another line", shape_id)
+		}
+	}
+
+	// The loaded city keeps every line
+	if lines := len(s.MetromanServer.Cities[test_city_code].Lines); lines != 3 {
+		t.Errorf("expected the loaded city to keep its 3 lines, has %d", lines)
+	}
+}
+
+func TestWriteGTFSZip(t *testing.T) {
+	s := newTestServer(t)
+
+	var buf bytes.Buffer
+	if err := s.MetromanWriteGTFSZip(test_city_code, &buf, GenerateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	written_files := readZip(t, buf.Bytes())
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated_files := readZip(t, gtfs_zip)
+
+	if len(written_files) == 0 || len(written_files) != len(generated_files) {
+		t.Fatalf("expected the same files, got %d and %d", len(written_files), len(generated_files))
+	}
+	for filename, contents := range generated_files {
+		if written_files[filename] != contents {
+			t.Errorf("%s differs between the writer and byte slice APIs", filename)
+		}
+	}
+
+	// Nothing is written when generation fails
+	var failed_buf bytes.Buffer
+	if err := s.MetromanWriteGTFSZip("zz", &failed_buf, GenerateOptions{}); err == nil || failed_buf.Len() != 0 {
+		t.Errorf("expected an error and no output for a city that is not loaded, got %v and %d bytes", err, failed_buf.Len())
+	}
+}
+
+// Use runner for the GTFS generators for the rest of the test
+func setGeneratorRunner(t testing.TB, runner func(tasks ...func() error) error) {
+	previous_runner := runGenerators
+	runGenerators = runner
+	t.Cleanup(func() {
+		runGenerators = previous_runner
+	})
+}
+
+func TestGenerateMatchesSequential(t *testing.T) {
+	s := newTestServer(t)
+	opts := GenerateOptions{IncludeFares: true, WalkingWayMode: metroman_client.WALKING_WAY_MODE_TRANSFERS}
+
+	concurrent_files, err := s.metromanGenerateGTFSFiles(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setGeneratorRunner(t, runSequentially)
+	sequential_files, err := s.metromanGenerateGTFSFiles(test_city_code, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(concurrent_files, sequential_files) {
+		t.Errorf("concurrent generation differs from sequential generation")
+	}
+}
+
+func TestRunConcurrentlyReturnsFirstError(t *testing.T) {
+	first_err := errors.New("first")
+	second_err := errors.New("second")
+
+	ran := make([]bool, 3)
+	err := runConcurrently(
+		func() error {
+			ran[0] = true
+			return nil
+		},
+		func() error {
+			ran[1] = true
+			return first_err
+		},
+		func() error {
+			ran[2] = true
+			return second_err
+		},
+	)
+	if err != first_err {
+		t.Errorf("expected the earliest error in argument order, got %v", err)
+	}
+	// Unlike runSequentially every task still runs
+	if !slices.Equal(ran, []bool{true, true, true}) {
+		t.Errorf("expected every task to run, got %v", ran)
+	}
+}
+
+// Concurrent generation only pulls ahead with several CPUs, compare with -cpu 1,4
+func BenchmarkGenerateGTFSFiles(b *testing.B) {
+	s := newTestServer(b)
+	opts := GenerateOptions{IncludeFares: true, WalkingWayMode: metroman_client.WALKING_WAY_MODE_TRANSFERS}
+
+	for _, runner := range []struct {
+		name string
+		run  func(tasks ...func() error) error
+	}{
+		{"sequential", runSequentially},
+		{"concurrent", runConcurrently},
+	} {
+		b.Run(runner.name, func(b *testing.B) {
+			setGeneratorRunner(b, runner.run)
+			for b.Loop() {
+				if _, err := s.metromanGenerateGTFSFiles(test_city_code, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The fixture city zipped like MetroMan's OSS serves it
+func fixtureZip(t testing.TB) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zip_writer := zip.NewWriter(&buf)
+	err := fs.WalkDir(os.DirFS("metroman/testdata/xx"), ".", func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		contents, err := os.ReadFile(path.Join("metroman/testdata/xx", file_path))
+		if err != nil {
+			return err
+		}
+		file_writer, err := zip_writer.Create(file_path)
+		if err != nil {
+			return err
+		}
+		_, err = file_writer.Write(contents)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not zip fixture: %v", err)
+	}
+	if err := zip_writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGenerateCityLoadsAndGenerates(t *testing.T) {
+	city_zip := fixtureZip(t)
+
+	// Serve the fixture for every MetroMan download
+	downloads := 0
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		downloads++
+		recorder := httptest.NewRecorder()
+		recorder.Write(city_zip)
+		return recorder.Result(), nil
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+
+	s := &ChinaGTFSServer{
+		MetromanServer: &metroman_client.MetromanServer{
+			CityZips:      map[string][]byte{},
+			Cities:        map[string]*metroman_client.MetromanCity{},
+			ZipDateLookup: map[string]string{test_city_code: test_zip_prefix},
+			ChinaHandler:  &common.ChinaHandler{},
+		},
+	}
+
+	for range 2 {
+		gtfs_zip, err := s.GenerateCity(test_city_code, GenerateOptions{IncludeFares: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := readZip(t, gtfs_zip)
+		if stop_ids := csvColumn(t, files["stops.txt"], "stop_id"); len(stop_ids) == 0 {
+			t.Errorf("generated stops.txt has no stops")
+		}
+		if _, ok := files["fare_attributes.txt"]; !ok {
+			t.Errorf("options were not passed through, no fare_attributes.txt")
+		}
+	}
+	// The second call uses the loaded city
+	if downloads != 1 {
+		t.Errorf("expected 1 download, got %d", downloads)
+	}
+
+	if _, err := s.GenerateCity("zz", GenerateOptions{}); err == nil || !strings.Contains(err.Error(), "loading city zz") {
+		t.Errorf("expected loading an unknown city to fail, got %v", err)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGenerateOptionCombinations(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, test := range []struct {
+		name      string
+		opts      GenerateOptions
+		files     []string
+		stop_id   string
+		has_fares bool
+	}{
+		{"defaults", GenerateOptions{}, nil, "XXMS01", false},
+		{"fares", GenerateOptions{IncludeFares: true}, nil, "XXMS01", true},
+		{"prefixed fares", GenerateOptions{IncludeFares: true, IDPrefix: "xx_"}, nil, "xx_XXMS01", true},
+		{"prefixed subset", GenerateOptions{IDPrefix: "xx_", Files: []string{"stops.txt", "routes.txt"}}, []string{"routes.txt", "stops.txt"}, "xx_XXMS01", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := readZip(t, gtfs_zip)
+
+			if test.files != nil {
+				filenames := slices.Sorted(maps.Keys(files))
+				if !slices.Equal(filenames, test.files) {
+					t.Errorf("expected only %v, got %v", test.files, filenames)
+				}
+			}
+			if stop_ids := csvColumn(t, files["stops.txt"], "stop_id"); stop_ids[0] != test.stop_id {
+				t.Errorf("expected the first stop to be %s, got %s", test.stop_id, stop_ids[0])
+			}
+			if _, has_fares := files["fare_attributes.txt"]; has_fares != test.has_fares {
+				t.Errorf("expected fare_attributes.txt %v, got %v", test.has_fares, has_fares)
+			}
+
+			// Every file agrees on the prefix
+			if trips_txt, ok := files["trips.txt"]; ok {
+				for _, route_id := range csvColumn(t, trips_txt, "route_id") {
+					if !strings.HasPrefix(route_id, test.opts.IDPrefix+"XXMW") {
+						t.Errorf("trips.txt references route %s without prefix %q", route_id, test.opts.IDPrefix)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Answer version.txt with the fixture city and fail every other request, like Baidu being down
+func mockBaiduDown(t testing.TB) {
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(r.URL.Path, "/version.txt") {
+			return nil, errors.New("connection refused")
+		}
+		recorder := httptest.NewRecorder()
+		recorder.WriteString(test_city_code + "," + test_zip_prefix + ",1\n")
+		return recorder.Result(), nil
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+}
+
+func TestCreateServerWithBaiduDown(t *testing.T) {
+	mockBaiduDown(t)
+
+	s, err := CreateServer()
+	if err != nil {
+		t.Fatalf("expected to start without Baidu, got %v", err)
+	}
+	if s.BaiduServer != nil || s.MetromanServer.BaiduServer != nil {
+		t.Errorf("expected no Baidu server")
+	}
+	if err := s.BaiduPing(); err != nil {
+		t.Errorf("expected a server without Baidu to be ready, got %v", err)
+	}
+	if zip_date, ok := s.MetromanServer.ZipDate(test_city_code); !ok || zip_date != test_zip_prefix {
+		t.Errorf("expected MetroMan versions to load, got %q", zip_date)
+	}
+}
+
+// Fail every request, like MetroMan and Baidu both being down
+func mockOutage(t testing.TB) {
+	default_transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	t.Cleanup(func() {
+		http.DefaultTransport = default_transport
+	})
+}
+
+func TestCreateServerWithoutVersions(t *testing.T) {
+	mockOutage(t)
+
+	if _, err := CreateServerWithOptions(ServerOptions{Offline: true}); err == nil {
+		t.Errorf("expected an unreachable version.txt to fail by default")
+	}
+
+	s, err := CreateServerWithOptions(ServerOptions{Offline: true, AllowMissingVersions: true})
+	if err != nil {
+		t.Fatalf("expected to start without versions, got %v", err)
+	}
+	if _, ok := s.MetromanServer.ZipDate(test_city_code); ok {
+		t.Errorf("expected no versions")
+	}
+	// Cities fail individually instead
+	if _, err := s.GenerateCity(test_city_code, GenerateOptions{}); err == nil {
+		t.Errorf("expected generating without versions to fail")
+	}
+}
+
+func TestVersionsCacheUsedWhenFetchFails(t *testing.T) {
+	versions_cache_path := path.Join(t.TempDir(), "version.txt")
+
+	// A successful fetch writes the cache
+	mockBaiduDown(t)
+	if _, err := CreateServerWithOptions(ServerOptions{Offline: true, VersionsCachePath: versions_cache_path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(versions_cache_path); err != nil {
+		t.Fatalf("expected versions to be cached: %v", err)
+	}
+
+	mockOutage(t)
+	s, err := CreateServerWithOptions(ServerOptions{Offline: true, VersionsCachePath: versions_cache_path})
+	if err != nil {
+		t.Fatalf("expected the cached versions to be used, got %v", err)
+	}
+	if zip_date, ok := s.MetromanServer.ZipDate(test_city_code); !ok || zip_date != test_zip_prefix {
+		t.Errorf("expected %s from the cache, got %q", test_zip_prefix, zip_date)
+	}
+
+	// Without a cache the outage is fatal
+	if _, err := CreateServerWithOptions(ServerOptions{Offline: true, VersionsCachePath: path.Join(t.TempDir(), "version.txt")}); err == nil {
+		t.Errorf("expected a missing cache to fail")
+	}
+}
+
+func TestLineEndingUsedThroughout(t *testing.T) {
+	s := newTestServer(t)
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{IncludeFares: true, LineEnding: metroman_client.LINE_ENDING_CRLF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, contents := range readZip(t, gtfs_zip) {
+		if strings.Count(contents, "\n") != strings.Count(contents, "\r\n") || !strings.HasSuffix(contents, "\r\n") {
+			t.Errorf("%s has LF line endings", filename)
+		}
+	}
+
+	gtfs_zip, err = s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{
+		IncludeFares:        true,
+		LineEnding:          metroman_client.LINE_ENDING_CRLF,
+		OmitTrailingNewline: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, contents := range readZip(t, gtfs_zip) {
+		if strings.Count(contents, "\n") != strings.Count(contents, "\r\n") || strings.HasSuffix(contents, "\n") {
+			t.Errorf("%s should end without a newline", filename)
+		}
+	}
+}
+
+func TestChelaileCode(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.ChelaileCode(test_city_code); err == nil {
+		t.Errorf("expected an error without Baidu")
+	}
+
+	s.BaiduServer = &baidu_client.BaiduServer{
+		CityUIDMappingsByMetromanCode: map[string]baidu_client.CityUIDMapping{
+			test_city_code: {BaiduID: "999", MetromanCode: test_city_code, ChelaileCode: "099"},
+		},
+	}
+	if chelaile_code, err := s.ChelaileCode(test_city_code); err != nil || chelaile_code != "099" {
+		t.Errorf("expected 099, got %q %v", chelaile_code, err)
+	}
+	if _, err := s.ChelaileCode("zz"); err == nil {
+		t.Errorf("expected an error for a city without a code")
+	}
+}
+
+func TestReportCollectsEveryProblem(t *testing.T) {
+	s := newTestServer(t)
+	city := s.MetromanServer.Cities[test_city_code]
+
+	// Alpha to Foxtrot has no valid fare either way and line 2 has no paths
+	fare_matrix := *city.FareMatrices[0]
+	fare_matrix[0][5] = -1
+	fare_matrix[5][0] = -1
+	for _, line := range city.Lines {
+		if line.Code == "XXML02" {
+			line.StationPaths = map[string][]common.Coordinate{}
+		}
+	}
+
+	if _, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{IncludeFares: true}); err == nil {
+		t.Fatalf("expected the invalid fare to fail without a report")
+	}
+
+	gtfs_zip, events, err := s.MetromanGenerateGTFSZipWithReport(test_city_code, GenerateOptions{IncludeFares: true})
+	if err != nil {
+		t.Fatalf("expected problems to be reported rather than fail: %v", err)
+	}
+	if len(gtfs_zip) == 0 {
+		t.Errorf("expected a feed alongside the report")
+	}
+
+	subjects_by_kind := map[metroman_client.MetromanGenerationEventKind][]string{}
+	for _, event := range events {
+		subjects_by_kind[event.Kind] = append(subjects_by_kind[event.Kind], event.Subject)
+	}
+	for kind, expected_subjects := range map[metroman_client.MetromanGenerationEventKind][]string{
+		metroman_client.GENERATION_EVENT_FARE_INVALID:  {"fare_XXMS01_XXMS06", "fare_XXMS06_XXMS01"},
+		metroman_client.GENERATION_EVENT_SHAPE_MISSING: {"shape_XXMW03", "shape_XXMW04"},
+		metroman_client.GENERATION_EVENT_STOP_OMITTED:  {"XXMS07"},
+	} {
+		if subjects := subjects_by_kind[kind]; !slices.Equal(subjects, expected_subjects) {
+			t.Errorf("expected %s events for %v, got %v", kind, expected_subjects, subjects)
+		}
+	}
+}
+
+func TestTarGzMatchesZip(t *testing.T) {
+	s := newTestServer(t)
+
+	gtfs_tar_gz, err := s.MetromanGenerateGTFSTarGz(test_city_code, GenerateOptions{IncludeFares: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzip_reader, err := gzip.NewReader(bytes.NewReader(gtfs_tar_gz))
+	if err != nil {
+		t.Fatalf("not gzipped: %v", err)
+	}
+	tar_reader := tar.NewReader(gzip_reader)
+
+	tar_files := map[string]string{}
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		contents, err := io.ReadAll(tar_reader)
+		if err != nil {
+			t.Fatalf("could not read %s: %v", header.Name, err)
+		}
+		tar_files[header.Name] = string(contents)
+	}
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{IncludeFares: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zip_files := readZip(t, gtfs_zip); len(tar_files) == 0 || !maps.Equal(tar_files, zip_files) {
+		t.Errorf("expected the tarball to hold the zip's %d files, got %d", len(zip_files), len(tar_files))
+	}
+}
+
+func TestExcludeTimepointColumn(t *testing.T) {
+	s := newTestServer(t)
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readZip(t, gtfs_zip)
+
+	gtfs_zip, err = s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{
+		ExcludeColumns: map[string][]string{"stop_times.txt": {"timepoint"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded_files := readZip(t, gtfs_zip)
+
+	header := strings.SplitN(excluded_files["stop_times.txt"], "\n", 2)[0]
+	if strings.Contains(header, "timepoint") || !strings.Contains(header, "arrival_time") {
+		t.Errorf("expected only timepoint to be removed, got header %s", header)
+	}
+	if len(csvColumn(t, excluded_files["stop_times.txt"], "stop_id")) != len(csvColumn(t, files["stop_times.txt"], "stop_id")) {
+		t.Errorf("expected every stop_times row to be kept")
+	}
+	// Other files are untouched
+	if excluded_files["trips.txt"] != files["trips.txt"] {
+		t.Errorf("expected trips.txt to be unchanged")
+	}
+}
+
+func TestShapelessRouteReconciled(t *testing.T) {
+	s := newTestServer(t)
+
+	// Line 2 has no paths so shapes.txt has nothing for its routes
+	for _, line := range s.MetromanServer.Cities[test_city_code].Lines {
+		if line.Code == "XXML02" {
+			line.StationPaths = map[string][]common.Coordinate{}
+		}
+	}
+
+	gtfs_zip, events, err := s.MetromanGenerateGTFSZipWithReport(test_city_code, GenerateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtfs_files := readZip(t, gtfs_zip)
+
+	shape_ids := csvColumn(t, gtfs_files["shapes.txt"], "shape_id")
+	trip_route_ids := csvColumn(t, gtfs_files["trips.txt"], "route_id")
+	for trip_idx, shape_id := range csvColumn(t, gtfs_files["trips.txt"], "shape_id") {
+		switch trip_route_ids[trip_idx] {
+		case "XXMW01", "XXMW02":
+			if shape_id != "shape_"+trip_route_ids[trip_idx] {
+				t.Errorf("expected %s trips to keep their shape, got %q", trip_route_ids[trip_idx], shape_id)
+			}
+		default:
+			if shape_id != "" {
+				t.Errorf("expected %s trips to have no shape, got %q", trip_route_ids[trip_idx], shape_id)
+			}
+		}
+		if shape_id != "" && !slices.Contains(shape_ids, shape_id) {
+			t.Errorf("trip references %s which is not in shapes.txt", shape_id)
+		}
+	}
+
+	cleared := []string{}
+	for _, event := range events {
+		if event.Kind == metroman_client.GENERATION_EVENT_SHAPE_ID_CLEARED {
+			cleared = append(cleared, event.Subject)
+		}
+	}
+	if !slices.Equal(cleared, []string{"shape_XXMW03", "shape_XXMW04"}) {
+		t.Errorf("expected both line 2 shapes to be reported cleared, got %v", cleared)
+	}
+}
+
+func TestWalkingWayRoutesInFeed(t *testing.T) {
+	// The fixture with a timetable for XXWW01
+	fixture_dir := t.TempDir()
+	if err := os.CopyFS(fixture_dir, os.DirFS("metroman/testdata/xx")); err != nil {
+		t.Fatal(err)
+	}
+	wayschedule_path := path.Join(fixture_dir, test_zip_prefix, "wayschedule.csv")
+	wayschedule_csv, err := os.ReadFile(wayschedule_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wayschedule_path, append(wayschedule_csv, "XXWW01,0,WD\r\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(fixture_dir, test_zip_prefix, "XXWW01.csv"), []byte("500,505\r\n560,565\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t)
+	if err := s.MetromanServer.LoadCityFromDir(test_city_code, test_zip_prefix, fixture_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	gtfs_zip, err := s.MetromanGenerateGTFSZip(test_city_code, GenerateOptions{
+		WalkingWayMode: metroman_client.WALKING_WAY_MODE_ROUTES,
+		IncludeFares:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtfs_files := readZip(t, gtfs_zip)
+
+	if !slices.Contains(csvColumn(t, gtfs_files["routes.txt"], "route_id"), "XXWW01") {
+		t.Errorf("expected XXWW01 in routes.txt")
+	}
+	if !slices.Contains(csvColumn(t, gtfs_files["route_networks.txt"], "route_id"), "XXWW01") {
+		t.Errorf("expected XXWW01 in a network")
+	}
+	if transfers := csvColumn(t, gtfs_files["transfers.txt"], "from_stop_id"); len(transfers) != 0 {
+		t.Errorf("expected no transfers for the walking way, got %v", transfers)
+	}
+	// Walking lines have no geometry
+	trip_route_ids := csvColumn(t, gtfs_files["trips.txt"], "route_id")
+	for trip_idx, shape_id := range csvColumn(t, gtfs_files["trips.txt"], "shape_id") {
+		if trip_route_ids[trip_idx] == "XXWW01" && shape_id != "" {
+			t.Errorf("expected walking trips without a shape, got %q", shape_id)
+		}
+	}
+}